@@ -0,0 +1,49 @@
+package autobackup
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/sbusso/autobackup/sources"
+	"github.com/sbusso/autobackup/stores"
+	"github.com/sbusso/autobackup/tasks"
+)
+
+// BinlogStore returns the S3 store where the MySQL binlogs are shipped, apart
+// from the backups so retention doesn't apply to them
+func BinlogStore() (*stores.S3Config, error) {
+	s3, err := stores.NewS3Config()
+	if err != nil {
+		return nil, err
+	}
+
+	s3.Prefix = siblingPrefix(s3.Prefix, "binlog")
+	s3.Partition = false
+
+	return s3, nil
+}
+
+// MySQLBinlogs recipe to ship the binlogs of a MySQL server to S3 regularly,
+// every 5 minutes unless BINLOG_SCHEDULE is set
+func MySQLBinlogs(source *sources.MySQLConfig) (*tasks.Scheduler, error) {
+
+	var config = tasks.NewConfig()
+
+	config.Schedule = os.Getenv("BINLOG_SCHEDULE")
+	if config.Schedule == "" {
+		config.Schedule = "@every 5m"
+	}
+
+	store, err := BinlogStore()
+	if err != nil {
+		return nil, fmt.Errorf("an error occured getting config, binlogs will not be shipped: %v\n", err)
+	}
+
+	s := tasks.NewScheduler(config, func(c *tasks.Config) error {
+		return source.ShipBinlogs(store)
+	})
+
+	s.Start()
+
+	return s, nil
+}
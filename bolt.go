@@ -0,0 +1,42 @@
+package autobackup
+
+import (
+	"fmt"
+
+	"github.com/sbusso/autobackup/sources"
+	"github.com/sbusso/autobackup/stores"
+	"github.com/sbusso/autobackup/tasks"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Bolt recipe to backup a bolt database opened by the application
+func Bolt(db *bolt.DB) (*tasks.Scheduler, error) {
+
+	var config = tasks.NewConfig()
+
+	var source = sources.NewBoltConfig(db, nil)
+
+	s3, err := stores.NewS3Config()
+	if err != nil {
+		return nil, fmt.Errorf("an error occured getting config, backup will not be scheduled: %v\n", err)
+	}
+
+	repo, err := stores.WithRepository(s3)
+	if err != nil {
+		return nil, fmt.Errorf("an error occured opening repository, backup will not be scheduled: %v\n", err)
+	}
+
+	store, err := stores.WithCatalog(repo)
+	if err != nil {
+		return nil, fmt.Errorf("an error occured opening catalog, backup will not be scheduled: %v\n", err)
+	}
+
+	s, err := tasks.ScheduleBackup(config, source, store)
+	if err != nil {
+		return nil, fmt.Errorf("an error occured during scheduling backup, backup will not be scheduled: %v\n", err)
+	}
+
+	s.Start()
+
+	return s, nil
+}
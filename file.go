@@ -19,11 +19,21 @@ func File(dbName string) (*tasks.Scheduler, error) {
 
 	var source = sources.NewTarballConfig(opts)
 
-	store, err := stores.NewS3Config()
+	s3, err := stores.NewS3Config()
 	if err != nil {
 		return nil, fmt.Errorf("an error occured getting config, backup will not be scheduled: %v\n", err)
 	}
 
+	repo, err := stores.WithRepository(s3)
+	if err != nil {
+		return nil, fmt.Errorf("an error occured opening repository, backup will not be scheduled: %v\n", err)
+	}
+
+	store, err := stores.WithCatalog(repo)
+	if err != nil {
+		return nil, fmt.Errorf("an error occured opening catalog, backup will not be scheduled: %v\n", err)
+	}
+
 	s, err := tasks.ScheduleBackup(config, source, store)
 	if err != nil {
 		return nil, fmt.Errorf("an error occured during scheduling backup, backup will not be scheduled: %v\n", err)
@@ -0,0 +1,41 @@
+package autobackup
+
+import (
+	"fmt"
+
+	"github.com/sbusso/autobackup/sources"
+	"github.com/sbusso/autobackup/stores"
+	"github.com/sbusso/autobackup/tasks"
+)
+
+// Func recipe to backup a state serialized by the application itself
+func Func(name string, backup sources.BackupFunc, restore sources.RestoreFunc) (*tasks.Scheduler, error) {
+
+	var config = tasks.NewConfig()
+
+	var source = sources.NewFuncConfig(name, backup, restore)
+
+	s3, err := stores.NewS3Config()
+	if err != nil {
+		return nil, fmt.Errorf("an error occured getting config, backup will not be scheduled: %v\n", err)
+	}
+
+	repo, err := stores.WithRepository(s3)
+	if err != nil {
+		return nil, fmt.Errorf("an error occured opening repository, backup will not be scheduled: %v\n", err)
+	}
+
+	store, err := stores.WithCatalog(repo)
+	if err != nil {
+		return nil, fmt.Errorf("an error occured opening catalog, backup will not be scheduled: %v\n", err)
+	}
+
+	s, err := tasks.ScheduleBackup(config, source, store)
+	if err != nil {
+		return nil, fmt.Errorf("an error occured during scheduling backup, backup will not be scheduled: %v\n", err)
+	}
+
+	s.Start()
+
+	return s, nil
+}
@@ -0,0 +1,241 @@
+package naming
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/caarlos0/env"
+)
+
+const (
+	// TimestampLayout is the UTC time format of the {timestamp} placeholder,
+	// RFC 3339 without colons so it is a valid filename everywhere
+	TimestampLayout = "2006-01-02T150405Z"
+
+	// LegacyLayout is the local time format of the {time} placeholder
+	LegacyLayout = "20060102150405"
+
+	// PartitionLayout is the directory layout of date partitioned stores
+	PartitionLayout = "2006/01/02"
+)
+
+var (
+	placeholder = regexp.MustCompile(`\{[a-z]+\}`)
+	legacyTime  = regexp.MustCompile(`-(\d{14})(\.|$)`)
+	sequence    uint64
+)
+
+// Template builds backup names from a pattern with placeholders:
+// {prefix} (name given by the source), {job}, {hostname}, {timestamp}
+// (UTC), {time} (local time, original format), {seq} and {ext}
+type Template struct {
+	Pattern string `env:"NAME_TEMPLATE" envDefault:"{prefix}-{time}{ext}"`
+	Job     string `env:"JOB_NAME"`
+
+	once   sync.Once
+	re     *regexp.Regexp
+	layout string
+	loc    *time.Location
+}
+
+var (
+	defaultTemplate *Template
+	defaultOnce     sync.Once
+)
+
+// NewTemplate loads the template configuration from the environment
+func NewTemplate() (*Template, error) {
+	t := &Template{}
+	if err := env.Parse(t); err != nil {
+		return nil, err
+	}
+
+	if err := t.Validate(); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// Default returns the template configured by the environment, falling back
+// to the original naming if the configuration is invalid
+func Default() *Template {
+	defaultOnce.Do(func() {
+		t, err := NewTemplate()
+		if err != nil {
+			fmt.Printf("invalid name template, using default: %v\n", err)
+			t = &Template{Pattern: "{prefix}-{time}{ext}"}
+		}
+
+		defaultTemplate = t
+	})
+
+	return defaultTemplate
+}
+
+// SetDefault replaces the template used by sources and stores
+func SetDefault(t *Template) {
+	defaultOnce.Do(func() {})
+	defaultTemplate = t
+}
+
+// Validate checks that the pattern can be parsed back to a time
+func (t *Template) Validate() error {
+	if !strings.Contains(t.Pattern, "{timestamp}") && !strings.Contains(t.Pattern, "{time}") {
+		return fmt.Errorf("template %q must contain {timestamp} or {time}", t.Pattern)
+	}
+
+	for _, p := range placeholder.FindAllString(t.Pattern, -1) {
+		switch p {
+		case "{prefix}", "{job}", "{hostname}", "{timestamp}", "{time}", "{seq}", "{ext}":
+		default:
+			return fmt.Errorf("unknown placeholder %s in template %q", p, t.Pattern)
+		}
+	}
+
+	return nil
+}
+
+// Name returns the name of a backup created at the specified time, the
+// extension is appended if the pattern has no {ext} placeholder
+func (t *Template) Name(prefix, ext string, now time.Time) string {
+	hostname, _ := os.Hostname()
+	job := t.Job
+	if job == "" {
+		job = prefix
+	}
+
+	name := placeholder.ReplaceAllStringFunc(t.Pattern, func(p string) string {
+		switch p {
+		case "{prefix}":
+			return prefix
+		case "{job}":
+			return job
+		case "{hostname}":
+			return hostname
+		case "{timestamp}":
+			return now.UTC().Format(TimestampLayout)
+		case "{time}":
+			return now.Format(LegacyLayout)
+		case "{seq}":
+			return fmt.Sprintf("%04d", atomic.AddUint64(&sequence, 1))
+		case "{ext}":
+			return ext
+		}
+		return p
+	})
+
+	if !strings.Contains(t.Pattern, "{ext}") {
+		name += ext
+	}
+
+	return name
+}
+
+func (t *Template) compile() {
+	var expr strings.Builder
+	last := 0
+
+	expr.WriteString("^")
+
+	for _, loc := range placeholder.FindAllStringIndex(t.Pattern, -1) {
+		expr.WriteString(regexp.QuoteMeta(t.Pattern[last:loc[0]]))
+
+		switch p := t.Pattern[loc[0]:loc[1]]; p {
+		case "{timestamp}", "{time}":
+			if t.layout != "" {
+				// only the first time placeholder is parsed
+				expr.WriteString(".+?")
+			} else if p == "{timestamp}" {
+				t.layout, t.loc = TimestampLayout, time.UTC
+				expr.WriteString(`(\d{4}-\d{2}-\d{2}T\d{6}Z)`)
+			} else {
+				t.layout, t.loc = LegacyLayout, time.Local
+				expr.WriteString(`(\d{14})`)
+			}
+		case "{seq}":
+			expr.WriteString(`\d+`)
+		case "{ext}":
+			expr.WriteString(`(?:\..*)?`)
+		default:
+			expr.WriteString(".+?")
+		}
+
+		last = loc[1]
+	}
+
+	expr.WriteString(regexp.QuoteMeta(t.Pattern[last:]))
+
+	if !strings.Contains(t.Pattern, "{ext}") {
+		expr.WriteString(`(?:\..*)?`)
+	}
+
+	expr.WriteString("$")
+
+	re, err := regexp.Compile(expr.String())
+	if err == nil {
+		t.re = re
+	}
+}
+
+// Time extracts the creation time of a backup from its name (or path),
+// names created with the original format are also recognized
+func (t *Template) Time(name string) (time.Time, bool) {
+	t.once.Do(t.compile)
+	name = path.Base(name)
+
+	if t.re != nil && t.layout != "" {
+		if m := t.re.FindStringSubmatch(name); m != nil {
+			if ts, err := time.ParseInLocation(t.layout, m[1], t.loc); err == nil {
+				return ts, true
+			}
+		}
+	}
+
+	if m := legacyTime.FindStringSubmatch(name); m != nil {
+		if ts, err := time.ParseInLocation(LegacyLayout, m[1], time.Local); err == nil {
+			return ts, true
+		}
+	}
+
+	return time.Time{}, false
+}
+
+// Backup is a backup name with the time parsed from it
+type Backup struct {
+	Name string
+	Time time.Time
+}
+
+// Sort returns the names recognized by the template ordered from the oldest
+// to the most recent backup, other names are left out
+func (t *Template) Sort(names []string) []Backup {
+	var backups []Backup
+
+	for _, name := range names {
+		if ts, ok := t.Time(name); ok {
+			backups = append(backups, Backup{Name: name, Time: ts})
+		}
+	}
+
+	sort.SliceStable(backups, func(i, j int) bool {
+		if backups[i].Time.Equal(backups[j].Time) {
+			return backups[i].Name < backups[j].Name
+		}
+		return backups[i].Time.Before(backups[j].Time)
+	})
+
+	return backups
+}
+
+// PartitionDir returns the YYYY/MM/DD directory of a backup
+func PartitionDir(t time.Time) string {
+	return t.UTC().Format(PartitionLayout)
+}
@@ -0,0 +1,48 @@
+package naming
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTemplateName(t *testing.T) {
+	r := require.New(t)
+
+	now := time.Date(2018, 9, 1, 10, 15, 0, 0, time.UTC)
+
+	tpl := &Template{Pattern: "{job}-{timestamp}-{seq}{ext}", Job: "products"}
+	r.NoError(tpl.Validate())
+
+	name := tpl.Name("tarball-backup", ".tar.gz", now)
+	r.Regexp(`^products-2018-09-01T101500Z-\d{4}\.tar\.gz$`, name)
+
+	ts, ok := tpl.Time("2018/09/01/" + name)
+	r.True(ok, "failed to parse time from name")
+	r.True(now.Equal(ts), "parsed time mismatch")
+
+	r.Error((&Template{Pattern: "{prefix}"}).Validate())
+	r.Error((&Template{Pattern: "{prefix}-{date}"}).Validate())
+}
+
+func TestTemplateSort(t *testing.T) {
+	r := require.New(t)
+
+	tpl := &Template{Pattern: "{hostname}-{timestamp}{ext}"}
+
+	names := []string{
+		"b-2018-09-02T000000Z.tar",
+		"a-2018-09-03T000000Z.tar",
+		"readme.txt",
+		"c-2018-09-01T000000Z.tar",
+		// names of the original format are still recognized
+		"tarball-backup-20180801000000.tar.gz",
+	}
+
+	backups := tpl.Sort(names)
+	r.Len(backups, 4)
+	r.Equal("tarball-backup-20180801000000.tar.gz", backups[0].Name)
+	r.Equal("c-2018-09-01T000000Z.tar", backups[1].Name)
+	r.Equal("a-2018-09-03T000000Z.tar", backups[3].Name)
+}
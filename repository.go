@@ -0,0 +1,23 @@
+package autobackup
+
+import (
+	"fmt"
+
+	"github.com/sbusso/autobackup/stores"
+)
+
+// CheckRepository verifies the packs and snapshots of the deduplicated
+// repository stored on S3
+func CheckRepository() error {
+	s3, err := stores.NewS3Config()
+	if err != nil {
+		return fmt.Errorf("an error occured getting config: %v", err)
+	}
+
+	repo, err := stores.NewRepositoryConfig(s3)
+	if err != nil {
+		return fmt.Errorf("an error occured opening repository: %v", err)
+	}
+
+	return repo.Check()
+}
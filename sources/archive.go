@@ -0,0 +1,383 @@
+package sources
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"log"
+)
+
+// xattrPrefix is the PAX record prefix of extended attributes
+const xattrPrefix = "SCHILY.xattr."
+
+// tarDirectory writes the files of a directory without subdirectories to a
+// tarball, base.tar of pg_basebackup goes first as tablespaces are restored
+// relative to it
+func tarDirectory(dir, dest string) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	sort.SliceStable(files, func(i, j int) bool {
+		return strings.HasPrefix(files[i].Name(), "base.") && !strings.HasPrefix(files[j].Name(), "base.")
+	})
+
+	f, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	archive := tar.NewWriter(f)
+
+	for _, info := range files {
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+
+		if err = archive.WriteHeader(header); err != nil {
+			return err
+		}
+
+		in, err := os.Open(path.Join(dir, info.Name()))
+		if err != nil {
+			return err
+		}
+
+		_, err = io.Copy(archive, in)
+		in.Close()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if err = archive.Close(); err != nil {
+		return err
+	}
+
+	return f.Sync()
+}
+
+func extractTarFile(filepath, dest string) error {
+	f, err := os.Open(filepath)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	return extractTar(f, dest)
+}
+
+// extractTar extracts the directories, files and links of an archive,
+// refusing entries that would be written outside of dest
+func extractTar(r io.Reader, dest string) error {
+	if err := os.MkdirAll(dest, 0700); err != nil {
+		return err
+	}
+
+	return extractTarEntries(r, func(name string) (string, error) {
+		return safeJoin(dest, name)
+	}, nil)
+}
+
+// safeJoin joins name to dir, failing for absolute names and if the result is
+// outside of dir
+func safeJoin(dir, name string) (string, error) {
+	if path.IsAbs(name) || filepath.IsAbs(name) {
+		return "", fmt.Errorf("invalid absolute path %s", name)
+	}
+
+	dir = filepath.Clean(dir)
+	target := filepath.Join(dir, name)
+
+	if target != dir && !strings.HasPrefix(target, dir+string(os.PathSeparator)) {
+		return "", fmt.Errorf("invalid path %s", name)
+	}
+
+	return target, nil
+}
+
+// extractTarEntries extracts an archive, writing each entry to the path
+// returned by resolve or skipping it if empty. Permissions, times and extended attributes are
+// restored, and ownership when running as root: the archived owners are used
+// unless credential is set.
+func extractTarEntries(r io.Reader, resolve func(name string) (string, error), credential *syscall.Credential) error {
+	archive := tar.NewReader(r)
+	owners := newTarOwners(credential)
+
+	type dirEntry struct {
+		header *tar.Header
+		target string
+	}
+
+	var dirs []dirEntry
+
+	// entries below an extracted symlink could be written outside of the archive
+	symlinks := map[string]bool{}
+
+	belowSymlink := func(target string) bool {
+		for dir := filepath.Dir(target); dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+			if symlinks[dir] {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		target, err := resolve(header.Name)
+		if err != nil {
+			return err
+		}
+
+		if target == "" {
+			continue
+		}
+
+		if belowSymlink(target) {
+			return fmt.Errorf("invalid path %s, it is below a symlink", header.Name)
+		}
+
+		// never write through a link extracted before, and replace the paths
+		// that changed type since a previous backup
+		if info, err := os.Lstat(target); err == nil && !(info.IsDir() && header.Typeflag == tar.TypeDir) {
+			if err = os.RemoveAll(target); err != nil {
+				return err
+			}
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err = os.MkdirAll(target, 0700); err != nil {
+				return err
+			}
+
+			// restored last as extracting their contents changes them
+			dirs = append(dirs, dirEntry{header, target})
+			continue
+		case tar.TypeReg, tar.TypeRegA:
+			if err = os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+				return err
+			}
+
+			if err = writeSparseFile(target, archive, header.Size); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err = os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+				return err
+			}
+
+			if err = os.Symlink(header.Linkname, target); err != nil {
+				return err
+			}
+
+			symlinks[target] = true
+		case tar.TypeLink:
+			source, err := resolve(header.Linkname)
+			if err != nil {
+				return err
+			}
+
+			if belowSymlink(source) {
+				return fmt.Errorf("invalid link %s, it is below a symlink", header.Linkname)
+			}
+
+			if err = os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+				return err
+			}
+
+			// the metadata is shared with the linked file
+			if err = os.Link(source, target); err != nil {
+				return err
+			}
+
+			continue
+		default:
+			log.Printf("Skipping %s, unsupported file type\n", header.Name)
+			continue
+		}
+
+		if err = restoreMetadata(target, header, owners); err != nil {
+			return err
+		}
+	}
+
+	// children first so parents are still writable
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := restoreMetadata(dirs[i].target, dirs[i].header, owners); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeSparseFile writes size bytes of r to a file, blocks of zeros are
+// skipped leaving holes in the file
+func writeSparseFile(target string, r io.Reader, size int64) error {
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, 64*1024)
+	zeros := make([]byte, len(buf))
+
+	for err == nil {
+		var n int
+		n, err = io.ReadFull(r, buf)
+
+		if n > 0 {
+			if bytes.Equal(buf[:n], zeros[:n]) {
+				_, werr := out.Seek(int64(n), io.SeekCurrent)
+				if werr != nil {
+					err = werr
+				}
+			} else if _, werr := out.Write(buf[:n]); werr != nil {
+				err = werr
+			}
+		}
+	}
+
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		// sets the size when the file ends with a hole
+		err = out.Truncate(size)
+	}
+
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// tarOwners maps the owners of the archived files to the local users
+type tarOwners struct {
+	credential *syscall.Credential
+	uids       map[string]int
+	gids       map[string]int
+}
+
+func newTarOwners(credential *syscall.Credential) *tarOwners {
+	return &tarOwners{credential: credential, uids: map[string]int{}, gids: map[string]int{}}
+}
+
+// owner returns the uid and gid of an entry, names have precedence over ids
+// as they may differ between hosts
+func (o *tarOwners) owner(header *tar.Header) (int, int) {
+	if o.credential != nil {
+		return int(o.credential.Uid), int(o.credential.Gid)
+	}
+
+	uid := lookupID(o.uids, header.Uname, header.Uid, func(name string) (string, error) {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return "", err
+		}
+		return u.Uid, nil
+	})
+
+	gid := lookupID(o.gids, header.Gname, header.Gid, func(name string) (string, error) {
+		g, err := user.LookupGroup(name)
+		if err != nil {
+			return "", err
+		}
+		return g.Gid, nil
+	})
+
+	return uid, gid
+}
+
+// lookupID returns the local id of a user or group name, or the archived id
+// when it does not exist
+func lookupID(cache map[string]int, name string, id int, lookup func(name string) (string, error)) int {
+	if name == "" {
+		return id
+	}
+
+	if cached, ok := cache[name]; ok {
+		return cached
+	}
+
+	if local, err := lookup(name); err == nil {
+		if n, err := strconv.Atoi(local); err == nil {
+			id = n
+		}
+	}
+
+	cache[name] = id
+
+	return id
+}
+
+// restoreMetadata applies the owner, permissions, extended attributes and
+// times of an entry to the extracted file
+func restoreMetadata(target string, header *tar.Header, owners *tarOwners) error {
+	if os.Geteuid() == 0 {
+		uid, gid := owners.owner(header)
+
+		if err := os.Lchown(target, uid, gid); err != nil {
+			return err
+		}
+	}
+
+	symlink := header.Typeflag == tar.TypeSymlink
+
+	// after chown as it clears the setuid bit
+	if !symlink {
+		mode := header.FileInfo().Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+
+		if err := os.Chmod(target, mode); err != nil {
+			return err
+		}
+	}
+
+	for key, value := range header.PAXRecords {
+		if !strings.HasPrefix(key, xattrPrefix) {
+			continue
+		}
+
+		// the filesystem or the user may not support them
+		if err := writeXattr(target, strings.TrimPrefix(key, xattrPrefix), value); err != nil {
+			log.Printf("Cannot restore extended attribute: %v\n", err)
+		}
+	}
+
+	atime := header.AccessTime
+	if atime.IsZero() {
+		atime = header.ModTime
+	}
+
+	if symlink {
+		return lchtimes(target, atime, header.ModTime)
+	}
+
+	return os.Chtimes(target, atime, header.ModTime)
+}
@@ -0,0 +1,169 @@
+package sources
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	"github.com/caarlos0/env"
+	"github.com/mitchellh/mapstructure"
+	bolt "go.etcd.io/bbolt"
+)
+
+// BoltConfig has the config options for the BoltDB service, DB is the handle
+// opened by the application and File defaults to its path
+type BoltConfig struct {
+	Name               string
+	DB                 *bolt.DB
+	File               string
+	Compress           bool   `env:"BOLT_COMPRESS" envDefault:"true"`
+	Compression        string `env:"BOLT_COMPRESSION" envDefault:"gzip"`
+	CompressionLevel   int    `env:"BOLT_COMPRESSION_LEVEL"`
+	CompressionThreads int    `env:"BOLT_COMPRESSION_THREADS"`
+	SaveDir            string `env:"SAVEDIR" envDefault:"/tmp/"`
+}
+
+func NewBoltConfig(db *bolt.DB, opts map[string]interface{}) *BoltConfig {
+	cfg := &BoltConfig{}
+	err := env.Parse(cfg)
+	mapstructure.Decode(opts, cfg)
+
+	cfg.DB = db
+	cfg.target()
+
+	if err != nil {
+		fmt.Printf("%+v\n", err)
+	}
+	return cfg
+}
+
+// target returns the database file, the path is remembered as the handle
+// forgets it once closed
+func (b *BoltConfig) target() string {
+	if b.File == "" && b.DB != nil {
+		b.File = b.DB.Path()
+	}
+
+	return b.File
+}
+
+// Backup writes a snapshot of the database from a read transaction, so the
+// application can keep writing during the backup
+func (b *BoltConfig) Backup() (string, error) {
+	if b.DB == nil {
+		return "", fmt.Errorf("bolt database handle is not set")
+	}
+
+	var name string
+
+	if b.Name != "" {
+		name = b.Name + "-backup"
+	} else {
+		name = path.Base(b.target()) + "-backup"
+	}
+
+	var codec *Codec
+	var err error
+
+	ext := ".bolt"
+	if b.Compress {
+		if codec, err = GetCodec(b.Compression); err != nil {
+			return "", err
+		}
+
+		ext += codec.Extension
+	}
+
+	filepath := generateFilename(b.SaveDir, name, ext)
+
+	f, err := os.Create(filepath)
+	if err != nil {
+		return "", fmt.Errorf("cannot create file: %v", err)
+	}
+
+	defer f.Close()
+
+	var writer io.Writer = f
+	var compressor io.WriteCloser
+
+	if codec != nil {
+		if compressor, err = codec.NewWriter(f, b.CompressionLevel, b.CompressionThreads); err != nil {
+			os.Remove(filepath)
+			return "", fmt.Errorf("cannot create %s writer: %v", codec.Name, err)
+		}
+
+		writer = compressor
+	}
+
+	err = b.DB.View(func(tx *bolt.Tx) error {
+		_, err := tx.WriteTo(writer)
+		return err
+	})
+
+	if err == nil && compressor != nil {
+		err = compressor.Close()
+	}
+
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if err != nil {
+		os.Remove(filepath)
+		return "", fmt.Errorf("cannot write snapshot of %s: %v", b.target(), err)
+	}
+
+	return filepath, nil
+}
+
+// Restore validates a snapshot and swaps it in place of the database file,
+// the application must close the database first
+func (b *BoltConfig) Restore(filepath string) error {
+	target := b.target()
+	if target == "" {
+		return fmt.Errorf("bolt database file is not set")
+	}
+
+	// bolt holds an exclusive lock on the file while it is open
+	if _, err := os.Stat(target); err == nil {
+		db, err := bolt.Open(target, 0600, &bolt.Options{Timeout: time.Second})
+		if err != nil {
+			return fmt.Errorf("database %s is in use, close it before restoring: %v", target, err)
+		}
+
+		db.Close()
+	}
+
+	tmp := path.Join(path.Dir(target), "."+path.Base(target)+".restore")
+	defer os.Remove(tmp)
+
+	if err := decompressFile(filepath, tmp, 0600); err != nil {
+		return fmt.Errorf("cannot write %s: %v", tmp, err)
+	}
+
+	db, err := bolt.Open(tmp, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return fmt.Errorf("invalid snapshot: %v", err)
+	}
+
+	err = db.View(func(tx *bolt.Tx) error {
+		for err := range tx.Check() {
+			return err
+		}
+		return nil
+	})
+
+	db.Close()
+
+	if err != nil {
+		return fmt.Errorf("snapshot consistency check failed: %v", err)
+	}
+
+	if err = os.Rename(tmp, target); err != nil {
+		return fmt.Errorf("cannot replace %s: %v", target, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,68 @@
+package sources
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestBoltBackupRestore(t *testing.T) {
+	r := require.New(t)
+	tmp, err := ioutil.TempDir("", "bolt")
+	r.NoError(err, "failed to create temp directory")
+
+	defer os.RemoveAll(tmp)
+
+	dbFile := path.Join(tmp, "products.db")
+	db, err := bolt.Open(dbFile, 0600, nil)
+	r.NoError(err, "failed to open database")
+
+	put := func(value string) error {
+		return db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("products"))
+			if err != nil {
+				return err
+			}
+			return b.Put([]byte("fruit"), []byte(value))
+		})
+	}
+
+	r.NoError(put("apple"), "failed to write database")
+
+	b := BoltConfig{
+		DB:          db,
+		Compress:    true,
+		Compression: "zstd",
+		SaveDir:     tmp,
+	}
+
+	snapshot, err := b.Backup()
+	r.NoError(err, "failed to backup database")
+	r.True(strings.HasSuffix(snapshot, ".bolt.zst"), "codec extension missing")
+
+	r.NoError(put("banana"), "failed to write database")
+
+	err = b.Restore(snapshot)
+	r.Error(err, "restore should fail while the database is open")
+
+	r.NoError(db.Close())
+
+	err = b.Restore(snapshot)
+	r.NoError(err, "failed to restore database")
+
+	db, err = bolt.Open(dbFile, 0600, nil)
+	r.NoError(err, "failed to open restored database")
+
+	defer db.Close()
+
+	err = db.View(func(tx *bolt.Tx) error {
+		r.Equal([]byte("apple"), tx.Bucket([]byte("products")).Get([]byte("fruit")))
+		return nil
+	})
+	r.NoError(err)
+}
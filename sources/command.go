@@ -2,8 +2,10 @@ package sources
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path"
@@ -13,15 +15,63 @@ import (
 	"time"
 
 	"log"
+
+	"github.com/sbusso/autobackup/naming"
 )
 
-// CmdConfig has the configuration needed to run an external command
+// CmdConfig has the configuration needed to run an external command. With
+// Timeout set, the command runs in its own process group, killed with its
+// children once Timeout is reached.
 type CmdConfig struct {
-	Env        []string
-	InputFile  io.Reader
-	OutputFile io.Writer
-	Credential *syscall.Credential
-	ParsedArg  string
+	Env         []string
+	InputFile   io.Reader
+	OutputFile  io.Writer
+	Credential  *syscall.Credential
+	ParsedArg   string
+	Timeout     time.Duration
+	secretFiles []string
+}
+
+// SecretFile writes secrets to a temporary file only readable by the current
+// user, so they are passed to the command without appearing on its process
+// arguments. The file is removed by Cleanup.
+func (app *CmdConfig) SecretFile(dir, prefix, content string) (string, error) {
+	f, err := ioutil.TempFile(dir, prefix)
+	if err != nil {
+		return "", fmt.Errorf("cannot create secret file: %v", err)
+	}
+
+	app.secretFiles = append(app.secretFiles, f.Name())
+
+	// give the file to the user the command runs as
+	if err = f.Chmod(0600); err == nil && app.Credential != nil && os.Geteuid() == 0 {
+		err = f.Chown(int(app.Credential.Uid), int(app.Credential.Gid))
+	}
+
+	if err == nil {
+		_, err = f.WriteString(content)
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		return "", fmt.Errorf("cannot write secret file: %v", err)
+	}
+
+	return f.Name(), nil
+}
+
+// Cleanup removes the secret files of the command
+func (app *CmdConfig) Cleanup() {
+	for _, name := range app.secretFiles {
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			log.Printf("Cannot remove secret file %s: %v\n", name, err)
+		}
+	}
+
+	app.secretFiles = nil
 }
 
 // CmdRun executes an external executable
@@ -38,9 +88,29 @@ func (app *CmdConfig) CmdRun(name string, arg ...string) error {
 		log.Printf("Not running as root, starting %s with UID %d\n", name, os.Geteuid())
 	}
 
+	if app.Timeout > 0 {
+		if cmd.SysProcAttr == nil {
+			cmd.SysProcAttr = &syscall.SysProcAttr{}
+		}
+
+		cmd.SysProcAttr.Setpgid = true
+	}
+
 	if app.InputFile == nil && app.OutputFile == nil {
 		cmd.Stdout = os.Stdout
-		return cmd.Run()
+
+		if err := cmd.Start(); err != nil {
+			return err
+		}
+
+		timedOut := app.killAfterTimeout(cmd)
+
+		err := cmd.Wait()
+		if timedOut() {
+			return fmt.Errorf("%s timed out after %v", name, app.Timeout)
+		}
+
+		return err
 	}
 
 	var readErr, writeErr error
@@ -90,11 +160,19 @@ func (app *CmdConfig) CmdRun(name string, arg ...string) error {
 		return fmt.Errorf("cannot start process: %v", err)
 	}
 
+	timedOut := app.killAfterTimeout(cmd)
+
 	writeErr = <-doneWrite
 	readErr = <-doneRead
 
-	if err := cmd.Wait(); err != nil {
-		return fmt.Errorf("failed to wait for process: %v", err)
+	err := cmd.Wait()
+	if timedOut() {
+		return fmt.Errorf("%s timed out after %v", name, app.Timeout)
+	}
+
+	// the exit status is kept for ignoreExitCode
+	if err != nil {
+		return fmt.Errorf("failed to wait for process: %w", err)
 	}
 
 	if readErr != nil {
@@ -108,9 +186,56 @@ func (app *CmdConfig) CmdRun(name string, arg ...string) error {
 	return nil
 }
 
-func generateFilename(dir, prefix string) string {
-	now := time.Now().Format("20060102150405")
-	return path.Join(dir, prefix+"-"+now)
+// ignoreExitCode returns nil when err is a non-zero exit status of a process
+// run by CmdRun and ignore is set, err otherwise
+func ignoreExitCode(err error, ignore bool) error {
+	var exitErr *exec.ExitError
+
+	if ignore && errors.As(err, &exitErr) {
+		log.Printf("Ignored exit code of restore process: %v\n", exitErr)
+		return nil
+	}
+
+	return err
+}
+
+// killAfterTimeout kills the process group of a started command once Timeout
+// is reached, the returned function stops the timer and tells if it fired
+func (app *CmdConfig) killAfterTimeout(cmd *exec.Cmd) func() bool {
+	if app.Timeout <= 0 {
+		return func() bool { return false }
+	}
+
+	fired := make(chan struct{})
+
+	timer := time.AfterFunc(app.Timeout, func() {
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		close(fired)
+	})
+
+	return func() bool {
+		if timer.Stop() {
+			return false
+		}
+
+		<-fired
+		return true
+	}
+}
+
+// readSecretFile returns the contents of a file holding a secret, without the
+// trailing newline
+func readSecretFile(name string) (string, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return "", fmt.Errorf("cannot read secret file %s: %v", name, err)
+	}
+
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+func generateFilename(dir, prefix, ext string) string {
+	return path.Join(dir, naming.Default().Name(prefix, ext, time.Now()))
 }
 
 func removeDirectoryContents(dir string) error {
@@ -1,7 +1,11 @@
 package sources
 
 import (
+	"io/ioutil"
+	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -27,3 +31,59 @@ func TestParseArg(t *testing.T) {
 	res = parseArg(long, "")
 	r.Equal(res, long)
 }
+
+func TestSecretFile(t *testing.T) {
+	r := require.New(t)
+	tmp, err := ioutil.TempDir("", "secret")
+	r.NoError(err, "failed to create temp directory")
+
+	defer os.RemoveAll(tmp)
+
+	app := CmdConfig{}
+
+	name, err := app.SecretFile(tmp, ".secret-", "password=s3cret\n")
+	r.NoError(err, "failed to create secret file")
+
+	info, err := os.Stat(name)
+	r.NoError(err)
+	r.Equal(os.FileMode(0600), info.Mode().Perm())
+
+	contents, err := ioutil.ReadFile(name)
+	r.NoError(err)
+	r.Equal("password=s3cret\n", string(contents))
+
+	app.Cleanup()
+
+	_, err = os.Stat(name)
+	r.True(os.IsNotExist(err), "secret file was not removed")
+}
+
+func TestCmdTimeout(t *testing.T) {
+	r := require.New(t)
+
+	app := CmdConfig{Timeout: 100 * time.Millisecond}
+
+	start := time.Now()
+	err := app.CmdRun("sleep", "5")
+	r.Error(err, "command was not killed")
+	r.Contains(err.Error(), "timed out")
+	r.True(time.Since(start) < 5*time.Second)
+
+	r.NoError(app.CmdRun("true"))
+}
+
+func TestIgnoreExitCode(t *testing.T) {
+	r := require.New(t)
+
+	// the exit status is kept when the command reads its stdin from a file
+	app := CmdConfig{InputFile: strings.NewReader("input")}
+
+	err := app.CmdRun("/bin/sh", "-c", "cat > /dev/null; exit 3")
+	r.Error(err)
+	r.NoError(ignoreExitCode(err, true), "exit code not ignored")
+	r.Error(ignoreExitCode(err, false), "exit code ignored")
+
+	// only the exit status is ignored
+	err = app.CmdRun("/nonexistent")
+	r.Error(ignoreExitCode(err, true), "start failure ignored")
+}
@@ -0,0 +1,311 @@
+package sources
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/ulikunitz/xz"
+)
+
+// DefaultCodec compresses the backups when no codec is configured
+const DefaultCodec = "gzip"
+
+// Codec compresses backups, Extension is appended to their name. Restores
+// detect the codec from the magic bytes of a file, then from its extension.
+type Codec struct {
+	Name      string
+	Extension string
+	Magic     []byte
+
+	// NewWriter returns a compressing writer, a zero level or number of
+	// threads uses the default of the codec
+	NewWriter func(w io.Writer, level, threads int) (io.WriteCloser, error)
+
+	NewReader func(r io.Reader) (io.ReadCloser, error)
+}
+
+var codecs = map[string]*Codec{}
+
+// RegisterCodec makes a codec available to the sources and restores
+func RegisterCodec(codec *Codec) {
+	codecs[codec.Name] = codec
+}
+
+// GetCodec returns a registered codec, the default one for an empty name
+func GetCodec(name string) (*Codec, error) {
+	if name == "" {
+		name = DefaultCodec
+	}
+
+	codec, ok := codecs[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("unknown compression codec %s", name)
+	}
+
+	return codec, nil
+}
+
+// sortedCodecs returns the codecs in a stable order
+func sortedCodecs() []*Codec {
+	names := make([]string, 0, len(codecs))
+	for name := range codecs {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	list := make([]*Codec, len(names))
+	for i, name := range names {
+		list[i] = codecs[name]
+	}
+
+	return list
+}
+
+// detectCodec returns the codec of a backup from its first bytes or else its
+// extension, nil when it is not compressed
+func detectCodec(filepath string, header []byte) *Codec {
+	for _, codec := range sortedCodecs() {
+		if len(codec.Magic) > 0 && bytes.HasPrefix(header, codec.Magic) {
+			return codec
+		}
+	}
+
+	for _, codec := range sortedCodecs() {
+		if strings.HasSuffix(filepath, codec.Extension) {
+			return codec
+		}
+	}
+
+	return nil
+}
+
+// openBackup returns a reader of a backup, decompressing it with the codec
+// it was written with
+func openBackup(filepath string) (io.Reader, func(), error) {
+	in, err := os.Open(filepath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot open file: %v", err)
+	}
+
+	buf := bufio.NewReader(in)
+
+	// a short file can't be compressed, Peek returns what there is
+	header, _ := buf.Peek(8)
+
+	codec := detectCodec(filepath, header)
+	if codec == nil {
+		return buf, func() { in.Close() }, nil
+	}
+
+	reader, err := codec.NewReader(buf)
+	if err != nil {
+		in.Close()
+		return nil, nil, fmt.Errorf("cannot create %s reader: %v", codec.Name, err)
+	}
+
+	return reader, func() { reader.Close(); in.Close() }, nil
+}
+
+// compressedFile closes the codec writer before syncing and closing the file
+type compressedFile struct {
+	io.WriteCloser
+	file *os.File
+}
+
+func (c *compressedFile) Close() error {
+	err := c.WriteCloser.Close()
+	if err == nil {
+		err = c.file.Sync()
+	}
+
+	if cerr := c.file.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// createCompressed creates a file compressed with codec
+func createCompressed(filepath string, codec *Codec, level, threads int) (io.WriteCloser, error) {
+	f, err := os.Create(filepath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create file: %v", err)
+	}
+
+	writer, err := codec.NewWriter(f, level, threads)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("cannot create %s writer: %v", codec.Name, err)
+	}
+
+	return &compressedFile{WriteCloser: writer, file: f}, nil
+}
+
+// compressFile writes src compressed with codec to dest
+func compressFile(src, dest string, codec *Codec, level, threads int) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+
+	defer in.Close()
+
+	out, err := createCompressed(dest, codec, level, threads)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// decompressFile writes the contents of a backup to dest, decompressing it
+// with the codec it was written with
+func decompressFile(src, dest string, perm os.FileMode) error {
+	reader, closer, err := openBackup(src)
+	if err != nil {
+		return err
+	}
+
+	defer closer()
+
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return fmt.Errorf("cannot create file: %v", err)
+	}
+
+	_, err = io.Copy(out, reader)
+	if err == nil {
+		err = out.Sync()
+	}
+
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// trimCodecExtension removes the extension of a codec from a file name
+func trimCodecExtension(name string) string {
+	for _, codec := range sortedCodecs() {
+		if strings.HasSuffix(name, codec.Extension) {
+			return strings.TrimSuffix(name, codec.Extension)
+		}
+	}
+
+	return name
+}
+
+func init() {
+	RegisterCodec(&Codec{
+		Name:      "gzip",
+		Extension: ".gz",
+		Magic:     []byte{0x1f, 0x8b},
+		NewWriter: func(w io.Writer, level, threads int) (io.WriteCloser, error) {
+			if level == 0 {
+				level = gzip.DefaultCompression
+			}
+
+			return gzip.NewWriterLevel(w, level)
+		},
+		NewReader: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	})
+
+	RegisterCodec(&Codec{
+		Name:      "zstd",
+		Extension: ".zst",
+		Magic:     []byte{0x28, 0xb5, 0x2f, 0xfd},
+		NewWriter: func(w io.Writer, level, threads int) (io.WriteCloser, error) {
+			var opts []zstd.EOption
+
+			if level != 0 {
+				opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+			}
+
+			if threads > 0 {
+				opts = append(opts, zstd.WithEncoderConcurrency(threads))
+			}
+
+			return zstd.NewWriter(w, opts...)
+		},
+		NewReader: func(r io.Reader) (io.ReadCloser, error) {
+			dec, err := zstd.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+
+			return dec.IOReadCloser(), nil
+		},
+	})
+
+	// xz is single threaded, the level sets a dictionary of 2^(18+level) bytes
+	RegisterCodec(&Codec{
+		Name:      "xz",
+		Extension: ".xz",
+		Magic:     []byte{0xfd, '7', 'z', 'X', 'Z', 0x00},
+		NewWriter: func(w io.Writer, level, threads int) (io.WriteCloser, error) {
+			cfg := xz.WriterConfig{}
+
+			if level > 0 {
+				cfg.DictCap = 1 << uint(18+level)
+			}
+
+			return cfg.NewWriter(w)
+		},
+		NewReader: func(r io.Reader) (io.ReadCloser, error) {
+			reader, err := xz.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+
+			return ioutil.NopCloser(reader), nil
+		},
+	})
+
+	RegisterCodec(&Codec{
+		Name:      "lz4",
+		Extension: ".lz4",
+		Magic:     []byte{0x04, 0x22, 0x4d, 0x18},
+		NewWriter: func(w io.Writer, level, threads int) (io.WriteCloser, error) {
+			writer := lz4.NewWriter(w)
+
+			var opts []lz4.Option
+
+			// levels 1 to 9 are powers of two from 1 << 9
+			if level > 0 {
+				opts = append(opts, lz4.CompressionLevelOption(lz4.CompressionLevel(1<<uint(8+level))))
+			}
+
+			if threads > 0 {
+				opts = append(opts, lz4.ConcurrencyOption(threads))
+			}
+
+			if err := writer.Apply(opts...); err != nil {
+				return nil, err
+			}
+
+			return writer, nil
+		},
+		NewReader: func(r io.Reader) (io.ReadCloser, error) {
+			return ioutil.NopCloser(lz4.NewReader(r)), nil
+		},
+	})
+}
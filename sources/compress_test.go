@@ -0,0 +1,76 @@
+package sources
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCodecs(t *testing.T) {
+	r := require.New(t)
+	tmp, err := ioutil.TempDir("", "codecs")
+	r.NoError(err, "failed to create temp directory")
+
+	defer os.RemoveAll(tmp)
+
+	content := strings.Repeat("INSERT INTO orders VALUES (1);\n", 1000)
+
+	for _, name := range []string{"gzip", "zstd", "xz", "lz4"} {
+		codec, err := GetCodec(name)
+		r.NoError(err)
+
+		filepath := path.Join(tmp, "dump.sql"+codec.Extension)
+
+		writer, err := createCompressed(filepath, codec, 3, 2)
+		r.NoError(err, "failed to create %s writer", name)
+		_, err = writer.Write([]byte(content))
+		r.NoError(err)
+		r.NoError(writer.Close())
+
+		// renamed backups are detected by their magic bytes
+		renamed := path.Join(tmp, "dump-"+name)
+		r.NoError(os.Rename(filepath, renamed))
+
+		reader, closer, err := openBackup(renamed)
+		r.NoError(err, "failed to open %s backup", name)
+		data, err := ioutil.ReadAll(reader)
+		closer()
+		r.NoError(err, "failed to decompress %s backup", name)
+		r.Equal(content, string(data))
+	}
+
+	_, err = GetCodec("brotli")
+	r.Error(err, "unknown codec accepted")
+
+	// backups taken before the codecs were configurable
+	legacy := path.Join(tmp, "postgres-backup.sql.gz")
+	f, err := os.Create(legacy)
+	r.NoError(err)
+	gz := gzip.NewWriter(f)
+	_, err = gz.Write([]byte(content))
+	r.NoError(err)
+	r.NoError(gz.Close())
+	r.NoError(f.Close())
+
+	reader, closer, err := openBackup(legacy)
+	r.NoError(err)
+	data, err := ioutil.ReadAll(reader)
+	closer()
+	r.NoError(err)
+	r.Equal(content, string(data))
+
+	plain := path.Join(tmp, "postgres-backup.sql")
+	r.NoError(ioutil.WriteFile(plain, []byte(content), 0600))
+
+	reader, closer, err = openBackup(plain)
+	r.NoError(err)
+	data, err = ioutil.ReadAll(reader)
+	closer()
+	r.NoError(err)
+	r.Equal(content, string(data))
+}
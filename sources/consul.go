@@ -1,40 +1,385 @@
 package sources
 
 import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/caarlos0/env"
+	"github.com/mitchellh/mapstructure"
 )
 
-// ConsulConfig has the config options for the Consul service
+// ConsulConfig has the config options for the Consul service, the variables
+// are the same used by the consul binary
 type ConsulConfig struct {
-	SaveDir string
+	Address    string        `env:"CONSUL_HTTP_ADDR" envDefault:"127.0.0.1:8500"`
+	Token      string        `env:"CONSUL_HTTP_TOKEN"`
+	TokenFile  string        `env:"CONSUL_HTTP_TOKEN_FILE"`
+	SSL        bool          `env:"CONSUL_HTTP_SSL" envDefault:"false"`
+	Verify     bool          `env:"CONSUL_HTTP_SSL_VERIFY" envDefault:"true"`
+	CACert     string        `env:"CONSUL_CACERT"`
+	Cert       string        `env:"CONSUL_CLIENT_CERT"`
+	Key        string        `env:"CONSUL_CLIENT_KEY"`
+	ServerName string        `env:"CONSUL_TLS_SERVER_NAME"`
+	Datacenter string        `env:"CONSUL_DATACENTER"`
+	Stale      bool          `env:"CONSUL_STALE" envDefault:"false"`
+	Timeout    time.Duration `env:"CONSUL_TIMEOUT" envDefault:"1h"`
+	UseBinary  bool          `env:"CONSUL_USE_BINARY" envDefault:"false"`
+	SaveDir    string        `env:"SAVEDIR" envDefault:"/tmp/"`
 }
 
-// ConsulAppPath points to the consul binary location
+// ConsulAppPath points to the consul binary location, only used when
+// UseBinary is set
 var ConsulAppPath = "/bin/consul"
 
-// Backup generates a tarball of the ConsulConfig repositories and returns the path where is stored
+func NewConsulConfig(opts map[string]interface{}) *ConsulConfig {
+	cfg := &ConsulConfig{}
+	err := env.Parse(cfg)
+	mapstructure.Decode(opts, cfg)
+
+	if err != nil {
+		fmt.Printf("%+v\n", err)
+	}
+	return cfg
+}
+
+func (c *ConsulConfig) token() (string, error) {
+	if c.Token != "" || c.TokenFile == "" {
+		return c.Token, nil
+	}
+
+	data, err := ioutil.ReadFile(c.TokenFile)
+	if err != nil {
+		return "", fmt.Errorf("cannot read token file: %v", err)
+	}
+
+	return strings.TrimSpace(string(data)), nil
+}
+
+func (c *ConsulConfig) snapshotURL(stale bool) (string, error) {
+	address := c.Address
+	if !strings.Contains(address, "://") {
+		if c.SSL {
+			address = "https://" + address
+		} else {
+			address = "http://" + address
+		}
+	}
+
+	u, err := url.Parse(address)
+	if err != nil {
+		return "", fmt.Errorf("invalid address %s: %v", c.Address, err)
+	}
+
+	u.Path = "/v1/snapshot"
+
+	query := url.Values{}
+	if c.Datacenter != "" {
+		query.Set("dc", c.Datacenter)
+	}
+
+	if stale {
+		query.Set("stale", "")
+	}
+
+	u.RawQuery = query.Encode()
+
+	return u.String(), nil
+}
+
+func (c *ConsulConfig) context() (context.Context, context.CancelFunc) {
+	if c.Timeout > 0 {
+		return context.WithTimeout(context.Background(), c.Timeout)
+	}
+
+	return context.WithCancel(context.Background())
+}
+
+func (c *ConsulConfig) do(method string, stale bool, body io.Reader) (*http.Response, context.CancelFunc, error) {
+	address, err := c.snapshotURL(stale)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	token, err := c.token()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	client := &http.Client{}
+
+	if strings.HasPrefix(address, "https://") {
+		config, err := newTLSConfig(c.ServerName, c.CACert, c.Cert, c.Key, !c.Verify)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		client.Transport = &http.Transport{TLSClientConfig: config}
+	}
+
+	ctx, cancel := c.context()
+
+	req, err := http.NewRequest(method, address, body)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+
+	req = req.WithContext(ctx)
+
+	if token != "" {
+		req.Header.Set("X-Consul-Token", token)
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		res.Body.Close()
+		cancel()
+		return nil, nil, fmt.Errorf("unexpected status %s: %s", res.Status, strings.TrimSpace(string(msg)))
+	}
+
+	return res, cancel, nil
+}
+
+// raftSumsSealed is the signature of SHA256SUMS added by Vault, it can only
+// be checked by Vault with its barrier key
+const raftSumsSealed = "SHA256SUMS.sealed"
+
+// verifyRaftSnapshot checks the files of a raft snapshot archive, as saved
+// by Consul and Vault, against the SHA256SUMS file included on it
+func verifyRaftSnapshot(filepath string) error {
+	f, err := os.Open(filepath)
+	if err != nil {
+		return fmt.Errorf("cannot open snapshot: %v", err)
+	}
+
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return fmt.Errorf("invalid snapshot: %v", err)
+	}
+
+	defer gz.Close()
+
+	sums := map[string]string{}
+	var expected []byte
+
+	archive := tar.NewReader(gz)
+
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return fmt.Errorf("invalid snapshot: %v", err)
+		}
+
+		if header.Name == "SHA256SUMS" {
+			if expected, err = ioutil.ReadAll(archive); err != nil {
+				return fmt.Errorf("invalid snapshot: %v", err)
+			}
+			continue
+		}
+
+		if header.Name == raftSumsSealed {
+			continue
+		}
+
+		h := sha256.New()
+		if _, err = io.Copy(h, archive); err != nil {
+			return fmt.Errorf("invalid snapshot: %v", err)
+		}
+
+		sums[header.Name] = hex.EncodeToString(h.Sum(nil))
+	}
+
+	if expected == nil {
+		return fmt.Errorf("snapshot has no SHA256SUMS")
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(string(expected)))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+
+		sum, ok := sums[fields[1]]
+		if !ok {
+			return fmt.Errorf("snapshot is missing %s", fields[1])
+		}
+
+		if sum != fields[0] {
+			return fmt.Errorf("snapshot hash mismatch for %s", fields[1])
+		}
+
+		delete(sums, fields[1])
+	}
+
+	if len(sums) > 0 {
+		return fmt.Errorf("snapshot has files without hash")
+	}
+
+	return nil
+}
+
+// binaryEnv passes the configuration to the consul binary, so the token is
+// not visible on the process arguments
+func (c *ConsulConfig) binaryEnv() []string {
+	vars := os.Environ()
+
+	values := map[string]string{
+		"CONSUL_HTTP_ADDR":       c.Address,
+		"CONSUL_HTTP_TOKEN":      c.Token,
+		"CONSUL_HTTP_TOKEN_FILE": c.TokenFile,
+		"CONSUL_CACERT":          c.CACert,
+		"CONSUL_CLIENT_CERT":     c.Cert,
+		"CONSUL_CLIENT_KEY":      c.Key,
+		"CONSUL_TLS_SERVER_NAME": c.ServerName,
+	}
+
+	for name, value := range values {
+		if value != "" {
+			vars = append(vars, name+"="+value)
+		}
+	}
+
+	vars = append(vars, fmt.Sprintf("CONSUL_HTTP_SSL=%t", c.SSL))
+	vars = append(vars, fmt.Sprintf("CONSUL_HTTP_SSL_VERIFY=%t", c.Verify))
+
+	return vars
+}
+
+// Backup saves a snapshot of the Consul servers state and returns the path where is stored
 func (c *ConsulConfig) Backup() (string, error) {
-	filepath := generateFilename(c.SaveDir, "consul-backup") + ".snap"
-	args := []string{"snapshot", "save", filepath}
+	filepath := generateFilename(c.SaveDir, "consul-backup", ".snap")
 
-	app := CmdConfig{}
+	var err error
 
-	if err := app.CmdRun(ConsulAppPath, args...); err != nil {
-		return "", fmt.Errorf("couldn't execute %s, %v", ConsulAppPath, err)
+	if c.UseBinary {
+		err = c.saveWithBinary(filepath)
+	} else {
+		err = c.save(filepath)
+	}
+
+	if err == nil {
+		err = verifyRaftSnapshot(filepath)
+	}
+
+	if err != nil {
+		os.Remove(filepath)
+		return "", fmt.Errorf("cannot save consul snapshot: %v", err)
 	}
 
 	return filepath, nil
 }
 
-// Restore takes a ConsulConfig backup and restores it to the service
-func (c *ConsulConfig) Restore(filepath string) error {
-	args := []string{"snapshot", "restore", filepath}
+func (c *ConsulConfig) save(filepath string) error {
+	res, cancel, err := c.do(http.MethodGet, c.Stale, nil)
+	if err != nil {
+		return err
+	}
+
+	defer cancel()
+	defer res.Body.Close()
+
+	f, err := os.Create(filepath)
+	if err != nil {
+		return fmt.Errorf("cannot create file: %v", err)
+	}
 
-	app := CmdConfig{}
+	_, err = io.Copy(f, res.Body)
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+func (c *ConsulConfig) saveWithBinary(filepath string) error {
+	args := []string{"snapshot", "save"}
+
+	if c.Datacenter != "" {
+		args = append(args, "-datacenter="+c.Datacenter)
+	}
+
+	if c.Stale {
+		args = append(args, "-stale")
+	}
+
+	args = append(args, filepath)
+
+	app := CmdConfig{Env: c.binaryEnv()}
 
 	if err := app.CmdRun(ConsulAppPath, args...); err != nil {
-		return fmt.Errorf("couldn't execute consul restore, %v", err)
+		return fmt.Errorf("couldn't execute %s, %v", ConsulAppPath, err)
 	}
 
 	return nil
 }
+
+// Restore verifies a Consul snapshot and restores it to the servers
+func (c *ConsulConfig) Restore(filepath string) error {
+	if err := verifyRaftSnapshot(filepath); err != nil {
+		return err
+	}
+
+	if c.UseBinary {
+		args := []string{"snapshot", "restore"}
+
+		if c.Datacenter != "" {
+			args = append(args, "-datacenter="+c.Datacenter)
+		}
+
+		args = append(args, filepath)
+
+		app := CmdConfig{Env: c.binaryEnv()}
+
+		if err := app.CmdRun(ConsulAppPath, args...); err != nil {
+			return fmt.Errorf("couldn't execute consul restore, %v", err)
+		}
+
+		return nil
+	}
+
+	f, err := os.Open(filepath)
+	if err != nil {
+		return fmt.Errorf("cannot open file: %v", err)
+	}
+
+	defer f.Close()
+
+	res, cancel, err := c.do(http.MethodPut, false, f)
+	if err != nil {
+		return fmt.Errorf("cannot restore consul snapshot: %v", err)
+	}
+
+	defer cancel()
+	res.Body.Close()
+
+	return nil
+}
@@ -0,0 +1,108 @@
+package sources
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// raftSnapshot returns a snapshot archive like Vault's, Consul's have no
+// SHA256SUMS.sealed
+func raftSnapshot(state string, corrupt bool) []byte {
+	files := map[string]string{"meta.json": `{"Index":42}`, "state.bin": state}
+
+	var sums bytes.Buffer
+	for _, name := range []string{"meta.json", "state.bin"} {
+		content := files[name]
+		if corrupt && name == "state.bin" {
+			content += "!"
+		}
+		fmt.Fprintf(&sums, "%x  %s\n", sha256.Sum256([]byte(content)), name)
+	}
+	files["SHA256SUMS"] = sums.String()
+	files["SHA256SUMS.sealed"] = `{"ciphertext":"c2VhbGVk","key_info":{"Mechanism":0}}`
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	archive := tar.NewWriter(gz)
+
+	for _, name := range []string{"meta.json", "state.bin", "SHA256SUMS", "SHA256SUMS.sealed"} {
+		archive.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(files[name]))})
+		archive.Write([]byte(files[name]))
+	}
+
+	archive.Close()
+	gz.Close()
+
+	return buf.Bytes()
+}
+
+func TestConsulSnapshot(t *testing.T) {
+	r := require.New(t)
+	tmp, err := ioutil.TempDir("", "consul")
+	r.NoError(err, "failed to create temp directory")
+
+	defer os.RemoveAll(tmp)
+
+	var snapshot, restored []byte
+	var query string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/v1/snapshot" || req.Header.Get("X-Consul-Token") != "secret" {
+			http.Error(w, "Permission denied", http.StatusForbidden)
+			return
+		}
+
+		query = req.URL.RawQuery
+
+		switch req.Method {
+		case http.MethodGet:
+			w.Write(snapshot)
+		case http.MethodPut:
+			restored, _ = ioutil.ReadAll(req.Body)
+		}
+	}))
+
+	defer server.Close()
+
+	c := ConsulConfig{
+		Address:    server.URL,
+		Token:      "secret",
+		Datacenter: "dc2",
+		Stale:      true,
+		SaveDir:    tmp,
+	}
+
+	snapshot = raftSnapshot("raft state", true)
+	_, err = c.Backup()
+	r.Error(err, "corrupted snapshot saved")
+	r.Contains(err.Error(), "hash mismatch")
+
+	c.Token = "invalid"
+	_, err = c.Backup()
+	r.Error(err, "backup without a valid token")
+	r.Contains(err.Error(), "Permission denied")
+
+	files, err := ioutil.ReadDir(tmp)
+	r.NoError(err)
+	r.Len(files, 0, "failed backups were not removed")
+
+	snapshot = raftSnapshot("raft state", false)
+	c.Token = "secret"
+	filepath, err := c.Backup()
+	r.NoError(err, "failed to backup")
+	r.Equal("dc=dc2&stale=", query)
+
+	r.NoError(c.Restore(filepath), "failed to restore")
+	r.Equal(snapshot, restored)
+	r.Equal("dc=dc2", query)
+}
@@ -0,0 +1,287 @@
+package sources
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"log"
+
+	"github.com/caarlos0/env"
+	"github.com/mitchellh/mapstructure"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/etcdutl/v3/snapshot"
+	"go.uber.org/zap"
+)
+
+// EtcdConfig has the config options for the etcd service
+type EtcdConfig struct {
+	Endpoints           []string      `env:"ETCD_ENDPOINTS" envSeparator:"," envDefault:"http://127.0.0.1:2379"`
+	User                string        `env:"ETCD_USER"`
+	Password            string        `env:"ETCD_PASSWORD"`
+	CACert              string        `env:"ETCD_CACERT"`
+	Cert                string        `env:"ETCD_CERT"`
+	Key                 string        `env:"ETCD_KEY"`
+	SkipVerify          bool          `env:"ETCD_SKIP_VERIFY" envDefault:"false"`
+	DialTimeout         time.Duration `env:"ETCD_DIAL_TIMEOUT" envDefault:"10s"`
+	Timeout             time.Duration `env:"ETCD_TIMEOUT" envDefault:"1h"`
+	DataDir             string        `env:"ETCD_DATA_DIR"`
+	Name                string        `env:"ETCD_NAME"`
+	InitialCluster      string        `env:"ETCD_INITIAL_CLUSTER"`
+	InitialClusterToken string        `env:"ETCD_INITIAL_CLUSTER_TOKEN"`
+	InitialAdvertiseURL string        `env:"ETCD_INITIAL_ADVERTISE_PEER_URLS"`
+	Compress            bool          `env:"ETCD_COMPRESS" envDefault:"true"`
+	Compression         string        `env:"ETCD_COMPRESSION" envDefault:"gzip"`
+	CompressionLevel    int           `env:"ETCD_COMPRESSION_LEVEL"`
+	CompressionThreads  int           `env:"ETCD_COMPRESSION_THREADS"`
+	SaveDir             string        `env:"SAVEDIR" envDefault:"/tmp/"`
+}
+
+// Defaults of the restored member, as used by etcdutl
+const (
+	etcdDefaultName         = "default"
+	etcdDefaultPeerURL      = "http://localhost:2380"
+	etcdDefaultClusterToken = "etcd-cluster"
+)
+
+func NewEtcdConfig(opts map[string]interface{}) *EtcdConfig {
+	cfg := &EtcdConfig{}
+	err := env.Parse(cfg)
+	mapstructure.Decode(opts, cfg)
+
+	if err != nil {
+		fmt.Printf("%+v\n", err)
+	}
+	return cfg
+}
+
+func (e *EtcdConfig) newClient() (*clientv3.Client, error) {
+	config := clientv3.Config{
+		Endpoints:   e.Endpoints,
+		DialTimeout: e.DialTimeout,
+		Username:    e.User,
+		Password:    e.Password,
+	}
+
+	if e.CACert != "" || e.Cert != "" || e.SkipVerify {
+		tlsConfig, err := newTLSConfig("", e.CACert, e.Cert, e.Key, e.SkipVerify)
+		if err != nil {
+			return nil, err
+		}
+
+		config.TLS = tlsConfig
+	}
+
+	return clientv3.New(config)
+}
+
+// verifySnapshotHash checks the sha256 appended by etcd to the snapshot
+func verifySnapshotHash(filepath string) error {
+	f, err := os.Open(filepath)
+	if err != nil {
+		return fmt.Errorf("cannot open snapshot: %v", err)
+	}
+
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("cannot stat snapshot: %v", err)
+	}
+
+	size := info.Size() - sha256.Size
+	if size <= 0 {
+		return fmt.Errorf("snapshot is too small")
+	}
+
+	h := sha256.New()
+	if _, err = io.CopyN(h, f, size); err != nil {
+		return fmt.Errorf("cannot read snapshot: %v", err)
+	}
+
+	expected := make([]byte, sha256.Size)
+	if _, err = io.ReadFull(f, expected); err != nil {
+		return fmt.Errorf("cannot read snapshot hash: %v", err)
+	}
+
+	if !bytes.Equal(h.Sum(nil), expected) {
+		return fmt.Errorf("snapshot hash mismatch")
+	}
+
+	return nil
+}
+
+func (e *EtcdConfig) context() (context.Context, context.CancelFunc) {
+	if e.Timeout > 0 {
+		return context.WithTimeout(context.Background(), e.Timeout)
+	}
+
+	return context.WithCancel(context.Background())
+}
+
+// Backup saves a snapshot of the keyspace using the maintenance API
+func (e *EtcdConfig) Backup() (string, error) {
+	cli, err := e.newClient()
+	if err != nil {
+		return "", fmt.Errorf("cannot connect to etcd: %v", err)
+	}
+
+	defer cli.Close()
+
+	ctx, cancel := e.context()
+	defer cancel()
+
+	snapshotFile := generateFilename(e.SaveDir, "etcd-backup", ".db")
+
+	rc, err := cli.Snapshot(ctx)
+	if err != nil {
+		return "", fmt.Errorf("cannot request snapshot: %v", err)
+	}
+
+	defer rc.Close()
+
+	f, err := os.Create(snapshotFile)
+	if err != nil {
+		return "", fmt.Errorf("cannot create file: %v", err)
+	}
+
+	_, err = io.Copy(f, rc)
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err == nil {
+		err = verifySnapshotHash(snapshotFile)
+	}
+
+	if err != nil {
+		os.Remove(snapshotFile)
+		return "", fmt.Errorf("cannot save snapshot: %v", err)
+	}
+
+	if !e.Compress {
+		return snapshotFile, nil
+	}
+
+	defer os.Remove(snapshotFile)
+
+	codec, err := GetCodec(e.Compression)
+	if err != nil {
+		return "", err
+	}
+
+	filepath := snapshotFile + codec.Extension
+	if err = compressFile(snapshotFile, filepath, codec, e.CompressionLevel, e.CompressionThreads); err != nil {
+		os.Remove(filepath)
+		return "", fmt.Errorf("cannot compress snapshot: %v", err)
+	}
+
+	return filepath, nil
+}
+
+// Restore verifies a snapshot and creates a data directory from it, ready
+// to be used with etcd --data-dir. An existing directory is moved aside once
+// the restore succeeded.
+func (e *EtcdConfig) Restore(filepath string) error {
+	if e.DataDir == "" {
+		return fmt.Errorf("data directory is not set")
+	}
+
+	snapshotFile := filepath
+
+	if name := trimCodecExtension(path.Base(filepath)); name != path.Base(filepath) {
+		snapshotFile = path.Join(path.Dir(filepath), "."+name)
+		if err := decompressFile(filepath, snapshotFile, 0600); err != nil {
+			return fmt.Errorf("cannot decompress snapshot: %v", err)
+		}
+
+		defer os.Remove(snapshotFile)
+	}
+
+	if err := verifySnapshotHash(snapshotFile); err != nil {
+		return err
+	}
+
+	// the data directory is created in a sibling staging directory, the
+	// existing one is only moved aside once the restore succeeded
+	staging := e.DataDir + ".restore-" + time.Now().Format("20060102150405")
+
+	if err := snapshot.NewV3(zap.NewNop()).Restore(e.restoreConfig(snapshotFile, staging)); err != nil {
+		os.RemoveAll(staging)
+		return fmt.Errorf("cannot restore snapshot: %v", err)
+	}
+
+	var old string
+
+	if _, err := os.Stat(e.DataDir); err == nil {
+		old = e.DataDir + ".old-" + time.Now().Format("20060102150405")
+		log.Printf("Moving existing data directory to %s\n", old)
+
+		if err = os.Rename(e.DataDir, old); err != nil {
+			os.RemoveAll(staging)
+			return fmt.Errorf("cannot move existing data directory: %v", err)
+		}
+	}
+
+	if err := os.Rename(staging, e.DataDir); err != nil {
+		os.RemoveAll(staging)
+
+		if old != "" {
+			if rerr := os.Rename(old, e.DataDir); rerr != nil {
+				log.Printf("Cannot move back the data directory from %s: %v\n", old, rerr)
+			}
+		}
+
+		return fmt.Errorf("cannot move restored data directory: %v", err)
+	}
+
+	return nil
+}
+
+// restoreConfig returns the membership of the restored member, a single
+// member cluster with the defaults of etcdutl
+func (e *EtcdConfig) restoreConfig(snapshotFile, dataDir string) snapshot.RestoreConfig {
+	name := e.Name
+	if name == "" {
+		name = etcdDefaultName
+	}
+
+	peerURLs := []string{etcdDefaultPeerURL}
+	if e.InitialAdvertiseURL != "" {
+		peerURLs = strings.Split(e.InitialAdvertiseURL, ",")
+	}
+
+	cluster := e.InitialCluster
+	if cluster == "" {
+		var members []string
+		for _, u := range peerURLs {
+			members = append(members, name+"="+u)
+		}
+
+		cluster = strings.Join(members, ",")
+	}
+
+	token := e.InitialClusterToken
+	if token == "" {
+		token = etcdDefaultClusterToken
+	}
+
+	return snapshot.RestoreConfig{
+		SnapshotPath:        snapshotFile,
+		Name:                name,
+		OutputDataDir:       dataDir,
+		PeerURLs:            peerURLs,
+		InitialCluster:      cluster,
+		InitialClusterToken: token,
+	}
+}
@@ -0,0 +1,132 @@
+package sources
+
+import (
+	"context"
+	"crypto/sha256"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.etcd.io/etcd/server/v3/embed"
+)
+
+// startEtcd starts an embedded etcd server on dir, listening on random ports
+func startEtcd(r *require.Assertions, dir string) *embed.Etcd {
+	cfg := embed.NewConfig()
+	cfg.Dir = dir
+	cfg.LogLevel = "error"
+
+	client, err := url.Parse("http://127.0.0.1:0")
+	r.NoError(err)
+	peer, err := url.Parse("http://127.0.0.1:0")
+	r.NoError(err)
+
+	cfg.ListenClientUrls, cfg.AdvertiseClientUrls = []url.URL{*client}, []url.URL{*client}
+	cfg.ListenPeerUrls, cfg.AdvertisePeerUrls = []url.URL{*peer}, []url.URL{*peer}
+	cfg.InitialCluster = cfg.Name + "=" + peer.String()
+
+	server, err := embed.StartEtcd(cfg)
+	r.NoError(err, "failed to start etcd")
+
+	select {
+	case <-server.Server.ReadyNotify():
+	case <-time.After(30 * time.Second):
+		server.Close()
+		r.FailNow("etcd did not start")
+	}
+
+	return server
+}
+
+func TestEtcdBackupRestore(t *testing.T) {
+	r := require.New(t)
+	tmp, err := ioutil.TempDir("", "etcd")
+	r.NoError(err, "failed to create temp directory")
+
+	defer os.RemoveAll(tmp)
+
+	server := startEtcd(r, path.Join(tmp, "server"))
+
+	e := EtcdConfig{
+		Endpoints:   []string{server.Clients[0].Addr().String()},
+		DialTimeout: 5 * time.Second,
+		Timeout:     time.Minute,
+		Compress:    true,
+		Compression: "zstd",
+		SaveDir:     tmp,
+	}
+
+	cli, err := e.newClient()
+	r.NoError(err, "failed to connect to etcd")
+	_, err = cli.Put(context.Background(), "key", "value")
+	cli.Close()
+	r.NoError(err, "failed to put key")
+
+	filepath, err := e.Backup()
+	server.Close()
+	r.NoError(err, "failed to backup etcd")
+	r.Contains(filepath, ".db.zst")
+
+	dataDir := path.Join(tmp, "data")
+	r.NoError(os.Mkdir(dataDir, 0700))
+	r.NoError(ioutil.WriteFile(path.Join(dataDir, "existing"), nil, 0600))
+
+	data := []byte("etcd snapshot contents")
+	sum := sha256.Sum256(data)
+
+	corrupted := path.Join(tmp, "corrupted.db")
+	r.NoError(ioutil.WriteFile(corrupted, append([]byte("etcd snapshot altered!"), sum[:]...), 0600))
+
+	e.DataDir = dataDir
+
+	err = e.Restore(corrupted)
+	r.Error(err, "corrupted snapshot restored")
+	r.Contains(err.Error(), "hash mismatch")
+
+	// a failed restore leaves the data directory in place
+	e.InitialCluster = "default=not a url"
+	r.Error(e.Restore(filepath), "invalid cluster ignored")
+
+	_, err = os.Stat(path.Join(dataDir, "existing"))
+	r.NoError(err, "data directory moved by a failed restore")
+
+	e.InitialCluster = ""
+	r.NoError(e.Restore(filepath), "failed to restore")
+
+	_, err = os.Stat(path.Join(dataDir, "member", "snap", "db"))
+	r.NoError(err, "restored data directory not in place")
+
+	files, err := ioutil.ReadDir(tmp)
+	r.NoError(err)
+
+	var moved bool
+	for _, f := range files {
+		if f.IsDir() && strings.HasPrefix(f.Name(), "data.old-") {
+			moved = true
+		}
+
+		r.NotContains(f.Name(), ".restore-", "staging directory left behind")
+		r.NotEqual(".etcd-backup.db", f.Name(), "decompressed snapshot was not removed")
+	}
+	r.True(moved, "existing data directory was not moved aside")
+
+	// the restored member serves the keys of the snapshot
+	server = startEtcd(r, dataDir)
+	defer server.Close()
+
+	e.Endpoints = []string{server.Clients[0].Addr().String()}
+
+	cli, err = e.newClient()
+	r.NoError(err, "failed to connect to restored etcd")
+	defer cli.Close()
+
+	res, err := cli.Get(context.Background(), "key")
+	r.NoError(err, "failed to get key")
+	r.Len(res.Kvs, 1, "key not restored")
+	r.Equal("value", string(res.Kvs[0].Value))
+}
@@ -0,0 +1,160 @@
+package sources
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/caarlos0/env"
+)
+
+// BackupFunc writes the state of the application to w
+type BackupFunc func(ctx context.Context, w io.Writer) error
+
+// RestoreFunc reads back the state of the application from r. Compressed
+// backups are read once before to verify their checksum, so a corrupted
+// backup is reported without being passed to the function.
+type RestoreFunc func(ctx context.Context, r io.Reader) error
+
+// FuncConfig has the config options for a source implemented by the host
+// application, the functions only deal with the serialized data while
+// naming, compression and storage are handled as for the other sources
+type FuncConfig struct {
+	Name               string
+	Ext                string
+	Compress           bool   `env:"FUNC_COMPRESS" envDefault:"true"`
+	Compression        string `env:"FUNC_COMPRESSION" envDefault:"gzip"`
+	CompressionLevel   int    `env:"FUNC_COMPRESSION_LEVEL"`
+	CompressionThreads int    `env:"FUNC_COMPRESSION_THREADS"`
+	Timeout            time.Duration
+	SaveDir            string `env:"SAVEDIR" envDefault:"/tmp/"`
+	BackupFunc         BackupFunc
+	RestoreFunc        RestoreFunc
+}
+
+// NewFuncConfig returns a source calling the functions, configured from the
+// environment
+func NewFuncConfig(name string, backup BackupFunc, restore RestoreFunc) *FuncConfig {
+	cfg := &FuncConfig{
+		Name:        name,
+		Ext:         ".bin",
+		BackupFunc:  backup,
+		RestoreFunc: restore,
+	}
+
+	if err := env.Parse(cfg); err != nil {
+		fmt.Printf("%+v\n", err)
+	}
+
+	return cfg
+}
+
+func (f *FuncConfig) context() (context.Context, context.CancelFunc) {
+	if f.Timeout > 0 {
+		return context.WithTimeout(context.Background(), f.Timeout)
+	}
+
+	return context.WithCancel(context.Background())
+}
+
+// Backup calls the backup function and saves its output
+func (f *FuncConfig) Backup() (string, error) {
+	if f.BackupFunc == nil {
+		return "", fmt.Errorf("backup function is not set")
+	}
+
+	var codec *Codec
+	var err error
+
+	ext := f.Ext
+	if f.Compress {
+		if codec, err = GetCodec(f.Compression); err != nil {
+			return "", err
+		}
+
+		ext += codec.Extension
+	}
+
+	filepath := generateFilename(f.SaveDir, f.Name+"-backup", ext)
+
+	file, err := os.Create(filepath)
+	if err != nil {
+		return "", fmt.Errorf("cannot create file: %v", err)
+	}
+
+	defer file.Close()
+
+	var writer io.Writer = file
+	var compressor io.WriteCloser
+
+	if codec != nil {
+		if compressor, err = codec.NewWriter(file, f.CompressionLevel, f.CompressionThreads); err != nil {
+			os.Remove(filepath)
+			return "", fmt.Errorf("cannot create %s writer: %v", codec.Name, err)
+		}
+
+		writer = compressor
+	}
+
+	ctx, cancel := f.context()
+	defer cancel()
+
+	err = f.BackupFunc(ctx, writer)
+	if err != nil {
+		err = fmt.Errorf("backup function failed: %v", err)
+	}
+
+	if err == nil && compressor != nil {
+		err = compressor.Close()
+	}
+
+	if err == nil {
+		err = file.Sync()
+	}
+
+	if err != nil {
+		os.Remove(filepath)
+		return "", err
+	}
+
+	return filepath, nil
+}
+
+// Restore passes the contents of a backup to the restore function
+func (f *FuncConfig) Restore(filepath string) error {
+	if f.RestoreFunc == nil {
+		return fmt.Errorf("restore function is not set")
+	}
+
+	// the codecs verify the checksum once the end of the stream is reached
+	reader, closer, err := openBackup(filepath)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(ioutil.Discard, reader)
+	closer()
+
+	if err != nil {
+		return fmt.Errorf("backup is corrupted: %v", err)
+	}
+
+	reader, closer, err = openBackup(filepath)
+	if err != nil {
+		return err
+	}
+
+	defer closer()
+
+	ctx, cancel := f.context()
+	defer cancel()
+
+	if err = f.RestoreFunc(ctx, reader); err != nil {
+		return fmt.Errorf("restore function failed: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,65 @@
+package sources
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFuncBackupRestore(t *testing.T) {
+	r := require.New(t)
+	tmp, err := ioutil.TempDir("", "func")
+	r.NoError(err, "failed to create temp directory")
+
+	defer os.RemoveAll(tmp)
+
+	state := []byte("in memory state")
+	var restored []byte
+
+	f := NewFuncConfig("state", func(ctx context.Context, w io.Writer) error {
+		_, err := w.Write(state)
+		return err
+	}, func(ctx context.Context, r io.Reader) error {
+		var err error
+		restored, err = ioutil.ReadAll(r)
+		return err
+	})
+	f.SaveDir = tmp
+
+	filepath, err := f.Backup()
+	r.NoError(err, "failed to backup state")
+	r.Contains(filepath, ".bin.gz")
+
+	err = f.Restore(filepath)
+	r.NoError(err, "failed to restore state")
+	r.Equal(state, restored, "restored state mismatch")
+
+	// a truncated backup is never passed to the restore function
+	data, err := ioutil.ReadFile(filepath)
+	r.NoError(err)
+	r.NoError(ioutil.WriteFile(filepath, data[:len(data)-4], 0600))
+
+	restored = nil
+	r.Error(f.Restore(filepath), "corrupted backup restored")
+	r.Nil(restored, "restore function called with a corrupted backup")
+
+	// a failed backup leaves no file behind
+	f.SaveDir, err = ioutil.TempDir(tmp, "failed")
+	r.NoError(err, "failed to create temp directory")
+
+	f.BackupFunc = func(ctx context.Context, w io.Writer) error {
+		return errors.New("serialization error")
+	}
+
+	_, err = f.Backup()
+	r.Error(err)
+
+	files, err := ioutil.ReadDir(f.SaveDir)
+	r.NoError(err)
+	r.Empty(files)
+}
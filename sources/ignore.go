@@ -0,0 +1,164 @@
+package sources
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// IgnoreFile is read from every directory added to a tarball, its patterns
+// exclude files relative to that directory
+const IgnoreFile = ".autobackupignore"
+
+// ignoreRule is a gitignore style pattern. Patterns without a slash match the
+// name at any depth, the others are relative to the base directory.
+type ignoreRule struct {
+	base     string
+	pattern  *regexp.Regexp
+	dirOnly  bool
+	negate   bool
+	anchored bool
+}
+
+type ignoreRules []ignoreRule
+
+// parseIgnoreRule parses a pattern relative to base, comments and empty lines
+// are skipped
+func parseIgnoreRule(base, line string) (ignoreRule, bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ignoreRule{}, false
+	}
+
+	rule := ignoreRule{base: base}
+
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	}
+
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+
+	if strings.Contains(line, "/") {
+		rule.anchored = true
+		line = strings.TrimPrefix(line, "/")
+	}
+
+	if line == "" {
+		return ignoreRule{}, false
+	}
+
+	rule.pattern = regexp.MustCompile("^" + globToRegexp(line) + "$")
+
+	return rule, true
+}
+
+func globToRegexp(glob string) string {
+	var expr strings.Builder
+
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			if strings.HasPrefix(glob[i:], "**/") {
+				expr.WriteString("(.*/)?")
+				i += 2
+			} else if strings.HasPrefix(glob[i:], "**") {
+				expr.WriteString(".*")
+				i++
+			} else {
+				expr.WriteString("[^/]*")
+			}
+		case '?':
+			expr.WriteString("[^/]")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	return expr.String()
+}
+
+// match reports if the rule applies to rel, a slash separated path relative
+// to the root directory
+func (r ignoreRule) match(rel string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+
+	if r.base != "" {
+		if !strings.HasPrefix(rel, r.base+"/") {
+			return false
+		}
+		rel = rel[len(r.base)+1:]
+	}
+
+	if r.anchored {
+		return r.pattern.MatchString(rel)
+	}
+
+	return r.pattern.MatchString(path.Base(rel))
+}
+
+func parseIgnoreRules(base string, patterns []string) ignoreRules {
+	var rules ignoreRules
+
+	for _, pattern := range patterns {
+		if rule, ok := parseIgnoreRule(base, pattern); ok {
+			rules = append(rules, rule)
+		}
+	}
+
+	return rules
+}
+
+// readIgnoreFile returns the rules of the ignore file of a directory, if any
+func readIgnoreFile(dir, base string) (ignoreRules, error) {
+	f, err := os.Open(path.Join(dir, IgnoreFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	var patterns []string
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		patterns = append(patterns, scanner.Text())
+	}
+
+	return parseIgnoreRules(base, patterns), scanner.Err()
+}
+
+// excluded reports if a path is excluded, the last matching rule wins
+func (rules ignoreRules) excluded(rel string, isDir bool) bool {
+	excluded := false
+
+	for _, rule := range rules {
+		if rule.match(rel, isDir) {
+			excluded = !rule.negate
+		}
+	}
+
+	return excluded
+}
+
+// matchAny reports if any of the rules matches the path
+func (rules ignoreRules) matchAny(rel string, isDir bool) bool {
+	for _, rule := range rules {
+		if rule.match(rel, isDir) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,217 @@
+package sources
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/caarlos0/env"
+	"github.com/mitchellh/mapstructure"
+)
+
+// MongoConfig has the config options for the MongoDB service
+type MongoConfig struct {
+	URI                string   `env:"MONGO_URI"`
+	Host               string   `env:"MONGO_HOST"`
+	Port               string   `env:"MONGO_PORT"`
+	User               string   `env:"MONGO_USER"`
+	Password           string   `env:"MONGO_PASSWORD"`
+	AuthDatabase       string   `env:"MONGO_AUTH_DATABASE"`
+	Database           string   `env:"MONGO_DATABASE"`
+	Collection         string   `env:"MONGO_COLLECTION"`
+	ExcludeCollections []string `env:"MONGO_EXCLUDE_COLLECTIONS" envSeparator:","`
+	Oplog              bool     `env:"MONGO_OPLOG" envDefault:"false"`
+	Drop               bool     `env:"MONGO_DROP" envDefault:"true"`
+	Options            string   `env:"MONGO_OPTIONS"`
+	SaveDir            string   `env:"SAVEDIR" envDefault:"/tmp/"`
+	IgnoreExitCode     bool     `env:"MONGO_IGNORE_EXIT_CODE" envDefault:"false"`
+}
+
+var (
+	// MongoDumpCmd points to the mongodump binary location
+	MongoDumpCmd = "/usr/bin/mongodump"
+
+	// MongoRestoreCmd points to the mongorestore binary location
+	MongoRestoreCmd = "/usr/bin/mongorestore"
+)
+
+func NewMongoConfig(opts map[string]interface{}) *MongoConfig {
+	cfg := &MongoConfig{}
+	err := env.Parse(cfg)
+	mapstructure.Decode(opts, cfg)
+
+	if err != nil {
+		fmt.Printf("%+v\n", err)
+	}
+	return cfg
+}
+
+func (m *MongoConfig) validate() error {
+	if m.Collection != "" && m.Database == "" {
+		return fmt.Errorf("a database is required to filter by collection")
+	}
+
+	if m.Oplog && m.Database != "" {
+		return fmt.Errorf("oplog is only supported when dumping all the databases")
+	}
+
+	return nil
+}
+
+// writeConfigFile saves the secrets to a secret file of the command, so they
+// don't appear in the process arguments
+func (m *MongoConfig) writeConfigFile(app *CmdConfig) (string, error) {
+	var lines []string
+
+	if m.URI != "" {
+		lines = append(lines, "uri: "+strconv.Quote(m.URI))
+	}
+
+	if m.Password != "" {
+		lines = append(lines, "password: "+strconv.Quote(m.Password))
+	}
+
+	if len(lines) == 0 {
+		return "", nil
+	}
+
+	return app.SecretFile(m.SaveDir, ".mongo-config-", strings.Join(lines, "\n")+"\n")
+}
+
+func (m *MongoConfig) newBaseArgs(config string) []string {
+	var args []string
+
+	if config != "" {
+		args = append(args, "--config="+config)
+	}
+
+	if m.URI == "" {
+		if m.Host != "" {
+			args = append(args, "--host="+m.Host)
+		}
+
+		if m.Port != "" {
+			args = append(args, "--port="+m.Port)
+		}
+
+		if m.User != "" {
+			args = append(args, "--username="+m.User)
+		}
+
+		if m.AuthDatabase != "" {
+			args = append(args, "--authenticationDatabase="+m.AuthDatabase)
+		}
+	}
+
+	args = append(args, "--archive", "--gzip")
+
+	options := strings.Fields(m.Options)
+
+	// add extra options
+	if len(options) > 0 {
+		args = append(args, options...)
+	}
+
+	return args
+}
+
+// Backup generates an archive of the databases and returns the path where is stored
+func (m *MongoConfig) Backup() (string, error) {
+	if err := m.validate(); err != nil {
+		return "", err
+	}
+
+	app := CmdConfig{}
+	defer app.Cleanup()
+
+	config, err := m.writeConfigFile(&app)
+	if err != nil {
+		return "", err
+	}
+
+	args := m.newBaseArgs(config)
+
+	if m.Database != "" {
+		args = append(args, "--db="+m.Database)
+	}
+
+	if m.Collection != "" {
+		args = append(args, "--collection="+m.Collection)
+	}
+
+	for _, collection := range m.ExcludeCollections {
+		args = append(args, "--excludeCollection="+collection)
+	}
+
+	if m.Oplog {
+		args = append(args, "--oplog")
+	}
+
+	filepath := generateFilename(m.SaveDir, "mongo-backup", ".archive.gz")
+
+	f, err := os.Create(filepath)
+	if err != nil {
+		return "", fmt.Errorf("cannot create file: %v", err)
+	}
+
+	defer f.Close()
+
+	app.OutputFile = f
+
+	if err := app.CmdRun(MongoDumpCmd, args...); err != nil {
+		os.Remove(filepath)
+		return "", fmt.Errorf("couldn't execute %s, %v", MongoDumpCmd, err)
+	}
+
+	return filepath, nil
+}
+
+// Restore takes an archive and restores it, dropping the existing collections
+func (m *MongoConfig) Restore(filepath string) error {
+	if err := m.validate(); err != nil {
+		return err
+	}
+
+	app := CmdConfig{}
+	defer app.Cleanup()
+
+	config, err := m.writeConfigFile(&app)
+	if err != nil {
+		return err
+	}
+
+	args := m.newBaseArgs(config)
+
+	if m.Drop {
+		args = append(args, "--drop")
+	}
+
+	if m.Oplog {
+		args = append(args, "--oplogReplay")
+	}
+
+	if m.Database != "" {
+		collection := m.Collection
+		if collection == "" {
+			collection = "*"
+		}
+
+		args = append(args, "--nsInclude="+m.Database+"."+collection)
+	}
+
+	f, err := os.Open(filepath)
+	if err != nil {
+		return fmt.Errorf("cannot open file: %v", err)
+	}
+
+	defer f.Close()
+
+	app.InputFile = f
+
+	if err := ignoreExitCode(app.CmdRun(MongoRestoreCmd, args...), m.IgnoreExitCode); err != nil {
+		return fmt.Errorf("couldn't execute %s, %v", MongoRestoreCmd, err)
+	}
+
+	return nil
+}
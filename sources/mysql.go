@@ -1,26 +1,36 @@
 package sources
 
 import (
-	"compress/gzip"
 	"fmt"
-	"os"
-	"os/exec"
+	"io"
 	"strings"
 
-	"log"
+	"github.com/caarlos0/env"
+	"github.com/mitchellh/mapstructure"
+	"github.com/sbusso/autobackup/stores"
 )
 
-// MySQLConfig has the config options for the MySQLservice
+// MySQLConfig has the config options for the MySQLservice. With Binlog set
+// the dumps record their binlog coordinates, and when BinlogStore is set the
+// binlogs shipped there are replayed after the dump up to StopDatetime.
 type MySQLConfig struct {
-	Host           string
-	Port           string
-	User           string
-	Password       string
-	Database       string
-	Options        string
-	Compress       bool
-	SaveDir        string
-	IgnoreExitCode bool
+	Host               string `env:"DATABASE_HOST" envDefault:"localhost"`
+	Port               string `env:"DATABASE_PORT" envDefault:"3306"`
+	User               string `env:"DATABASE_USER"`
+	Password           string `env:"DATABASE_PASSWORD"`
+	PasswordFile       string `env:"DATABASE_PASSWORD_FILE"`
+	Database           string `env:"DATABASE_NAME"`
+	Options            string `env:"DATABASE_OPTIONS"`
+	Compress           bool   `env:"DATABASE_COMPRESS" envDefault:"true"`
+	Compression        string `env:"DATABASE_COMPRESSION" envDefault:"gzip"`
+	CompressionLevel   int    `env:"DATABASE_COMPRESSION_LEVEL"`
+	CompressionThreads int    `env:"DATABASE_COMPRESSION_THREADS"`
+	SaveDir            string `env:"SAVEDIR" envDefault:"/tmp/"`
+	IgnoreExitCode     bool   `env:"DATABASE_IGNORE_EXIT_CODE" envDefault:"false"`
+	Binlog             bool   `env:"MYSQL_BINLOG" envDefault:"false"`
+	MasterData         bool   `env:"MYSQL_MASTER_DATA" envDefault:"false"`
+	BinlogStore        stores.Store
+	StopDatetime       string `env:"MYSQL_STOP_DATETIME"`
 }
 
 var (
@@ -31,17 +41,73 @@ var (
 	MysqlRestoreCmd = "/usr/bin/mysql"
 )
 
-func (m *MySQLConfig) newBaseArgs() []string {
+// NewMySQLConfig reads the configuration from the environment, opts override
+// it. The password file has precedence over the password.
+func NewMySQLConfig(opts map[string]interface{}) (*MySQLConfig, error) {
+	cfg := &MySQLConfig{}
+	if err := env.Parse(cfg); err != nil {
+		return nil, err
+	}
+
+	if err := mapstructure.Decode(opts, cfg); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+func (m *MySQLConfig) validate() error {
+	if m.PasswordFile != "" {
+		password, err := readSecretFile(m.PasswordFile)
+		if err != nil {
+			return err
+		}
+
+		m.Password = password
+	}
+
+	if m.Host == "" || m.Port == "" || m.User == "" {
+		return fmt.Errorf("database host, port and user are required")
+	}
+
+	if _, err := GetCodec(m.Compression); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// newMySQLCmd prepares a command with the credentials in an option file, the
+// returned arguments must come first as required by --defaults-extra-file
+func (m *MySQLConfig) newMySQLCmd() (*CmdConfig, []string, error) {
+	app := &CmdConfig{}
+
+	file, err := app.SecretFile(m.SaveDir, ".mysql-defaults-",
+		"[client]\nuser="+quoteOption(m.User)+"\npassword="+quoteOption(m.Password)+"\n")
+	if err != nil {
+		return nil, nil, err
+	}
+
 	args := []string{
+		"--defaults-extra-file=" + file,
 		"-h", m.Host,
 		"-P", m.Port,
-		"-u", m.User,
 	}
 
-	if m.Password != "" {
-		args = append(args, "-p"+m.Password)
-	}
+	return app, args, nil
+}
 
+// quoteOption quotes a value of a MySQL option file
+func quoteOption(value string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "\t", `\t`)
+	return `"` + replacer.Replace(value) + `"`
+}
+
+func (m *MySQLConfig) newBaseArgs(args []string) []string {
 	options := strings.Fields(m.Options)
 
 	// add extra options
@@ -54,8 +120,14 @@ func (m *MySQLConfig) newBaseArgs() []string {
 
 // Backup generates a dump of the database and returns the path where is stored
 func (m *MySQLConfig) Backup() (string, error) {
-	filepath := generateFilename(m.SaveDir, "mysql-backup")
-	args := m.newBaseArgs()
+	app, args, err := m.newMySQLCmd()
+	if err != nil {
+		return "", err
+	}
+
+	defer app.Cleanup()
+
+	args = m.newBaseArgs(args)
 
 	if m.Database != "" {
 		args = append(args, "-B", m.Database)
@@ -63,72 +135,79 @@ func (m *MySQLConfig) Backup() (string, error) {
 		args = append(args, "--all-databases")
 	}
 
+	// record the binlog position as a comment, --master-data before MySQL 8.0.26
+	if m.Binlog && m.MasterData {
+		args = append(args, "--master-data=2", "--flush-logs")
+	} else if m.Binlog {
+		args = append(args, "--source-data=2", "--flush-logs")
+	}
+
+	var filepath string
+	var writer io.WriteCloser
 	if !m.Compress {
-		filepath += ".sql"
+		filepath = generateFilename(m.SaveDir, "mysql-backup", ".sql")
 		args = append(args, "-r", filepath)
 	} else {
-		filepath += ".sql.gz"
-	}
-
-	app := CmdConfig{ParsedArg: "-p"}
-
-	if m.Compress {
-		f, err := os.Create(filepath)
+		codec, err := GetCodec(m.Compression)
 		if err != nil {
-			return "", fmt.Errorf("cannot create file: %v", err)
+			return "", err
 		}
 
-		defer f.Close()
+		filepath = generateFilename(m.SaveDir, "mysql-backup", ".sql"+codec.Extension)
 
-		writer := gzip.NewWriter(f)
-		defer writer.Close()
+		if writer, err = createCompressed(filepath, codec, m.CompressionLevel, m.CompressionThreads); err != nil {
+			return "", err
+		}
 
 		app.OutputFile = writer
 	}
 
 	if err := app.CmdRun(MysqlDumpCmd, args...); err != nil {
+		if writer != nil {
+			writer.Close()
+		}
+
 		return "", fmt.Errorf("couldn't execute %s, %v", MysqlDumpCmd, err)
 	}
 
+	if writer != nil {
+		if err := writer.Close(); err != nil {
+			return "", fmt.Errorf("cannot compress %s: %v", filepath, err)
+		}
+	}
+
 	return filepath, nil
 }
 
 // Restore takes a database dump and restores it
 func (m *MySQLConfig) Restore(filepath string) error {
-	args := m.newBaseArgs()
-	app := CmdConfig{}
+	app, args, err := m.newMySQLCmd()
+	if err != nil {
+		return err
+	}
+
+	defer app.Cleanup()
+
+	args = m.newBaseArgs(args)
 
 	if m.Database != "" {
 		args = append(args, "-D", m.Database)
 	}
 
-	f, err := os.Open(filepath)
+	reader, closer, err := openBackup(filepath)
 	if err != nil {
-		return fmt.Errorf("cannot open file: %v", err)
+		return err
 	}
 
-	defer f.Close()
+	defer closer()
+	app.InputFile = reader
 
-	if strings.HasSuffix(filepath, ".gz") {
-		reader, err := gzip.NewReader(f)
-		if err != nil {
-			return fmt.Errorf("cannot create gzip reader: %v", err)
-		}
-
-		defer reader.Close()
-		app.InputFile = reader
-	} else {
-		app.InputFile = f
+	if err := ignoreExitCode(app.CmdRun(MysqlRestoreCmd, args...), m.IgnoreExitCode); err != nil {
+		return fmt.Errorf("couldn't execute %s, %v", MysqlRestoreCmd, err)
 	}
 
-	if err := app.CmdRun(MysqlRestoreCmd, args...); err != nil {
-		serr, ok := err.(*exec.ExitError)
-
-		if ok && m.IgnoreExitCode {
-			log.Printf("Ignored exit code of restore process: %v\n", serr)
-		} else {
-			return fmt.Errorf("couldn't execute %s, %v", MysqlRestoreCmd, err)
-		}
+	if m.BinlogStore != nil {
+		return m.replayBinlogs(filepath)
 	}
 
 	return nil
@@ -0,0 +1,307 @@
+package sources
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"log"
+
+	"github.com/sbusso/autobackup/stores"
+)
+
+// MysqlBinlogCmd points to the mysqlbinlog binary location
+var MysqlBinlogCmd = "/usr/bin/mysqlbinlog"
+
+// coordinatesPattern matches the binlog position written by --source-data=2
+// and --master-data=2 at the top of a dump
+var coordinatesPattern = regexp.MustCompile(`(?:MASTER|SOURCE)_LOG_FILE='([^']+)',\s*(?:MASTER|SOURCE)_LOG_POS=(\d+)`)
+
+// binlogCoordinates returns the binlog file and position a dump was taken at
+func binlogCoordinates(filepath string) (string, int64, error) {
+	reader, closer, err := openBackup(filepath)
+	if err != nil {
+		return "", 0, err
+	}
+
+	defer closer()
+
+	buf := bufio.NewReader(reader)
+
+	// the coordinates are written before any data
+	for i := 0; i < 200; i++ {
+		line, err := buf.ReadString('\n')
+
+		if match := coordinatesPattern.FindStringSubmatch(line); match != nil {
+			pos, _ := strconv.ParseInt(match[2], 10, 64)
+			return match[1], pos, nil
+		}
+
+		if err != nil {
+			break
+		}
+	}
+
+	return "", 0, fmt.Errorf("no binlog coordinates found in %s, was it taken with Binlog set?", filepath)
+}
+
+func (m *MySQLConfig) query(query string) (string, error) {
+	var out bytes.Buffer
+
+	app, args, err := m.newMySQLCmd()
+	if err != nil {
+		return "", err
+	}
+
+	defer app.Cleanup()
+
+	args = append(args, "-N", "-B", "-e", query)
+	app.OutputFile = &out
+
+	if err := app.CmdRun(MysqlRestoreCmd, args...); err != nil {
+		return "", fmt.Errorf("couldn't execute %s, %v", MysqlRestoreCmd, err)
+	}
+
+	return out.String(), nil
+}
+
+func binlogShippedPath(saveDir string) string {
+	return path.Join(saveDir, ".mysql-binlogs-shipped")
+}
+
+// ShipBinlogs rotates the binary log of the server and sends the closed binlog
+// files that were not shipped yet to the store
+func (m *MySQLConfig) ShipBinlogs(store stores.Store) error {
+	if _, err := m.query("FLUSH BINARY LOGS"); err != nil {
+		return fmt.Errorf("cannot rotate binary logs: %v", err)
+	}
+
+	out, err := m.query("SHOW BINARY LOGS")
+	if err != nil {
+		return fmt.Errorf("cannot list binary logs: %v", err)
+	}
+
+	var binlogs []string
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 {
+			binlogs = append(binlogs, fields[0])
+		}
+	}
+
+	// the last binlog is still being written
+	if len(binlogs) < 2 {
+		return nil
+	}
+
+	shipped := map[string]bool{}
+	if data, err := ioutil.ReadFile(binlogShippedPath(m.SaveDir)); err == nil {
+		for _, name := range strings.Fields(string(data)) {
+			shipped[name] = true
+		}
+	}
+
+	dir, err := ioutil.TempDir(m.SaveDir, ".mysql-binlogs-")
+	if err != nil {
+		return fmt.Errorf("cannot create temporary directory: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	for _, name := range binlogs[:len(binlogs)-1] {
+		if shipped[name] {
+			continue
+		}
+
+		if err = m.shipBinlog(store, dir, name); err != nil {
+			return err
+		}
+
+		f, err := os.OpenFile(binlogShippedPath(m.SaveDir), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return fmt.Errorf("cannot record shipped binlog: %v", err)
+		}
+
+		_, err = f.WriteString(name + "\n")
+		f.Close()
+
+		if err != nil {
+			return fmt.Errorf("cannot record shipped binlog: %v", err)
+		}
+
+		log.Printf("Binlog %s shipped\n", name)
+	}
+
+	return nil
+}
+
+func (m *MySQLConfig) shipBinlog(store stores.Store, dir, name string) error {
+	app, args, err := m.newMySQLCmd()
+	if err != nil {
+		return err
+	}
+
+	defer app.Cleanup()
+
+	args = append(args, "--read-from-remote-server", "--raw", "--result-file="+dir+"/", name)
+
+	if err := app.CmdRun(MysqlBinlogCmd, args...); err != nil {
+		return fmt.Errorf("couldn't execute %s, %v", MysqlBinlogCmd, err)
+	}
+
+	// binlogs are compressed with the codec of the dumps
+	binlog, stored := path.Join(dir, name), name
+
+	if m.Compress {
+		codec, err := GetCodec(m.Compression)
+		if err != nil {
+			return err
+		}
+
+		stored = name + codec.Extension
+		compressed := path.Join(m.SaveDir, stored)
+
+		if err = compressFile(binlog, compressed, codec, m.CompressionLevel, m.CompressionThreads); err != nil {
+			os.Remove(compressed)
+			return fmt.Errorf("cannot compress %s: %v", name, err)
+		}
+
+		os.Remove(binlog)
+		binlog = compressed
+	}
+
+	if err := store.Store(binlog, stored); err != nil {
+		os.Remove(binlog)
+		return fmt.Errorf("cannot store %s: %v", name, err)
+	}
+
+	// the store may have moved the file already
+	os.Remove(binlog)
+
+	return nil
+}
+
+// replayBinlogs applies the binlogs shipped after a dump, up to StopDatetime
+func (m *MySQLConfig) replayBinlogs(filepath string) error {
+	start, pos, err := binlogCoordinates(filepath)
+	if err != nil {
+		return err
+	}
+
+	idx, ok := m.BinlogStore.(stores.Indexer)
+	if !ok {
+		return fmt.Errorf("store %T cannot list binlogs", m.BinlogStore)
+	}
+
+	objects, err := idx.List()
+	if err != nil {
+		return fmt.Errorf("cannot list binlogs: %v", err)
+	}
+
+	// binlog names have a zero padded sequence number, they sort by name
+	prefix := strings.SplitN(start, ".", 2)[0] + "."
+	var names []string
+
+	for _, obj := range objects {
+		base := trimCodecExtension(path.Base(obj.Name))
+		if strings.HasPrefix(base, prefix) && base >= start {
+			names = append(names, obj.Name)
+		}
+	}
+
+	sort.Slice(names, func(i, j int) bool {
+		return trimCodecExtension(path.Base(names[i])) < trimCodecExtension(path.Base(names[j]))
+	})
+
+	if len(names) == 0 || trimCodecExtension(path.Base(names[0])) != start {
+		return fmt.Errorf("binlog %s was not shipped, cannot replay", start)
+	}
+
+	dir, err := ioutil.TempDir(m.SaveDir, ".mysql-replay-")
+	if err != nil {
+		return fmt.Errorf("cannot create temporary directory: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	var binlogs []string
+
+	for _, name := range names {
+		binlog := path.Join(dir, trimCodecExtension(path.Base(name)))
+
+		if err = m.retrieveBinlog(name, binlog); err != nil {
+			return err
+		}
+
+		binlogs = append(binlogs, binlog)
+	}
+
+	// the start position applies to the first file only
+	args := []string{"--start-position=" + strconv.FormatInt(pos, 10)}
+
+	if m.StopDatetime != "" {
+		args = append(args, "--stop-datetime="+m.StopDatetime)
+	}
+
+	if m.Database != "" {
+		args = append(args, "--database="+m.Database)
+	}
+
+	args = append(args, binlogs...)
+
+	events, err := os.Create(path.Join(dir, "events.sql"))
+	if err != nil {
+		return fmt.Errorf("cannot create file: %v", err)
+	}
+
+	defer events.Close()
+
+	app := CmdConfig{OutputFile: events}
+
+	if err = app.CmdRun(MysqlBinlogCmd, args...); err != nil {
+		return fmt.Errorf("couldn't execute %s, %v", MysqlBinlogCmd, err)
+	}
+
+	if _, err = events.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("cannot read binlog events: %v", err)
+	}
+
+	log.Printf("Replaying %d binlogs from %s:%d\n", len(binlogs), start, pos)
+
+	restore, restoreArgs, err := m.newMySQLCmd()
+	if err != nil {
+		return err
+	}
+
+	defer restore.Cleanup()
+
+	restore.InputFile = events
+
+	if err = restore.CmdRun(MysqlRestoreCmd, restoreArgs...); err != nil {
+		return fmt.Errorf("couldn't execute %s, %v", MysqlRestoreCmd, err)
+	}
+
+	return nil
+}
+
+func (m *MySQLConfig) retrieveBinlog(name, dest string) error {
+	retrieved, err := m.BinlogStore.Retrieve(name)
+	if err != nil {
+		return fmt.Errorf("cannot retrieve %s: %v", name, err)
+	}
+
+	defer m.BinlogStore.Close()
+
+	if err = decompressFile(retrieved, dest, 0600); err != nil {
+		return fmt.Errorf("cannot decompress %s: %v", name, err)
+	}
+
+	return nil
+}
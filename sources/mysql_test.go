@@ -0,0 +1,152 @@
+package sources
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/sbusso/autobackup/stores"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBinlogShipping(t *testing.T) {
+	r := require.New(t)
+	tmp, err := ioutil.TempDir("", "mysql")
+	r.NoError(err, "failed to create temp directory")
+
+	defer os.RemoveAll(tmp)
+
+	scripts := map[string]string{
+		// fake mysql answering the queries and recording what is restored
+		"mysql": `#!/bin/sh
+case "$*" in
+  *"SHOW BINARY LOGS"*) printf 'binlog.000001\t100\nbinlog.000002\t200\nbinlog.000003\t50\n';;
+  *"FLUSH BINARY LOGS"*) ;;
+  *) cat >> ` + tmp + `/applied;;
+esac
+`,
+		"mysqldump": `#!/bin/sh
+echo "$@" > ` + tmp + `/dump-args
+cat ${1#--defaults-extra-file=} > ` + tmp + `/defaults
+echo "-- CHANGE REPLICATION SOURCE TO SOURCE_LOG_FILE='binlog.000002', SOURCE_LOG_POS=157;"
+echo "CREATE TABLE orders;"
+`,
+		// fake mysqlbinlog downloading binlogs or printing their events
+		"mysqlbinlog": `#!/bin/sh
+case "$*" in
+  *--read-from-remote-server*)
+    echo $* >> ` + tmp + `/fetched
+    for arg; do case $arg in --result-file=*) dir=${arg#--result-file=};; esac; name=$arg; done
+    echo "events of $name" > $dir$name;;
+  *)
+    echo "$@" > ` + tmp + `/binlog-args
+    for arg; do case $arg in -*) ;; *) cat $arg;; esac; done;;
+esac
+`,
+	}
+
+	for name, content := range scripts {
+		r.NoError(ioutil.WriteFile(path.Join(tmp, name), []byte(content), 0755))
+	}
+
+	defer func(dump, restore, binlog string) {
+		MysqlDumpCmd, MysqlRestoreCmd, MysqlBinlogCmd = dump, restore, binlog
+	}(MysqlDumpCmd, MysqlRestoreCmd, MysqlBinlogCmd)
+	MysqlDumpCmd = path.Join(tmp, "mysqldump")
+	MysqlRestoreCmd = path.Join(tmp, "mysql")
+	MysqlBinlogCmd = path.Join(tmp, "mysqlbinlog")
+
+	storeDir := path.Join(tmp, "binlogs")
+	r.NoError(os.Mkdir(storeDir, 0700))
+	store := &stores.FilesystemConfig{SaveDir: storeDir}
+
+	m := MySQLConfig{
+		Host:     "localhost",
+		Port:     "3306",
+		User:     "root",
+		Password: `s3"cret`,
+		Compress: true,
+		Binlog:   true,
+		SaveDir:  tmp,
+	}
+
+	filepath, err := m.Backup()
+	r.NoError(err, "failed to backup")
+
+	args, err := ioutil.ReadFile(path.Join(tmp, "dump-args"))
+	r.NoError(err)
+	r.Contains(string(args), "--source-data=2 --flush-logs")
+	r.NotContains(string(args), "s3", "password exposed in arguments")
+
+	defaults, err := ioutil.ReadFile(path.Join(tmp, "defaults"))
+	r.NoError(err)
+	r.Equal("[client]\nuser=\"root\"\npassword=\"s3\\\"cret\"\n", string(defaults))
+
+	r.NoError(m.ShipBinlogs(store), "failed to ship binlogs")
+	r.NoError(m.ShipBinlogs(store), "failed to ship binlogs again")
+
+	shipped, err := ioutil.ReadDir(storeDir)
+	r.NoError(err)
+	r.Len(shipped, 2, "the open binlog was shipped")
+	r.Equal("binlog.000001.gz", shipped[0].Name())
+
+	fetched, err := ioutil.ReadFile(path.Join(tmp, "fetched"))
+	r.NoError(err)
+	r.Equal(2, strings.Count(string(fetched), "\n"), "binlogs shipped twice")
+
+	m.BinlogStore = store
+	m.StopDatetime = "2018-09-01 10:15:00"
+
+	r.NoError(m.Restore(filepath), "failed to restore")
+
+	args, err = ioutil.ReadFile(path.Join(tmp, "binlog-args"))
+	r.NoError(err)
+	r.Contains(string(args), "--start-position=157 --stop-datetime=2018-09-01 10:15:00 ")
+	r.NotContains(string(args), "binlog.000001", "binlog before the dump replayed")
+
+	applied, err := ioutil.ReadFile(path.Join(tmp, "applied"))
+	r.NoError(err)
+	r.Contains(string(applied), "CREATE TABLE orders;\n")
+	r.Contains(string(applied), "events of binlog.000002\n")
+
+	files, err := ioutil.ReadDir(tmp)
+	r.NoError(err)
+	for _, f := range files {
+		r.NotContains(f.Name(), ".mysql-defaults-", "option file was not removed")
+	}
+}
+
+func TestMySQLIgnoreExitCode(t *testing.T) {
+	r := require.New(t)
+	tmp, err := ioutil.TempDir("", "mysql")
+	r.NoError(err, "failed to create temp directory")
+
+	defer os.RemoveAll(tmp)
+
+	// fake mysql reading the dump and failing on some statements
+	script := path.Join(tmp, "mysql")
+	err = ioutil.WriteFile(script, []byte(`#!/bin/sh
+cat > `+tmp+`/restored
+exit 1
+`), 0755)
+	r.NoError(err, "failed to create fake mysql")
+
+	defer func(cmd string) { MysqlRestoreCmd = cmd }(MysqlRestoreCmd)
+	MysqlRestoreCmd = script
+
+	filepath := path.Join(tmp, "mysql-backup.sql")
+	r.NoError(ioutil.WriteFile(filepath, []byte("CREATE TABLE orders;\n"), 0600))
+
+	m := MySQLConfig{Host: "localhost", Port: "3306", User: "root", SaveDir: tmp}
+
+	r.Error(m.Restore(filepath), "exit code ignored")
+
+	m.IgnoreExitCode = true
+	r.NoError(m.Restore(filepath), "exit code not ignored")
+
+	restored, err := ioutil.ReadFile(path.Join(tmp, "restored"))
+	r.NoError(err)
+	r.Equal("CREATE TABLE orders;\n", string(restored))
+}
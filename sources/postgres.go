@@ -1,29 +1,51 @@
 package sources
 
 import (
-	"compress/gzip"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
-	"os/exec"
+	"path"
+	"strconv"
 	"strings"
 
 	"log"
+
+	"github.com/caarlos0/env"
+	"github.com/mitchellh/mapstructure"
 )
 
-// PostgresConfig has the config options for the Postgres service
+// PostgresConfig has the config options for the Postgres service. Physical
+// backups copy the whole cluster with pg_basebackup and are restored to
+// DataDir, recovering up to RecoveryTargetTime with RestoreCommand. The
+// directory format dumps and restores a database with Jobs in parallel.
 type PostgresConfig struct {
-	Host           string
-	Port           string
-	User           string
-	Password       string
-	Database       string
-	Options        string
-	Compress       bool
-	Custom         bool
-	SaveDir        string
-	IgnoreExitCode bool
-	Drop           bool
-	Owner          string
+	Host               string   `env:"DATABASE_HOST" envDefault:"localhost"`
+	Port               string   `env:"DATABASE_PORT" envDefault:"5432"`
+	User               string   `env:"DATABASE_USER"`
+	Password           string   `env:"DATABASE_PASSWORD"`
+	PasswordFile       string   `env:"DATABASE_PASSWORD_FILE"`
+	Database           string   `env:"DATABASE_NAME"`
+	Options            string   `env:"DATABASE_OPTIONS"`
+	Compress           bool     `env:"DATABASE_COMPRESS" envDefault:"true"`
+	Compression        string   `env:"DATABASE_COMPRESSION" envDefault:"gzip"`
+	CompressionLevel   int      `env:"DATABASE_COMPRESSION_LEVEL"`
+	CompressionThreads int      `env:"DATABASE_COMPRESSION_THREADS"`
+	Custom             bool     `env:"POSTGRES_CUSTOM_FORMAT" envDefault:"false"`
+	Directory          bool     `env:"POSTGRES_DIRECTORY_FORMAT" envDefault:"false"`
+	Jobs               int      `env:"POSTGRES_JOBS" envDefault:"1"`
+	IncludeTables      []string `env:"POSTGRES_INCLUDE_TABLES" envSeparator:","`
+	ExcludeTables      []string `env:"POSTGRES_EXCLUDE_TABLES" envSeparator:","`
+	IncludeSchemas     []string `env:"POSTGRES_INCLUDE_SCHEMAS" envSeparator:","`
+	ExcludeSchemas     []string `env:"POSTGRES_EXCLUDE_SCHEMAS" envSeparator:","`
+	SaveDir            string   `env:"SAVEDIR" envDefault:"/tmp/"`
+	IgnoreExitCode     bool     `env:"DATABASE_IGNORE_EXIT_CODE" envDefault:"false"`
+	Drop               bool     `env:"POSTGRES_DROP" envDefault:"false"`
+	Owner              string   `env:"POSTGRES_OWNER"`
+	Physical           bool     `env:"POSTGRES_PHYSICAL" envDefault:"false"`
+	DataDir            string   `env:"POSTGRES_DATA_DIR"`
+	RestoreCommand     string   `env:"POSTGRES_RESTORE_COMMAND"`
+	RecoveryTargetTime string   `env:"POSTGRES_RECOVERY_TARGET_TIME"`
 }
 
 var (
@@ -50,6 +72,54 @@ WHERE pg_stat_activity.datname = '%s' AND pid <> pg_backend_pid();`
 	maintenanceDatabase = "postgres"
 )
 
+// NewPostgresConfig reads the configuration from the environment, opts
+// override it. The password file has precedence over the password.
+func NewPostgresConfig(opts map[string]interface{}) (*PostgresConfig, error) {
+	cfg := &PostgresConfig{}
+	if err := env.Parse(cfg); err != nil {
+		return nil, err
+	}
+
+	if err := mapstructure.Decode(opts, cfg); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+func (p *PostgresConfig) validate() error {
+	if p.PasswordFile != "" {
+		password, err := readSecretFile(p.PasswordFile)
+		if err != nil {
+			return err
+		}
+
+		p.Password = password
+	}
+
+	if p.Host == "" || p.Port == "" || p.User == "" {
+		return fmt.Errorf("database host, port and user are required")
+	}
+
+	if p.Directory && p.Database == "" {
+		return fmt.Errorf("a database is required for the directory format")
+	}
+
+	if p.Custom && p.Directory {
+		return fmt.Errorf("custom and directory formats are exclusive")
+	}
+
+	if _, err := GetCodec(p.Compression); err != nil {
+		return err
+	}
+
+	return nil
+}
+
 func (p *PostgresConfig) newBaseArgs() []string {
 	args := []string{
 		"-h", p.Host,
@@ -71,6 +141,69 @@ func (p *PostgresConfig) newBaseArgs() []string {
 	return args
 }
 
+// filterArgs returns the pg_dump options selecting the tables and schemas
+func (p *PostgresConfig) filterArgs() []string {
+	var args []string
+
+	for _, table := range p.IncludeTables {
+		args = append(args, "-t", table)
+	}
+
+	for _, table := range p.ExcludeTables {
+		args = append(args, "-T", table)
+	}
+
+	for _, schema := range p.IncludeSchemas {
+		args = append(args, "-n", schema)
+	}
+
+	for _, schema := range p.ExcludeSchemas {
+		args = append(args, "-N", schema)
+	}
+
+	return args
+}
+
+func (p *PostgresConfig) jobsArgs() []string {
+	if p.Jobs > 1 {
+		return []string{"-j", strconv.Itoa(p.Jobs)}
+	}
+
+	return nil
+}
+
+// directoryDump runs pg_dump in directory format and packs the directory in
+// a tarball, the files of the directory are already compressed
+func (p *PostgresConfig) directoryDump(args []string) (string, error) {
+	dir, err := ioutil.TempDir(p.SaveDir, ".postgres-dump-")
+	if err != nil {
+		return "", fmt.Errorf("cannot create temporary directory: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	// pg_dump creates the output directory itself
+	dump := path.Join(dir, "dump")
+
+	args = append(args, "-Fd", "-f", dump)
+	args = append(args, p.jobsArgs()...)
+
+	app := p.newPostgresCmd()
+
+	if err = app.CmdRun(PostgresDumpCmd, args...); err != nil {
+		return "", fmt.Errorf("couldn't execute %s, %v", PostgresDumpCmd, err)
+	}
+
+	filepath := generateFilename(p.SaveDir, "postgres-backup", ".dir.tar")
+
+	if err = tarDirectory(dump, filepath); err != nil {
+		os.Remove(filepath)
+		return "", fmt.Errorf("cannot pack dump directory: %v", err)
+	}
+
+	return filepath, nil
+}
+
 func (p *PostgresConfig) newPostgresCmd() *CmdConfig {
 	var env []string
 
@@ -85,7 +218,10 @@ func (p *PostgresConfig) newPostgresCmd() *CmdConfig {
 
 // Backup generates a dump of the database and returns the path where is stored
 func (p *PostgresConfig) Backup() (string, error) {
-	filepath := generateFilename(p.SaveDir, "postgres-backup")
+	if p.Physical {
+		return p.basebackup()
+	}
+
 	args := p.newBaseArgs()
 
 	var appPath string
@@ -95,48 +231,87 @@ func (p *PostgresConfig) Backup() (string, error) {
 		appPath = PostgresDumpallCmd
 	}
 
+	if p.Database != "" {
+		args = append(args, p.filterArgs()...)
+	}
+
+	if p.Directory && p.Database != "" {
+		return p.directoryDump(args)
+	}
+
 	// only allow custom format when dumping a single database
+	var filepath string
+	var writer io.WriteCloser
 	if p.Custom && p.Database != "" {
-		filepath += ".dump"
+		filepath = generateFilename(p.SaveDir, "postgres-backup", ".dump")
 		args = append(args, "-f", filepath)
 		args = append(args, "-Fc")
 	} else if !p.Compress {
-		filepath += ".sql"
+		filepath = generateFilename(p.SaveDir, "postgres-backup", ".sql")
 		args = append(args, "-f", filepath)
 	} else {
-		filepath += ".sql.gz"
-	}
-
-	app := p.newPostgresCmd()
-
-	if p.Compress && !p.Custom {
-		f, err := os.Create(filepath)
+		codec, err := GetCodec(p.Compression)
 		if err != nil {
-			return "", fmt.Errorf("cannot create file: %v", err)
+			return "", err
 		}
 
-		defer f.Close()
+		filepath = generateFilename(p.SaveDir, "postgres-backup", ".sql"+codec.Extension)
+
+		if writer, err = createCompressed(filepath, codec, p.CompressionLevel, p.CompressionThreads); err != nil {
+			return "", err
+		}
+	}
 
-		writer := gzip.NewWriter(f)
-		defer writer.Close()
+	app := p.newPostgresCmd()
 
+	if writer != nil {
 		app.OutputFile = writer
 	}
 
 	if err := app.CmdRun(appPath, args...); err != nil {
+		if writer != nil {
+			writer.Close()
+		}
+
 		return "", fmt.Errorf("couldn't execute %s, %v", appPath, err)
 	}
 
+	if writer != nil {
+		if err := writer.Close(); err != nil {
+			return "", fmt.Errorf("cannot compress %s: %v", filepath, err)
+		}
+	}
+
 	return filepath, nil
 }
 
 // Restore takes a database dump and restores it
 func (p *PostgresConfig) Restore(filepath string) error {
+	if p.Physical {
+		return p.restoreBasebackup(filepath)
+	}
+
 	args := p.newBaseArgs()
 	var appPath string
 
-	// only allow custom format when restoring a single database
-	if p.Custom && p.Database != "" {
+	// only allow custom and directory formats when restoring a single database
+	if p.Directory && p.Database != "" {
+		dir, err := ioutil.TempDir(p.SaveDir, ".postgres-restore-")
+		if err != nil {
+			return fmt.Errorf("cannot create temporary directory: %v", err)
+		}
+
+		defer os.RemoveAll(dir)
+
+		if err = extractTarFile(filepath, dir); err != nil {
+			return fmt.Errorf("cannot unpack %s: %v", filepath, err)
+		}
+
+		args = append(args, "-Fd")
+		args = append(args, p.jobsArgs()...)
+		args = append(args, dir)
+		appPath = PostgresRestoreCmd
+	} else if p.Custom && p.Database != "" {
 		args = append(args, filepath)
 		appPath = PostgresRestoreCmd
 	} else {
@@ -145,27 +320,15 @@ func (p *PostgresConfig) Restore(filepath string) error {
 
 	app := p.newPostgresCmd()
 
-	if !p.Custom {
-		f, err := os.Open(filepath)
+	if appPath == PostgresTermCmd {
+		reader, closer, err := openBackup(filepath)
 		if err != nil {
-			return fmt.Errorf("cannot open file: %v", err)
+			return err
 		}
 
-		defer f.Close()
-
-		if strings.HasSuffix(filepath, ".gz") {
-			reader, err := gzip.NewReader(f)
-			if err != nil {
-				return fmt.Errorf("cannot create gzip reader: %v", err)
-			}
+		defer closer()
 
-			defer reader.Close()
-
-			app.InputFile = reader
-		} else {
-			app.InputFile = f
-		}
-		defer f.Close()
+		app.InputFile = reader
 	}
 
 	if p.Drop {
@@ -175,14 +338,8 @@ func (p *PostgresConfig) Restore(filepath string) error {
 		}
 	}
 
-	if err := app.CmdRun(appPath, args...); err != nil {
-		serr, ok := err.(*exec.ExitError)
-
-		if ok && p.IgnoreExitCode {
-			log.Printf("Ignored exit code of restore process: %v\n", serr)
-		} else {
-			return fmt.Errorf("couldn't execute %s, %v", appPath, err)
-		}
+	if err := ignoreExitCode(app.CmdRun(appPath, args...), p.IgnoreExitCode); err != nil {
+		return fmt.Errorf("couldn't execute %s, %v", appPath, err)
 	}
 
 	return nil
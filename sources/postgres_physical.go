@@ -0,0 +1,304 @@
+package sources
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"log"
+)
+
+// PostgresBasebackupCmd points to the pg_basebackup binary location
+var PostgresBasebackupCmd = "/usr/bin/pg_basebackup"
+
+// basebackup runs pg_basebackup in tar format with streamed WAL and bundles
+// the resulting files in a single tarball
+func (p *PostgresConfig) basebackup() (string, error) {
+	dir, err := ioutil.TempDir(p.SaveDir, ".postgres-basebackup-")
+	if err != nil {
+		return "", fmt.Errorf("cannot create temporary directory: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	args := []string{
+		"-h", p.Host,
+		"-p", p.Port,
+		"-U", p.User,
+		"-D", dir,
+		"-Ft",
+		"-X", "stream",
+	}
+
+	if p.Compress {
+		args = append(args, "-z")
+	}
+
+	args = append(args, strings.Fields(p.Options)...)
+
+	app := p.newPostgresCmd()
+
+	if err = app.CmdRun(PostgresBasebackupCmd, args...); err != nil {
+		return "", fmt.Errorf("couldn't execute %s, %v", PostgresBasebackupCmd, err)
+	}
+
+	filepath := generateFilename(p.SaveDir, "postgres-basebackup", ".tar")
+
+	if err = tarDirectory(dir, filepath); err != nil {
+		os.Remove(filepath)
+		return "", fmt.Errorf("cannot bundle base backup: %v", err)
+	}
+
+	return filepath, nil
+}
+
+// restoreBasebackup extracts a base backup to the data directory and
+// prepares the recovery, the server must be stopped. An existing directory
+// is moved aside once the extraction succeeded.
+func (p *PostgresConfig) restoreBasebackup(filepath string) error {
+	if p.DataDir == "" {
+		return fmt.Errorf("data directory is not set")
+	}
+
+	if _, err := os.Stat(path.Join(p.DataDir, "postmaster.pid")); err == nil {
+		return fmt.Errorf("postgres is running on %s, stop it before restoring", p.DataDir)
+	}
+
+	// the backup is extracted to a sibling staging directory, the existing
+	// data directory is only moved aside once it is complete
+	staging := p.DataDir + ".restore-" + time.Now().Format("20060102150405")
+
+	if err := os.MkdirAll(staging, 0700); err != nil {
+		return fmt.Errorf("cannot create data directory: %v", err)
+	}
+
+	if err := p.extractBasebackup(filepath, staging); err != nil {
+		os.RemoveAll(staging)
+		return err
+	}
+
+	var old string
+
+	if _, err := os.Stat(p.DataDir); err == nil {
+		old = p.DataDir + ".old-" + time.Now().Format("20060102150405")
+		log.Printf("Moving existing data directory to %s\n", old)
+
+		if err = os.Rename(p.DataDir, old); err != nil {
+			os.RemoveAll(staging)
+			return fmt.Errorf("cannot move existing data directory: %v", err)
+		}
+	}
+
+	if err := os.Rename(staging, p.DataDir); err != nil {
+		os.RemoveAll(staging)
+
+		if old != "" {
+			if rerr := os.Rename(old, p.DataDir); rerr != nil {
+				log.Printf("Cannot move back the data directory from %s: %v\n", old, rerr)
+			}
+		}
+
+		return fmt.Errorf("cannot move restored data directory: %v", err)
+	}
+
+	return nil
+}
+
+// extractBasebackup extracts the members of a base backup to dataDir and
+// prepares the recovery
+func (p *PostgresConfig) extractBasebackup(filepath, dataDir string) error {
+	f, err := os.Open(filepath)
+	if err != nil {
+		return fmt.Errorf("cannot open file: %v", err)
+	}
+
+	defer f.Close()
+
+	bundle := tar.NewReader(f)
+	restoredBase := false
+	var tablespaces map[string]string
+
+	for {
+		header, err := bundle.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return fmt.Errorf("invalid base backup: %v", err)
+		}
+
+		name := strings.TrimSuffix(strings.TrimSuffix(header.Name, ".gz"), ".tar")
+
+		var dest string
+
+		switch {
+		case name == "base":
+			dest = dataDir
+			restoredBase = true
+		case name == "pg_wal":
+			dest = path.Join(dataDir, "pg_wal")
+		case header.Name == "backup_manifest":
+			continue
+		case restoredBase:
+			// tablespaces are named after their OID, pg_basebackup lists them in
+			// tablespace_map since PostgreSQL 9.5 and linked them from pg_tblspc
+			// before
+			if dest = tablespaces[name]; dest == "" {
+				dest, err = os.Readlink(path.Join(dataDir, "pg_tblspc", name))
+				if err != nil {
+					return fmt.Errorf("unknown tablespace %s: %v", name, err)
+				}
+			}
+		default:
+			return fmt.Errorf("unexpected file %s before base.tar", header.Name)
+		}
+
+		log.Printf("Extracting %s to %s\n", header.Name, dest)
+
+		var reader io.Reader = bundle
+
+		if strings.HasSuffix(header.Name, ".gz") {
+			gz, err := gzip.NewReader(bundle)
+			if err != nil {
+				return fmt.Errorf("cannot create gzip reader: %v", err)
+			}
+
+			reader = gz
+		}
+
+		// reading the rest of the member checks the gzip checksum and catches a
+		// truncated bundle, the file would otherwise be seeked over
+		if err = extractTar(reader, dest); err == nil {
+			_, err = io.Copy(ioutil.Discard, reader)
+		}
+
+		if err != nil {
+			return fmt.Errorf("cannot extract %s: %v", header.Name, err)
+		}
+
+		if name == "base" {
+			if tablespaces, err = readTablespaceMap(dataDir); err != nil {
+				return fmt.Errorf("invalid tablespace_map: %v", err)
+			}
+		}
+	}
+
+	if !restoredBase {
+		return fmt.Errorf("base backup has no base.tar")
+	}
+
+	return p.prepareRecovery(dataDir)
+}
+
+// readTablespaceMap returns the locations of the tablespaces by OID, listed
+// in the tablespace_map file of a base backup as "<oid> <location>" lines.
+// Backslashes escape the line breaks of the locations.
+func readTablespaceMap(dataDir string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path.Join(dataDir, "tablespace_map"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	tablespaces := map[string]string{}
+
+	var line []byte
+	escaped := false
+
+	for _, c := range data {
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\':
+			escaped = true
+			continue
+		case c == '\n':
+			if err = addTablespace(tablespaces, string(line)); err != nil {
+				return nil, err
+			}
+
+			line = line[:0]
+			continue
+		}
+
+		line = append(line, c)
+	}
+
+	if len(line) > 0 {
+		if err = addTablespace(tablespaces, string(line)); err != nil {
+			return nil, err
+		}
+	}
+
+	return tablespaces, nil
+}
+
+func addTablespace(tablespaces map[string]string, line string) error {
+	if line == "" {
+		return nil
+	}
+
+	fields := strings.SplitN(line, " ", 2)
+	if len(fields) != 2 || fields[1] == "" {
+		return fmt.Errorf("invalid line %q", line)
+	}
+
+	tablespaces[fields[0]] = fields[1]
+
+	return nil
+}
+
+// prepareRecovery configures the server of dataDir to replay the archived WAL
+// up to the target time on its next start
+func (p *PostgresConfig) prepareRecovery(dataDir string) error {
+	if p.RestoreCommand == "" && p.RecoveryTargetTime == "" {
+		return nil
+	}
+
+	var settings []string
+
+	if p.RestoreCommand != "" {
+		settings = append(settings, "restore_command = "+quoteSetting(p.RestoreCommand))
+	}
+
+	if p.RecoveryTargetTime != "" {
+		settings = append(settings,
+			"recovery_target_time = "+quoteSetting(p.RecoveryTargetTime),
+			"recovery_target_action = 'promote'")
+	}
+
+	conf, err := os.OpenFile(path.Join(dataDir, "postgresql.auto.conf"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("cannot open postgresql.auto.conf: %v", err)
+	}
+
+	_, err = conf.WriteString("\n# added by autobackup restore\n" + strings.Join(settings, "\n") + "\n")
+
+	if cerr := conf.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		return fmt.Errorf("cannot write recovery settings: %v", err)
+	}
+
+	if err = ioutil.WriteFile(path.Join(dataDir, "recovery.signal"), nil, 0600); err != nil {
+		return fmt.Errorf("cannot create recovery.signal: %v", err)
+	}
+
+	return nil
+}
+
+func quoteSetting(value string) string {
+	return "'" + strings.Replace(value, "'", "''", -1) + "'"
+}
@@ -0,0 +1,319 @@
+package sources
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/sbusso/autobackup/stores"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBasebackupRestore(t *testing.T) {
+	r := require.New(t)
+	tmp, err := ioutil.TempDir("", "postgres")
+	r.NoError(err, "failed to create temp directory")
+
+	defer os.RemoveAll(tmp)
+
+	// fake pg_basebackup writing the tar format output to the -D directory
+	script := path.Join(tmp, "pg_basebackup")
+	err = ioutil.WriteFile(script, []byte(`#!/bin/sh
+while [ $# -gt 0 ]; do
+  case $1 in -D) dir=$2; shift;; esac
+  shift
+done
+cd `+tmp+` && mkdir -p src/global src/wal src/tblspc/PG_16_202307071 && echo 16 > src/PG_VERSION && echo segment > src/wal/000000010000000000000001
+echo relation > src/tblspc/PG_16_202307071/16384
+echo "16385 `+tmp+`/tblspc" > src/tablespace_map
+tar -czf $dir/base.tar.gz -C src PG_VERSION global tablespace_map
+tar -czf $dir/16385.tar.gz -C src/tblspc .
+tar -czf $dir/pg_wal.tar.gz -C src/wal .
+echo '{}' > $dir/backup_manifest
+`), 0755)
+	r.NoError(err, "failed to create fake pg_basebackup")
+
+	defer func(cmd string) { PostgresBasebackupCmd = cmd }(PostgresBasebackupCmd)
+	PostgresBasebackupCmd = script
+
+	dataDir := path.Join(tmp, "data")
+
+	p := PostgresConfig{
+		Physical:           true,
+		Compress:           true,
+		DataDir:            dataDir,
+		RestoreCommand:     "app wal-fetch %f %p",
+		RecoveryTargetTime: "2018-09-01 10:15:00+00",
+		SaveDir:            tmp,
+	}
+
+	filepath, err := p.Backup()
+	r.NoError(err, "failed to backup")
+
+	r.NoError(p.Restore(filepath), "failed to restore")
+
+	version, err := ioutil.ReadFile(path.Join(dataDir, "PG_VERSION"))
+	r.NoError(err, "data directory not restored")
+	r.Equal("16\n", string(version))
+
+	_, err = os.Stat(path.Join(dataDir, "pg_wal", "000000010000000000000001"))
+	r.NoError(err, "WAL not restored")
+
+	// the tablespace is extracted to its location in tablespace_map
+	relation, err := ioutil.ReadFile(path.Join(tmp, "tblspc", "PG_16_202307071", "16384"))
+	r.NoError(err, "tablespace not restored")
+	r.Equal("relation\n", string(relation))
+
+	_, err = os.Stat(path.Join(dataDir, "recovery.signal"))
+	r.NoError(err, "recovery.signal not created")
+
+	conf, err := ioutil.ReadFile(path.Join(dataDir, "postgresql.auto.conf"))
+	r.NoError(err)
+	r.Contains(string(conf), "restore_command = 'app wal-fetch %f %p'")
+	r.Contains(string(conf), "recovery_target_time = '2018-09-01 10:15:00+00'")
+
+	r.NoError(ioutil.WriteFile(path.Join(dataDir, "postmaster.pid"), nil, 0600))
+	r.Error(p.Restore(filepath), "restored over a running server")
+	r.NoError(os.Remove(path.Join(dataDir, "postmaster.pid")))
+
+	// a failed extraction leaves the data directory in place
+	data, err := ioutil.ReadFile(filepath)
+	r.NoError(err)
+	truncated := path.Join(tmp, "truncated.tar")
+	r.NoError(ioutil.WriteFile(truncated, data[:600], 0600))
+
+	r.Error(p.Restore(truncated), "truncated base backup restored")
+
+	version, err = ioutil.ReadFile(path.Join(dataDir, "PG_VERSION"))
+	r.NoError(err, "data directory moved by a failed restore")
+	r.Equal("16\n", string(version))
+
+	files, err := ioutil.ReadDir(tmp)
+	r.NoError(err)
+
+	for _, f := range files {
+		r.NotContains(f.Name(), ".restore-", "staging directory left behind")
+	}
+}
+
+func TestWALArchive(t *testing.T) {
+	r := require.New(t)
+	tmp, err := ioutil.TempDir("", "wal")
+	r.NoError(err, "failed to create temp directory")
+
+	defer os.RemoveAll(tmp)
+
+	walDir := path.Join(tmp, "pg_wal")
+	storeDir := path.Join(tmp, "store")
+	r.NoError(os.Mkdir(walDir, 0700))
+	r.NoError(os.Mkdir(storeDir, 0700))
+
+	segment := path.Join(walDir, "000000010000000000000002")
+	r.NoError(ioutil.WriteFile(segment, []byte("wal contents"), 0600))
+
+	archive := WALArchive{
+		Store:   &stores.FilesystemConfig{SaveDir: storeDir},
+		SaveDir: tmp,
+	}
+
+	r.NoError(archive.Push(segment, path.Base(segment)), "failed to push segment")
+
+	_, err = os.Stat(segment)
+	r.NoError(err, "segment removed from pg_wal")
+
+	dest := path.Join(tmp, "RECOVERYXLOG")
+	r.NoError(archive.Fetch(path.Base(segment), dest), "failed to fetch segment")
+
+	contents, err := ioutil.ReadFile(dest)
+	r.NoError(err)
+	r.Equal("wal contents", string(contents))
+
+	r.Error(archive.Fetch("000000010000000000000003", dest), "fetched a missing segment")
+
+	// segments archived before a codec change are still fetched
+	archive.Compression = "zstd"
+	r.NoError(os.Remove(dest))
+	r.NoError(archive.Fetch(path.Base(segment), dest), "failed to fetch gzip segment")
+
+	contents, err = ioutil.ReadFile(dest)
+	r.NoError(err)
+	r.Equal("wal contents", string(contents))
+
+	r.NoError(archive.Push(segment, "000000010000000000000003"), "failed to push segment")
+
+	_, err = os.Stat(path.Join(storeDir, "000000010000000000000003.zst"))
+	r.NoError(err, "segment not compressed with zstd")
+}
+
+func TestExtractTarSymlink(t *testing.T) {
+	r := require.New(t)
+	tmp, err := ioutil.TempDir("", "extract")
+	r.NoError(err, "failed to create temp directory")
+
+	defer os.RemoveAll(tmp)
+
+	outside := path.Join(tmp, "outside")
+	r.NoError(os.Mkdir(outside, 0700))
+
+	var buf bytes.Buffer
+	archive := tar.NewWriter(&buf)
+	r.NoError(archive.WriteHeader(&tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: outside}))
+	r.NoError(archive.WriteHeader(&tar.Header{Name: "link/evil", Typeflag: tar.TypeReg, Mode: 0644, Size: 4}))
+	_, err = archive.Write([]byte("evil"))
+	r.NoError(err)
+	r.NoError(archive.Close())
+
+	r.Error(extractTar(&buf, path.Join(tmp, "dest")), "entry below a symlink extracted")
+
+	_, err = os.Stat(path.Join(outside, "evil"))
+	r.True(os.IsNotExist(err), "file written outside of the destination")
+}
+
+func TestDirectoryFormat(t *testing.T) {
+	r := require.New(t)
+	tmp, err := ioutil.TempDir("", "postgres")
+	r.NoError(err, "failed to create temp directory")
+
+	defer os.RemoveAll(tmp)
+
+	// fake pg_dump writing a directory format dump to the -f directory
+	dump := path.Join(tmp, "pg_dump")
+	err = ioutil.WriteFile(dump, []byte(`#!/bin/sh
+echo "$@" > `+tmp+`/dump-args
+while [ $# -gt 0 ]; do
+  case $1 in -f) dir=$2; shift;; esac
+  shift
+done
+mkdir $dir && echo toc > $dir/toc.dat && echo data > $dir/3001.dat.gz
+`), 0755)
+	r.NoError(err, "failed to create fake pg_dump")
+
+	// fake pg_restore recording its arguments and the files of the directory
+	restore := path.Join(tmp, "pg_restore")
+	err = ioutil.WriteFile(restore, []byte(`#!/bin/sh
+echo "$@" > `+tmp+`/restore-args
+for arg; do dir=$arg; done
+ls $dir > `+tmp+`/restore-files
+`), 0755)
+	r.NoError(err, "failed to create fake pg_restore")
+
+	defer func(dump, restore string) {
+		PostgresDumpCmd, PostgresRestoreCmd = dump, restore
+	}(PostgresDumpCmd, PostgresRestoreCmd)
+	PostgresDumpCmd, PostgresRestoreCmd = dump, restore
+
+	p := PostgresConfig{
+		Host:           "localhost",
+		Port:           "5432",
+		User:           "postgres",
+		Database:       "shop",
+		Directory:      true,
+		Jobs:           4,
+		ExcludeTables:  []string{"audit_*"},
+		ExcludeSchemas: []string{"archive"},
+		SaveDir:        tmp,
+	}
+
+	filepath, err := p.Backup()
+	r.NoError(err, "failed to backup")
+	r.Contains(filepath, ".dir.tar")
+
+	args, err := ioutil.ReadFile(path.Join(tmp, "dump-args"))
+	r.NoError(err)
+	r.Contains(string(args), "-d shop -T audit_* -N archive -Fd -f ")
+	r.Contains(string(args), " -j 4")
+
+	r.NoError(p.Restore(filepath), "failed to restore")
+
+	args, err = ioutil.ReadFile(path.Join(tmp, "restore-args"))
+	r.NoError(err)
+	r.Contains(string(args), "-d shop -Fd -j 4 ")
+
+	files, err := ioutil.ReadFile(path.Join(tmp, "restore-files"))
+	r.NoError(err)
+	r.Equal("3001.dat.gz\ntoc.dat\n", string(files))
+}
+
+func TestNewPostgresConfig(t *testing.T) {
+	r := require.New(t)
+	tmp, err := ioutil.TempDir("", "postgres")
+	r.NoError(err, "failed to create temp directory")
+
+	defer os.RemoveAll(tmp)
+
+	passwordFile := path.Join(tmp, "password")
+	r.NoError(ioutil.WriteFile(passwordFile, []byte("from-file\n"), 0600))
+
+	vars := map[string]string{
+		"DATABASE_USER":           "backup",
+		"DATABASE_PASSWORD":       "from-env",
+		"DATABASE_PASSWORD_FILE":  passwordFile,
+		"DATABASE_NAME":           "shop",
+		"POSTGRES_EXCLUDE_TABLES": "audit,audit_*",
+	}
+
+	for name, value := range vars {
+		os.Setenv(name, value)
+		defer os.Unsetenv(name)
+	}
+
+	p, err := NewPostgresConfig(map[string]interface{}{"Jobs": 4})
+	r.NoError(err, "failed to create config")
+	r.Equal("localhost", p.Host)
+	r.Equal("5432", p.Port)
+	r.Equal("from-file", p.Password, "password file has precedence")
+	r.Equal([]string{"audit", "audit_*"}, p.ExcludeTables)
+	r.Equal(4, p.Jobs)
+	r.True(p.Compress)
+	r.Equal("/tmp/", p.SaveDir)
+
+	m, err := NewMySQLConfig(nil)
+	r.NoError(err, "failed to create config")
+	r.Equal("3306", m.Port)
+	r.Equal("from-file", m.Password)
+
+	os.Unsetenv("DATABASE_USER")
+	_, err = NewPostgresConfig(nil)
+	r.Error(err, "user is required")
+
+	os.Setenv("DATABASE_USER", "backup")
+	os.Setenv("DATABASE_PASSWORD_FILE", path.Join(tmp, "missing"))
+	_, err = NewMySQLConfig(nil)
+	r.Error(err, "missing password file")
+}
+
+func TestPlainRestoreIgnoreExitCode(t *testing.T) {
+	r := require.New(t)
+	tmp, err := ioutil.TempDir("", "postgres")
+	r.NoError(err, "failed to create temp directory")
+
+	defer os.RemoveAll(tmp)
+
+	// fake psql reading the dump and failing on some statements
+	psql := path.Join(tmp, "psql")
+	err = ioutil.WriteFile(psql, []byte(`#!/bin/sh
+cat > `+tmp+`/restored
+exit 3
+`), 0755)
+	r.NoError(err, "failed to create fake psql")
+
+	defer func(cmd string) { PostgresTermCmd = cmd }(PostgresTermCmd)
+	PostgresTermCmd = psql
+
+	filepath := path.Join(tmp, "postgres-backup.sql")
+	r.NoError(ioutil.WriteFile(filepath, []byte("CREATE TABLE orders();\n"), 0600))
+
+	p := PostgresConfig{Host: "localhost", Port: "5432", User: "postgres", SaveDir: tmp}
+
+	r.Error(p.Restore(filepath), "exit code ignored")
+
+	p.IgnoreExitCode = true
+	r.NoError(p.Restore(filepath), "exit code not ignored")
+
+	restored, err := ioutil.ReadFile(path.Join(tmp, "restored"))
+	r.NoError(err)
+	r.Equal("CREATE TABLE orders();\n", string(restored))
+}
@@ -0,0 +1,125 @@
+package sources
+
+import (
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/caarlos0/env"
+	"github.com/mitchellh/mapstructure"
+	"github.com/sbusso/autobackup/stores"
+)
+
+// WALArchive ships the WAL segments of a Postgres server to a store, Push and
+// Fetch are meant to be called from archive_command and restore_command
+type WALArchive struct {
+	Store              stores.Store
+	Compression        string `env:"WAL_COMPRESSION" envDefault:"gzip"`
+	CompressionLevel   int    `env:"WAL_COMPRESSION_LEVEL"`
+	CompressionThreads int    `env:"WAL_COMPRESSION_THREADS"`
+	SaveDir            string `env:"SAVEDIR" envDefault:"/tmp/"`
+}
+
+func NewWALArchive(store stores.Store, opts map[string]interface{}) *WALArchive {
+	cfg := &WALArchive{}
+	err := env.Parse(cfg)
+	mapstructure.Decode(opts, cfg)
+
+	cfg.Store = store
+
+	if err != nil {
+		fmt.Printf("%+v\n", err)
+	}
+	return cfg
+}
+
+// key returns the name used to retrieve a segment from the store
+func (w *WALArchive) key(filename string) string {
+	if idx, ok := w.Store.(stores.Indexer); ok {
+		return idx.Key(filename)
+	}
+
+	return filename
+}
+
+// Push compresses a segment and sends it to the store, the segment itself is
+// left in place as it is managed by postgres
+func (w *WALArchive) Push(walPath, walName string) error {
+	codec, err := GetCodec(w.Compression)
+	if err != nil {
+		return err
+	}
+
+	tmp := path.Join(w.SaveDir, walName+codec.Extension)
+
+	if err = compressFile(walPath, tmp, codec, w.CompressionLevel, w.CompressionThreads); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("cannot compress %s: %v", walName, err)
+	}
+
+	if err = w.Store.Store(tmp, walName+codec.Extension); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("cannot archive %s: %v", walName, err)
+	}
+
+	// the store may have moved the file already
+	os.Remove(tmp)
+
+	return nil
+}
+
+// retrieve downloads a segment, it is looked up with the extension of the
+// configured codec first, then of the other codecs
+func (w *WALArchive) retrieve(walName string) (string, error) {
+	codec, err := GetCodec(w.Compression)
+	if err != nil {
+		return "", err
+	}
+
+	// some stores return the path of a missing file without error
+	try := func(codec *Codec) (string, error) {
+		retrieved, err := w.Store.Retrieve(w.key(walName + codec.Extension))
+		if err == nil {
+			_, err = os.Stat(retrieved)
+		}
+
+		return retrieved, err
+	}
+
+	retrieved, err := try(codec)
+	if err == nil {
+		return retrieved, nil
+	}
+
+	for _, other := range sortedCodecs() {
+		if other == codec {
+			continue
+		}
+
+		if retrieved, rerr := try(other); rerr == nil {
+			return retrieved, nil
+		}
+	}
+
+	return "", err
+}
+
+// Fetch retrieves a segment from the store and writes it to dest
+func (w *WALArchive) Fetch(walName, dest string) error {
+	retrieved, err := w.retrieve(walName)
+	if err != nil {
+		return fmt.Errorf("cannot retrieve %s: %v", walName, err)
+	}
+
+	defer w.Store.Close()
+
+	// postgres may read dest as soon as it exists, write it under a temporary name
+	tmp := dest + ".fetch"
+	defer os.Remove(tmp)
+
+	if err = decompressFile(retrieved, tmp, 0600); err != nil {
+		return fmt.Errorf("cannot write %s: %v", tmp, err)
+	}
+
+	return os.Rename(tmp, dest)
+}
@@ -0,0 +1,487 @@
+package sources
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"log"
+
+	"github.com/caarlos0/env"
+	"github.com/mitchellh/mapstructure"
+)
+
+// RedisConfig has the config options for the Redis service. In "sync" mode
+// the snapshot is streamed from the server as a replica would, in "bgsave"
+// mode the server saves it to disk and the RDB file is copied from there.
+type RedisConfig struct {
+	Host               string        `env:"REDIS_HOST" envDefault:"localhost"`
+	Port               string        `env:"REDIS_PORT" envDefault:"6379"`
+	User               string        `env:"REDIS_USER"`
+	Password           string        `env:"REDIS_PASSWORD"`
+	TLS                bool          `env:"REDIS_TLS" envDefault:"false"`
+	CACert             string        `env:"REDIS_TLS_CA"`
+	Cert               string        `env:"REDIS_TLS_CERT"`
+	Key                string        `env:"REDIS_TLS_KEY"`
+	SkipVerify         bool          `env:"REDIS_TLS_SKIP_VERIFY" envDefault:"false"`
+	Mode               string        `env:"REDIS_MODE" envDefault:"sync"`
+	RDBFile            string        `env:"REDIS_RDB_FILE"`
+	Reload             bool          `env:"REDIS_RELOAD" envDefault:"false"`
+	Compress           bool          `env:"REDIS_COMPRESS" envDefault:"true"`
+	Compression        string        `env:"REDIS_COMPRESSION" envDefault:"gzip"`
+	CompressionLevel   int           `env:"REDIS_COMPRESSION_LEVEL"`
+	CompressionThreads int           `env:"REDIS_COMPRESSION_THREADS"`
+	SaveTimeout        time.Duration `env:"REDIS_SAVE_TIMEOUT" envDefault:"1h"`
+	SaveDir            string        `env:"SAVEDIR" envDefault:"/tmp/"`
+	DialTimeout        time.Duration
+	checkInterval      time.Duration
+}
+
+func NewRedisConfig(opts map[string]interface{}) *RedisConfig {
+	cfg := &RedisConfig{}
+	err := env.Parse(cfg)
+	mapstructure.Decode(opts, cfg)
+
+	if err != nil {
+		fmt.Printf("%+v\n", err)
+	}
+	return cfg
+}
+
+// redisConn is a minimal client of the Redis protocol
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func (r *RedisConfig) dial() (*redisConn, error) {
+	addr := net.JoinHostPort(r.Host, r.Port)
+	dialer := &net.Dialer{Timeout: r.DialTimeout}
+	if dialer.Timeout == 0 {
+		dialer.Timeout = 10 * time.Second
+	}
+
+	var conn net.Conn
+	var err error
+
+	if r.TLS {
+		config, err := newTLSConfig(r.Host, r.CACert, r.Cert, r.Key, r.SkipVerify)
+		if err != nil {
+			return nil, err
+		}
+
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, config)
+		if err != nil {
+			return nil, fmt.Errorf("cannot connect to %s: %v", addr, err)
+		}
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+		if err != nil {
+			return nil, fmt.Errorf("cannot connect to %s: %v", addr, err)
+		}
+	}
+
+	c := &redisConn{conn: conn, reader: bufio.NewReader(conn)}
+
+	if r.Password != "" {
+		args := []string{"AUTH", r.Password}
+		if r.User != "" {
+			args = []string{"AUTH", r.User, r.Password}
+		}
+
+		if _, err = c.do(args...); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("authentication failed: %v", err)
+		}
+	}
+
+	return c, nil
+}
+
+func (c *redisConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *redisConn) send(args ...string) error {
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&buf, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+
+	_, err := c.conn.Write(buf.Bytes())
+	return err
+}
+
+func (c *redisConn) readLine() (string, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// reply reads a reply, arrays are returned as []interface{}
+func (c *redisConn) reply() (interface{}, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+
+	if line == "" {
+		return nil, fmt.Errorf("empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, fmt.Errorf("%s", line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, err
+		}
+
+		data := make([]byte, size+2)
+		if _, err = io.ReadFull(c.reader, data); err != nil {
+			return nil, err
+		}
+
+		return string(data[:size]), nil
+	case '*':
+		count, err := strconv.Atoi(line[1:])
+		if err != nil || count < 0 {
+			return nil, err
+		}
+
+		items := make([]interface{}, count)
+		for i := range items {
+			if items[i], err = c.reply(); err != nil {
+				return nil, err
+			}
+		}
+
+		return items, nil
+	}
+
+	return nil, fmt.Errorf("unexpected reply %q", line)
+}
+
+func (c *redisConn) do(args ...string) (interface{}, error) {
+	if err := c.send(args...); err != nil {
+		return nil, err
+	}
+
+	return c.reply()
+}
+
+// syncRDB requests a full synchronization and copies the RDB payload
+func (c *redisConn) syncRDB(w io.Writer) error {
+	if err := c.send("SYNC"); err != nil {
+		return err
+	}
+
+	var header string
+
+	// the server sends newlines as keepalive while it prepares the snapshot
+	for header == "" {
+		line, err := c.readLine()
+		if err != nil {
+			return err
+		}
+
+		header = line
+	}
+
+	if strings.HasPrefix(header, "-") {
+		return fmt.Errorf("%s", header[1:])
+	}
+
+	if !strings.HasPrefix(header, "$") {
+		return fmt.Errorf("unexpected sync reply %q", header)
+	}
+
+	// diskless replication sends the payload followed by a 40 bytes mark
+	if strings.HasPrefix(header, "$EOF:") {
+		mark := []byte(header[5:])
+		return copyUntilMark(w, c.reader, mark)
+	}
+
+	size, err := strconv.ParseInt(header[1:], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid sync payload size %q", header)
+	}
+
+	_, err = io.CopyN(w, c.reader, size)
+	return err
+}
+
+func copyUntilMark(w io.Writer, r io.Reader, mark []byte) error {
+	buf := make([]byte, 0, 64*1024+len(mark))
+	chunk := make([]byte, 64*1024)
+
+	for {
+		n, err := r.Read(chunk)
+		buf = append(buf, chunk[:n]...)
+
+		if i := bytes.Index(buf, mark); i >= 0 {
+			_, werr := w.Write(buf[:i])
+			return werr
+		}
+
+		// keep enough bytes to detect a mark split between reads
+		if keep := len(buf) - len(mark); keep > 0 {
+			if _, werr := w.Write(buf[:keep]); werr != nil {
+				return werr
+			}
+			buf = append(buf[:0], buf[keep:]...)
+		}
+
+		if err != nil {
+			if err == io.EOF {
+				return fmt.Errorf("sync payload ended before end mark")
+			}
+			return err
+		}
+	}
+}
+
+// rdbPath returns the RDB file of the server, from the configuration or as
+// reported by the server
+func (r *RedisConfig) rdbPath(c *redisConn) (string, error) {
+	if r.RDBFile != "" {
+		return r.RDBFile, nil
+	}
+
+	var parts []string
+
+	for _, param := range []string{"dir", "dbfilename"} {
+		res, err := c.do("CONFIG", "GET", param)
+		if err != nil {
+			return "", fmt.Errorf("cannot get %s: %v", param, err)
+		}
+
+		items, ok := res.([]interface{})
+		if !ok || len(items) != 2 {
+			return "", fmt.Errorf("unexpected reply to CONFIG GET %s", param)
+		}
+
+		parts = append(parts, fmt.Sprint(items[1]))
+	}
+
+	return path.Join(parts...), nil
+}
+
+// info returns the fields of a section of INFO
+func (c *redisConn) info(section string) (map[string]string, error) {
+	res, err := c.do("INFO", section)
+	if err != nil {
+		return nil, err
+	}
+
+	text, ok := res.(string)
+	if !ok {
+		return nil, fmt.Errorf("unexpected reply to INFO %s", section)
+	}
+
+	fields := map[string]string{}
+
+	for _, line := range strings.Split(text, "\n") {
+		if parts := strings.SplitN(strings.TrimSpace(line), ":", 2); len(parts) == 2 {
+			fields[parts[0]] = parts[1]
+		}
+	}
+
+	return fields, nil
+}
+
+// bgsave asks the server to save a snapshot and waits for LASTSAVE to change
+func (r *RedisConfig) bgsave(c *redisConn) error {
+	last, err := c.do("LASTSAVE")
+	if err != nil {
+		return fmt.Errorf("LASTSAVE failed: %v", err)
+	}
+
+	if _, err = c.do("BGSAVE"); err != nil {
+		return fmt.Errorf("BGSAVE failed: %v", err)
+	}
+
+	interval := r.checkInterval
+	if interval == 0 {
+		interval = time.Second
+	}
+
+	deadline := time.Now().Add(r.SaveTimeout)
+
+	for {
+		current, err := c.do("LASTSAVE")
+		if err != nil {
+			return fmt.Errorf("LASTSAVE failed: %v", err)
+		}
+
+		if current != last {
+			return nil
+		}
+
+		// a failed save doesn't change LASTSAVE, don't wait for the timeout
+		info, err := c.info("persistence")
+		if err != nil {
+			return fmt.Errorf("INFO failed: %v", err)
+		}
+
+		if info["rdb_bgsave_in_progress"] == "0" && info["rdb_last_bgsave_status"] != "ok" {
+			return fmt.Errorf("BGSAVE failed, see the server logs")
+		}
+
+		if r.SaveTimeout > 0 && time.Now().After(deadline) {
+			return fmt.Errorf("timeout waiting for BGSAVE to complete")
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+// Backup produces a RDB snapshot of the server
+func (r *RedisConfig) Backup() (string, error) {
+	var codec *Codec
+	var err error
+
+	ext := ".rdb"
+	if r.Compress {
+		if codec, err = GetCodec(r.Compression); err != nil {
+			return "", err
+		}
+
+		ext += codec.Extension
+	}
+
+	filepath := generateFilename(r.SaveDir, "redis-backup", ext)
+
+	c, err := r.dial()
+	if err != nil {
+		return "", err
+	}
+
+	defer c.Close()
+
+	f, err := os.Create(filepath)
+	if err != nil {
+		return "", fmt.Errorf("cannot create file: %v", err)
+	}
+
+	defer f.Close()
+
+	var writer io.Writer = f
+	var compressor io.WriteCloser
+
+	if codec != nil {
+		if compressor, err = codec.NewWriter(f, r.CompressionLevel, r.CompressionThreads); err != nil {
+			os.Remove(filepath)
+			return "", fmt.Errorf("cannot create %s writer: %v", codec.Name, err)
+		}
+
+		writer = compressor
+	}
+
+	switch r.Mode {
+	case "bgsave":
+		err = r.backupFromDisk(c, writer)
+	case "", "sync":
+		err = c.syncRDB(writer)
+	default:
+		err = fmt.Errorf("unknown mode %q", r.Mode)
+	}
+
+	if err == nil && compressor != nil {
+		err = compressor.Close()
+	}
+
+	if err != nil {
+		os.Remove(filepath)
+		return "", fmt.Errorf("cannot get redis snapshot: %v", err)
+	}
+
+	return filepath, nil
+}
+
+func (r *RedisConfig) backupFromDisk(c *redisConn, w io.Writer) error {
+	rdb, err := r.rdbPath(c)
+	if err != nil {
+		return err
+	}
+
+	if err = r.bgsave(c); err != nil {
+		return err
+	}
+
+	f, err := os.Open(rdb)
+	if err != nil {
+		return fmt.Errorf("cannot open RDB file: %v", err)
+	}
+
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// Restore places the RDB file where the server loads it from, then reloads
+// the server if configured to do so. Otherwise the server must be stopped
+// with SHUTDOWN NOSAVE and started again, a save on shutdown would overwrite
+// the restored file with the dataset in memory. With RDBFile set and Reload
+// unset, the server can also be stopped during the restore.
+func (r *RedisConfig) Restore(filepath string) error {
+	var c *redisConn
+	var err error
+
+	// the server may be stopped when it doesn't have to tell where the file is
+	if r.RDBFile == "" || r.Reload {
+		if c, err = r.dial(); err != nil {
+			return err
+		}
+
+		defer c.Close()
+	}
+
+	rdb, err := r.rdbPath(c)
+	if err != nil {
+		return err
+	}
+
+	tmp := path.Join(path.Dir(rdb), "."+path.Base(rdb)+".restore")
+	defer os.Remove(tmp)
+
+	if err = decompressFile(filepath, tmp, 0600); err != nil {
+		return fmt.Errorf("cannot write %s: %v", tmp, err)
+	}
+
+	if err = os.Rename(tmp, rdb); err != nil {
+		return fmt.Errorf("cannot replace %s: %v", rdb, err)
+	}
+
+	if !r.Reload {
+		log.Printf("Snapshot restored to %s, stop redis with SHUTDOWN NOSAVE and start it to load the snapshot, "+
+			"a save on shutdown would overwrite it\n", rdb)
+		return nil
+	}
+
+	// NOSAVE prevents the server from overwriting the restored file first
+	if _, err = c.do("DEBUG", "RELOAD", "NOSAVE"); err != nil {
+		return fmt.Errorf("DEBUG RELOAD failed, restart redis to load the snapshot: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,205 @@
+package sources
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRedis answers the commands used by RedisConfig
+func fakeRedis(t *testing.T, dir string, rdb []byte, diskless bool) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "failed to listen")
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				lastsave := 1
+
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+
+					count, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+					args := make([]string, count)
+					for i := range args {
+						reader.ReadString('\n')
+						arg, _ := reader.ReadString('\n')
+						args[i] = strings.TrimSpace(arg)
+					}
+
+					switch strings.ToUpper(args[0]) {
+					case "AUTH":
+						if len(args) == 3 && args[1] == "backup" && args[2] == "secret" {
+							conn.Write([]byte("+OK\r\n"))
+						} else {
+							conn.Write([]byte("-WRONGPASS invalid username-password pair\r\n"))
+						}
+					case "SYNC":
+						conn.Write([]byte("\n\n"))
+						if diskless {
+							mark := strings.Repeat("x", 40)
+							fmt.Fprintf(conn, "$EOF:%s\r\n%s%s", mark, rdb, mark)
+						} else {
+							fmt.Fprintf(conn, "$%d\r\n%s", len(rdb), rdb)
+						}
+					case "CONFIG":
+						value := dir
+						if args[2] == "dbfilename" {
+							value = "dump.rdb"
+						}
+						fmt.Fprintf(conn, "*2\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(args[2]), args[2], len(value), value)
+					case "LASTSAVE":
+						fmt.Fprintf(conn, ":%d\r\n", lastsave)
+					case "BGSAVE":
+						// the save of a nil snapshot fails
+						if rdb != nil {
+							ioutil.WriteFile(path.Join(dir, "dump.rdb"), rdb, 0600)
+							lastsave++
+						}
+						conn.Write([]byte("+Background saving started\r\n"))
+					case "INFO":
+						status := "ok"
+						if rdb == nil {
+							status = "err"
+						}
+						info := "# Persistence\r\nrdb_bgsave_in_progress:0\r\nrdb_last_bgsave_status:" + status + "\r\n"
+						fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(info), info)
+					case "DEBUG":
+						conn.Write([]byte("+OK\r\n"))
+					default:
+						conn.Write([]byte("-ERR unknown command\r\n"))
+					}
+				}
+			}()
+		}
+	}()
+
+	return l
+}
+
+func TestRedisBackupRestore(t *testing.T) {
+	r := require.New(t)
+	tmp, err := ioutil.TempDir("", "redis")
+	r.NoError(err, "failed to create temp directory")
+
+	defer os.RemoveAll(tmp)
+
+	rdb := []byte("REDIS0009" + strings.Repeat("\x00data", 1000))
+
+	for _, test := range []struct {
+		mode     string
+		diskless bool
+	}{{"sync", false}, {"sync", true}, {"bgsave", false}} {
+		l := fakeRedis(t, tmp, rdb, test.diskless)
+
+		host, port, _ := net.SplitHostPort(l.Addr().String())
+		redis := RedisConfig{
+			Host:          host,
+			Port:          port,
+			User:          "backup",
+			Password:      "secret",
+			Mode:          test.mode,
+			Compress:      true,
+			Reload:        true,
+			SaveDir:       tmp,
+			checkInterval: time.Millisecond,
+		}
+
+		filepath, err := redis.Backup()
+		r.NoError(err, "failed to backup in %s mode", test.mode)
+
+		err = redis.Restore(filepath)
+		r.NoError(err, "failed to restore")
+
+		actual, err := ioutil.ReadFile(path.Join(tmp, "dump.rdb"))
+		r.NoError(err, "failed to read restored RDB")
+		r.Equal(rdb, actual, "RDB contents mismatch in %s mode", test.mode)
+
+		os.Remove(filepath)
+		os.Remove(path.Join(tmp, "dump.rdb"))
+
+		redis.Password = "wrong"
+		_, err = redis.Backup()
+		r.Error(err, "authentication should fail")
+
+		l.Close()
+	}
+}
+
+func TestRedisBgsaveFailure(t *testing.T) {
+	r := require.New(t)
+	tmp, err := ioutil.TempDir("", "redis")
+	r.NoError(err, "failed to create temp directory")
+
+	defer os.RemoveAll(tmp)
+
+	l := fakeRedis(t, tmp, nil, false)
+	defer l.Close()
+
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	redis := RedisConfig{
+		Host:          host,
+		Port:          port,
+		User:          "backup",
+		Password:      "secret",
+		Mode:          "bgsave",
+		SaveTimeout:   time.Hour,
+		SaveDir:       tmp,
+		checkInterval: time.Millisecond,
+	}
+
+	start := time.Now()
+	_, err = redis.Backup()
+	r.Error(err, "failed save not reported")
+	r.Contains(err.Error(), "BGSAVE failed")
+	r.True(time.Since(start) < time.Minute, "waited for the save timeout")
+}
+
+func TestRedisServer(t *testing.T) {
+	server, err := exec.LookPath("redis-server")
+	if err != nil {
+		t.Skip("redis-server not found")
+	}
+
+	r := require.New(t)
+	tmp, err := ioutil.TempDir("", "redis")
+	r.NoError(err, "failed to create temp directory")
+
+	defer os.RemoveAll(tmp)
+
+	cmd := exec.Command(server, "--port", "16379", "--dir", tmp, "--save", "")
+	r.NoError(cmd.Start(), "failed to start redis-server")
+
+	defer cmd.Process.Kill()
+
+	time.Sleep(500 * time.Millisecond)
+
+	redis := RedisConfig{Host: "127.0.0.1", Port: "16379", Mode: "sync", SaveDir: tmp}
+
+	filepath, err := redis.Backup()
+	r.NoError(err, "failed to backup redis")
+
+	data, err := ioutil.ReadFile(filepath)
+	r.NoError(err, "failed to read snapshot")
+	r.True(strings.HasPrefix(string(data), "REDIS"), "snapshot is not a RDB file")
+}
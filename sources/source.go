@@ -5,3 +5,9 @@ type Source interface {
 	Backup() (string, error)
 	Restore(path string) error
 }
+
+// Committer is implemented by the sources keeping state between backups, the
+// tasks commit the state of a backup once it was stored
+type Committer interface {
+	Commit(filepath string) error
+}
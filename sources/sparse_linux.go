@@ -0,0 +1,61 @@
+package sources
+
+import (
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// dataSegments returns the data regions of the first size bytes of a file,
+// found with SEEK_DATA and SEEK_HOLE. It returns nil when the file has no
+// holes or the filesystem can't tell.
+func dataSegments(f *os.File, size int64) ([]sparseSegment, error) {
+	fd := int(f.Fd())
+
+	// a file with only a hole has no segments
+	segments := []sparseSegment{}
+	var offset int64
+
+	for offset < size {
+		data, err := unix.Seek(fd, offset, unix.SEEK_DATA)
+		if err == unix.ENXIO {
+			// only a hole is left
+			break
+		}
+
+		if err == unix.EINVAL || err == unix.EOPNOTSUPP {
+			return nil, nil
+		}
+
+		if err != nil {
+			return nil, &os.PathError{Op: "seek", Path: f.Name(), Err: err}
+		}
+
+		if data >= size {
+			break
+		}
+
+		hole, err := unix.Seek(fd, data, unix.SEEK_HOLE)
+		if err != nil {
+			return nil, &os.PathError{Op: "seek", Path: f.Name(), Err: err}
+		}
+
+		if hole > size {
+			hole = size
+		}
+
+		segments = append(segments, sparseSegment{Offset: data, Length: hole - data})
+		offset = hole
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	if size == 0 || (len(segments) == 1 && segments[0].Length == size) {
+		return nil, nil
+	}
+
+	return segments, nil
+}
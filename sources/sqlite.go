@@ -0,0 +1,173 @@
+package sources
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path"
+	"syscall"
+
+	"log"
+
+	"github.com/caarlos0/env"
+	// register the sqlite3 driver
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/mitchellh/mapstructure"
+)
+
+// SQLiteConfig has the config options for the SQLite service
+type SQLiteConfig struct {
+	Name               string
+	File               string `env:"SQLITE_FILE"`
+	Compress           bool   `env:"SQLITE_COMPRESS" envDefault:"true"`
+	Compression        string `env:"SQLITE_COMPRESSION" envDefault:"gzip"`
+	CompressionLevel   int    `env:"SQLITE_COMPRESSION_LEVEL"`
+	CompressionThreads int    `env:"SQLITE_COMPRESSION_THREADS"`
+	IntegrityCheck     bool   `env:"SQLITE_INTEGRITY_CHECK" envDefault:"true"`
+	SaveDir            string `env:"SAVEDIR" envDefault:"/tmp/"`
+}
+
+func NewSQLiteConfig(opts map[string]interface{}) *SQLiteConfig {
+	cfg := &SQLiteConfig{}
+	err := env.Parse(cfg)
+	mapstructure.Decode(opts, cfg)
+
+	if err != nil {
+		fmt.Printf("%+v\n", err)
+	}
+	return cfg
+}
+
+func integrityCheck(filepath string) error {
+	db, err := sql.Open("sqlite3", "file:"+filepath+"?mode=ro")
+	if err != nil {
+		return fmt.Errorf("cannot open %s: %v", filepath, err)
+	}
+
+	defer db.Close()
+
+	var result string
+	if err = db.QueryRow("PRAGMA integrity_check").Scan(&result); err != nil {
+		return fmt.Errorf("cannot run integrity check: %v", err)
+	}
+
+	if result != "ok" {
+		return fmt.Errorf("integrity check failed: %s", result)
+	}
+
+	return nil
+}
+
+// Backup creates a consistent snapshot of the database while it is in use
+func (s *SQLiteConfig) Backup() (string, error) {
+	var name string
+
+	if s.Name != "" {
+		name = s.Name + "-backup"
+	} else {
+		name = path.Base(s.File) + "-backup"
+	}
+
+	var codec *Codec
+	var err error
+
+	filepath := generateFilename(s.SaveDir, name, ".sqlite")
+	snapshot := filepath
+
+	if s.Compress {
+		if codec, err = GetCodec(s.Compression); err != nil {
+			return "", err
+		}
+
+		snapshot = path.Join(s.SaveDir, "."+path.Base(filepath))
+		filepath += codec.Extension
+	}
+
+	db, err := sql.Open("sqlite3", "file:"+s.File+"?mode=ro&_busy_timeout=10000")
+	if err != nil {
+		return "", fmt.Errorf("cannot open database %s: %v", s.File, err)
+	}
+
+	defer db.Close()
+
+	// VACUUM INTO writes a transactionally consistent copy of the database
+	if _, err = db.Exec("VACUUM INTO ?", snapshot); err != nil {
+		os.Remove(snapshot)
+		return "", fmt.Errorf("cannot create snapshot of %s: %v", s.File, err)
+	}
+
+	if s.IntegrityCheck {
+		if err = integrityCheck(snapshot); err != nil {
+			os.Remove(snapshot)
+			return "", err
+		}
+	}
+
+	if !s.Compress {
+		return filepath, nil
+	}
+
+	defer os.Remove(snapshot)
+
+	if err = compressFile(snapshot, filepath, codec, s.CompressionLevel, s.CompressionThreads); err != nil {
+		os.Remove(filepath)
+		return "", fmt.Errorf("cannot compress snapshot: %v", err)
+	}
+
+	return filepath, nil
+}
+
+// Restore replaces the database file with a snapshot, the application must
+// not have the database open
+func (s *SQLiteConfig) Restore(filepath string) error {
+	tmp := path.Join(path.Dir(s.File), "."+path.Base(s.File)+".restore")
+
+	defer os.Remove(tmp)
+
+	// the restored database keeps the mode and owner of the one it replaces
+	info, err := os.Stat(s.File)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("cannot stat %s: %v", s.File, err)
+	}
+
+	mode := os.FileMode(0600)
+	if info != nil {
+		mode = info.Mode().Perm()
+	}
+
+	if err := decompressFile(filepath, tmp, mode); err != nil {
+		return fmt.Errorf("cannot write %s: %v", tmp, err)
+	}
+
+	// the umask may have masked the mode when the file was created
+	if err := os.Chmod(tmp, mode); err != nil {
+		return fmt.Errorf("cannot set the mode of %s: %v", tmp, err)
+	}
+
+	if info != nil {
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok && os.Geteuid() == 0 {
+			if err := os.Chown(tmp, int(stat.Uid), int(stat.Gid)); err != nil {
+				return fmt.Errorf("cannot set the owner of %s: %v", tmp, err)
+			}
+		}
+	}
+
+	if s.IntegrityCheck {
+		if err := integrityCheck(tmp); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Rename(tmp, s.File); err != nil {
+		return fmt.Errorf("cannot replace %s: %v", s.File, err)
+	}
+
+	// journal files of the previous database would corrupt the restored one
+	for _, ext := range []string{"-wal", "-shm", "-journal"} {
+		if err := os.Remove(s.File + ext); err != nil && !os.IsNotExist(err) {
+			log.Printf("Cannot remove %s: %v\n", s.File+ext, err)
+		}
+	}
+
+	return nil
+}
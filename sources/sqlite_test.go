@@ -0,0 +1,88 @@
+package sources
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSQLiteBackupRestore(t *testing.T) {
+	r := require.New(t)
+	tmp, err := ioutil.TempDir("", "sqlite")
+	r.NoError(err, "failed to create temp directory")
+
+	defer os.RemoveAll(tmp)
+
+	dbFile := path.Join(tmp, "products.db")
+	db, err := sql.Open("sqlite3", dbFile+"?_journal_mode=WAL")
+	r.NoError(err, "failed to open database")
+
+	defer db.Close()
+
+	_, err = db.Exec("CREATE TABLE products (name TEXT); INSERT INTO products VALUES ('apple')")
+	r.NoError(err, "failed to create table")
+	r.NoError(os.Chmod(dbFile, 0640))
+
+	s := SQLiteConfig{
+		File:           dbFile,
+		Compress:       true,
+		IntegrityCheck: true,
+		SaveDir:        tmp,
+	}
+
+	// the database stays open while the snapshot is taken
+	snapshot, err := s.Backup()
+	r.NoError(err, "failed to backup database")
+
+	_, err = db.Exec("INSERT INTO products VALUES ('banana')")
+	r.NoError(err, "failed to insert row")
+	r.NoError(db.Close())
+
+	err = s.Restore(snapshot)
+	r.NoError(err, "failed to restore database")
+
+	info, err := os.Stat(dbFile)
+	r.NoError(err)
+	r.Equal(os.FileMode(0640), info.Mode().Perm(), "database mode not kept")
+
+	db, err = sql.Open("sqlite3", dbFile)
+	r.NoError(err, "failed to open restored database")
+
+	var count int
+	err = db.QueryRow("SELECT COUNT(*) FROM products").Scan(&count)
+	r.NoError(err, "failed to query restored database")
+	r.Equal(1, count, "restored database contents mismatch")
+}
+
+func TestSQLiteRestoreMissingFile(t *testing.T) {
+	r := require.New(t)
+	tmp, err := ioutil.TempDir("", "sqlite")
+	r.NoError(err, "failed to create temp directory")
+
+	defer os.RemoveAll(tmp)
+
+	dbFile := path.Join(tmp, "products.db")
+	db, err := sql.Open("sqlite3", dbFile)
+	r.NoError(err, "failed to open database")
+
+	_, err = db.Exec("CREATE TABLE products (name TEXT)")
+	r.NoError(err, "failed to create table")
+	r.NoError(db.Close())
+
+	s := SQLiteConfig{File: dbFile, SaveDir: tmp}
+
+	snapshot, err := s.Backup()
+	r.NoError(err, "failed to backup database")
+	r.NoError(os.Remove(dbFile))
+
+	// a database restored from scratch is only readable by its owner
+	r.NoError(s.Restore(snapshot), "failed to restore database")
+
+	info, err := os.Stat(dbFile)
+	r.NoError(err)
+	r.Equal(os.FileMode(0600), info.Mode().Perm())
+}
@@ -1,21 +1,54 @@
 package sources
 
 import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
 	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"log"
 
 	"github.com/caarlos0/env"
-	"github.com/mholt/archiver"
 	"github.com/mitchellh/mapstructure"
+	"github.com/sbusso/autobackup/stores"
 )
 
-// TarballConfig has the config options for the TarballConfig service
+// TarballConfig has the config options for the TarballConfig service. Paths
+// lists the directories or files to backup, Path and File are used when it is
+// empty. Each path is saved in the tarball under its base name. When running
+// as root, restored files get their archived owners or Credential if set.
+// In incremental and differential modes the previous backups needed by a
+// restore are looked up next to the tarball, then on ChainStore.
 type TarballConfig struct {
-	Name     string
-	File     string `env:"TAR_FILE"`
-	Path     string `env:"TAR_PATH" envDefault:"./"`
-	Compress bool   `env:"TAR_COMPRESS" envDefault:"true"`
-	SaveDir  string `env:"SAVEDIR" envDefault:"/tmp/"`
+	Name               string
+	File               string        `env:"TAR_FILE"`
+	Path               string        `env:"TAR_PATH" envDefault:"./"`
+	Paths              []string      `env:"TAR_PATHS" envSeparator:","`
+	Include            []string      `env:"TAR_INCLUDE" envSeparator:","`
+	Exclude            []string      `env:"TAR_EXCLUDE" envSeparator:","`
+	MaxFileSize        int64         `env:"TAR_MAX_FILE_SIZE"`
+	Compress           bool          `env:"TAR_COMPRESS" envDefault:"true"`
+	Compression        string        `env:"TAR_COMPRESSION" envDefault:"gzip"`
+	CompressionLevel   int           `env:"TAR_COMPRESSION_LEVEL"`
+	CompressionThreads int           `env:"TAR_COMPRESSION_THREADS"`
+	RollbackRetention  time.Duration `env:"TAR_ROLLBACK_RETENTION" envDefault:"24h"`
+	Mode               string        `env:"TAR_MODE" envDefault:"full"`
+	FullEvery          int           `env:"TAR_FULL_EVERY" envDefault:"6"`
+	StateFile          string        `env:"TAR_STATE_FILE"`
+	SaveDir            string        `env:"SAVEDIR" envDefault:"/tmp/"`
+	Credential         *syscall.Credential
+	ChainStore         stores.Store
 }
 
 func NewTarballConfig(opts map[string]interface{}) *TarballConfig {
@@ -29,62 +62,837 @@ func NewTarballConfig(opts map[string]interface{}) *TarballConfig {
 	return cfg
 }
 
-func (f *TarballConfig) target() string {
-	var target = f.Path
+// targets returns the paths to backup, indexed by their name in the tarball
+func (f *TarballConfig) targets() (map[string]string, error) {
+	paths := f.Paths
+	if len(paths) == 0 {
+		paths = []string{filepath.Join(f.Path, f.File)}
+	}
+
+	targets := map[string]string{}
+
+	for _, p := range paths {
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid path %s: %v", p, err)
+		}
+
+		name := filepath.Base(abs)
+		if other, ok := targets[name]; ok {
+			return nil, fmt.Errorf("%s and %s have the same name", other, abs)
+		}
 
-	if f.File != "" {
-		target = target + f.File
+		targets[name] = abs
 	}
 
-	return target
+	return targets, nil
 }
 
-// Backup creates a tarball of the specified directory
+// Backup creates a tarball of the specified paths
 func (f *TarballConfig) Backup() (string, error) {
-	var name string
-	var target = f.target()
+	targets, err := f.targets()
+	if err != nil {
+		return "", err
+	}
+
+	name := f.backupName(targets)
+
+	ext := ".tar"
+	if f.Compress {
+		codec, err := GetCodec(f.Compression)
+		if err != nil {
+			return "", err
+		}
 
+		ext += codec.Extension
+	}
+
+	state, err := readTarballState(f.statePath(name))
+	if err != nil {
+		return "", fmt.Errorf("cannot read tarball state: %v", err)
+	}
+
+	// the previous backup was not stored, the next one is based on the last
+	// stored backup
+	pending := f.statePath(name) + pendingSuffix
+	if _, err = os.Stat(pending); err == nil {
+		log.Printf("Discarding the state of a backup that was not stored\n")
+		os.Remove(pending)
+	}
+
+	inc, err := f.newIncrement(state)
+	if err != nil {
+		return "", err
+	}
+
+	filepath := generateFilename(f.SaveDir, name, ext)
+
+	if err = f.writeTarball(filepath, targets, inc); err != nil {
+		os.Remove(filepath)
+		return "", fmt.Errorf("cannot create tarball on %s, %v", filepath, err)
+	}
+
+	if inc != nil {
+		log.Printf("Created %s backup %s\n", inc.manifest.Level, filepath)
+
+		if err = writeTarballState(pending, inc.update(state, path.Base(filepath))); err != nil {
+			os.Remove(filepath)
+			return "", fmt.Errorf("cannot write tarball state: %v", err)
+		}
+	}
+
+	return filepath, nil
+}
+
+// backupName returns the name of the backups of the targets
+func (f *TarballConfig) backupName(targets map[string]string) string {
 	if f.Name != "" {
-		name = f.Name + "-backup"
-	} else {
-		name = path.Base(target) + "-backup"
+		return f.Name + "-backup"
+	}
+
+	if len(targets) == 1 {
+		for base := range targets {
+			return base + "-backup"
+		}
+	}
+
+	return "tarball-backup"
+}
+
+// Commit records the state of an incremental or differential backup once it
+// was stored, so the next backups are based on it
+func (f *TarballConfig) Commit(filepath string) error {
+	if f.Mode != TarballIncremental && f.Mode != TarballDifferential {
+		return nil
 	}
 
-	filepath := generateFilename(f.SaveDir, name) + ".tar"
+	targets, err := f.targets()
+	if err != nil {
+		return err
+	}
+
+	statePath := f.statePath(f.backupName(targets))
+
+	state, err := readTarballState(statePath + pendingSuffix)
+	if err != nil {
+		return fmt.Errorf("cannot read tarball state: %v", err)
+	}
 
-	var err error
+	if state == nil || len(state.Chain) == 0 || state.Chain[len(state.Chain)-1] != path.Base(filepath) {
+		return fmt.Errorf("no pending state for %s", path.Base(filepath))
+	}
+
+	return os.Rename(statePath+pendingSuffix, statePath)
+}
+
+// writeTarball archives the targets, only the files changed since the base
+// backup of inc when set
+func (f *TarballConfig) writeTarball(filepath string, targets map[string]string, inc *increment) error {
+	out, err := os.Create(filepath)
+	if err != nil {
+		return err
+	}
+
+	defer out.Close()
+
+	var writer io.Writer = out
+	var compressor io.WriteCloser
 
 	if f.Compress {
-		filepath += ".gz"
-		err = archiver.TarGz.Make(filepath, []string{target})
+		codec, err := GetCodec(f.Compression)
+		if err != nil {
+			return err
+		}
+
+		if compressor, err = codec.NewWriter(out, f.CompressionLevel, f.CompressionThreads); err != nil {
+			return fmt.Errorf("cannot create %s writer: %v", codec.Name, err)
+		}
+
+		writer = compressor
+	}
+
+	archive := tar.NewWriter(writer)
+
+	if inc != nil {
+		data, err := json.Marshal(inc.manifest)
+		if err != nil {
+			return err
+		}
+
+		if err = writeTarEntry(archive, tarballManifest, data); err != nil {
+			return err
+		}
+	}
+
+	names := make([]string, 0, len(targets))
+	for name := range targets {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	links := map[fileID]string{}
+
+	for _, name := range names {
+		target := targets[name]
+		w := tarWalker{
+			config:  f,
+			archive: archive,
+			out:     writer,
+			include: parseIgnoreRules("", f.Include),
+			rules:   parseIgnoreRules("", f.Exclude),
+			links:   links,
+			inc:     inc,
+		}
+
+		if err = w.add(target, name, ""); err != nil {
+			return err
+		}
+	}
+
+	if inc != nil && inc.manifest.Level != TarballFull {
+		data, err := json.Marshal(inc.deleted())
+		if err != nil {
+			return err
+		}
+
+		if err = writeTarEntry(archive, tarballDeleted, data); err != nil {
+			return err
+		}
+	}
+
+	if err = archive.Close(); err != nil {
+		return err
+	}
+
+	if compressor != nil {
+		if err = compressor.Close(); err != nil {
+			return err
+		}
+	}
+
+	return out.Sync()
+}
+
+// fileID identifies a file to detect hard links
+type fileID struct {
+	dev, ino uint64
+}
+
+// tarWalker adds the files of a path to a tarball, applying the filters
+type tarWalker struct {
+	config  *TarballConfig
+	archive *tar.Writer
+	out     io.Writer
+	include ignoreRules
+	rules   ignoreRules
+	links   map[fileID]string
+	inc     *increment
+}
+
+// add writes file to the tarball as name, rel is its path relative to the
+// root directory used to match the patterns
+func (w *tarWalker) add(file, name, rel string) error {
+	info, err := os.Lstat(file)
+	if err != nil {
+		return err
+	}
+
+	if rel != "" {
+		if w.rules.excluded(rel, info.IsDir()) {
+			return nil
+		}
+
+		if !info.IsDir() && len(w.include) > 0 && !w.include.matchAny(rel, false) {
+			return nil
+		}
+	}
+
+	mode := info.Mode()
+
+	switch {
+	case mode.IsRegular():
+		if w.config.MaxFileSize > 0 && info.Size() > w.config.MaxFileSize {
+			log.Printf("Skipping %s, bigger than %d bytes\n", file, w.config.MaxFileSize)
+			return nil
+		}
+	case mode.IsDir(), mode&os.ModeSymlink != 0:
+	default:
+		log.Printf("Skipping %s, unsupported file type\n", file)
+		return nil
+	}
+
+	var link string
+	if mode&os.ModeSymlink != 0 {
+		if link, err = os.Readlink(file); err != nil {
+			return err
+		}
+	}
+
+	first, linked := w.hardLink(info, name)
+
+	var state fileState
+
+	if w.inc != nil {
+		state = fileState{ModTime: info.ModTime(), Size: info.Size(), Mode: mode, Link: link}
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			state.Inode = uint64(stat.Ino)
+		}
+
+		prev, ok := w.inc.base[name]
+
+		// directories are always written to keep their metadata
+		if ok && !info.IsDir() && state.unchanged(prev) {
+			state.Hash = prev.Hash
+			w.inc.files[name] = state
+			return nil
+		}
+	}
+
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+
+	header.Name = name
+	if info.IsDir() {
+		header.Name += "/"
+	}
+
+	// PAX keeps long names, big ids, sub-second times and extended attributes
+	header.Format = tar.FormatPAX
+
+	xattrs, err := readXattrs(file)
+	if err != nil {
+		return err
+	}
+
+	for key, value := range xattrs {
+		if header.PAXRecords == nil {
+			header.PAXRecords = map[string]string{}
+		}
+
+		header.PAXRecords[xattrPrefix+key] = value
+	}
+
+	if linked {
+		header.Typeflag = tar.TypeLink
+		header.Linkname = first
+		header.Size = 0
+	}
+
+	if header.Typeflag != tar.TypeReg {
+		if err = w.archive.WriteHeader(header); err != nil {
+			return err
+		}
 	} else {
-		err = archiver.Tar.Make(filepath, []string{target})
+		in, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+
+		var sum hash.Hash
+		if w.inc != nil {
+			sum = sha256.New()
+		}
+
+		err = w.addFile(header, in, sum)
+		in.Close()
+
+		if err != nil {
+			return err
+		}
+
+		if sum != nil {
+			state.Hash = hex.EncodeToString(sum.Sum(nil))
+		}
+	}
+
+	if w.inc != nil {
+		w.inc.files[name] = state
 	}
 
+	if !info.IsDir() {
+		return nil
+	}
+
+	ignored, err := readIgnoreFile(file, rel)
 	if err != nil {
-		return "", fmt.Errorf("cannot create tarball on %s, %v", filepath, err)
+		return fmt.Errorf("cannot read %s of %s: %v", IgnoreFile, file, err)
 	}
 
-	return filepath, nil
+	// the rules of an ignore file apply to its directory only
+	rules := w.rules
+	w.rules = append(append(ignoreRules{}, rules...), ignored...)
+	defer func() { w.rules = rules }()
+
+	names, err := readDirNames(file)
+	if err != nil {
+		return err
+	}
+
+	for _, child := range names {
+		if rel == "" && restoreArtifact(name, child) {
+			continue
+		}
+
+		childRel := child
+		if rel != "" {
+			childRel = rel + "/" + child
+		}
+
+		if err = w.add(filepath.Join(file, child), name+"/"+child, childRel); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
-// Restore extracts a tarball to the specified directory
-func (f *TarballConfig) Restore(filepath string) error {
-	err := removeDirectoryContents(f.target())
+// addFile writes a regular file, the files with holes are written as sparse
+// entries without their holes
+func (w *tarWalker) addFile(header *tar.Header, in *os.File, sum hash.Hash) error {
+	segments, err := dataSegments(in, header.Size)
+	if err != nil {
+		return err
+	}
+
+	if segments != nil {
+		return writeSparseEntry(w.archive, w.out, header, in, segments, sum)
+	}
+
+	if err = w.archive.WriteHeader(header); err != nil {
+		return err
+	}
+
+	var writer io.Writer = w.archive
+	if sum != nil {
+		writer = io.MultiWriter(w.archive, sum)
+	}
+
+	_, err = io.CopyN(writer, in, header.Size)
+
+	return err
+}
+
+// hardLink returns the name a hard linked file was first added as, and if
+// it was already added
+func (w *tarWalker) hardLink(info os.FileInfo, name string) (string, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || !info.Mode().IsRegular() || stat.Nlink < 2 {
+		return "", false
+	}
+
+	id := fileID{uint64(stat.Dev), uint64(stat.Ino)}
+
+	if first, ok := w.links[id]; ok {
+		return first, true
+	}
+
+	w.links[id] = name
+
+	return "", false
+}
+
+func readDirNames(dir string) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
 	if err != nil {
-		return fmt.Errorf("failed to empty directory contents before restoring: %v", err)
+		return nil, err
+	}
+
+	names := make([]string, len(files))
+	for i, f := range files {
+		names[i] = f.Name()
 	}
 
-	archive := archiver.MatchingFormat(filepath)
-	if archive == nil {
-		return fmt.Errorf("unsupported file extension: %s", path.Base(filepath))
+	return names, nil
+}
+
+// Restore extracts a tarball next to the specified paths and swaps them into
+// place once fully extracted, the previous contents are kept in hidden
+// rollback directories for RollbackRetention. The backups an incremental or
+// differential tarball is based on are extracted first.
+func (f *TarballConfig) Restore(filepath string) error {
+	targets, err := f.targets()
+	if err != nil {
+		return err
 	}
 
-	// use the parent directory to unpack as the current directory is already in the tarball
-	err = archive.Open(filepath, path.Dir(f.Path))
+	manifest, err := readTarballManifest(filepath)
 	if err != nil {
+		return fmt.Errorf("cannot read backup: %v", err)
+	}
+
+	// staging directories are siblings of the paths so they can be renamed,
+	// or inside the paths restored in place
+	stages := map[string]string{}
+
+	defer func() {
+		for _, stage := range stages {
+			os.RemoveAll(stage)
+		}
+	}()
+
+	for name, target := range targets {
+		if err = os.MkdirAll(path.Dir(target), 0755); err != nil {
+			return fmt.Errorf("cannot create parent directory of %s: %v", target, err)
+		}
+
+		stage, err := ioutil.TempDir(rollbackDir(target), "."+name+".restore-")
+		if err != nil {
+			return fmt.Errorf("cannot create staging directory: %v", err)
+		}
+
+		stages[name] = stage
+	}
+
+	if manifest != nil {
+		for _, name := range manifest.Chain {
+			previous, err := f.retrieveChain(path.Dir(filepath), name)
+			if err != nil {
+				return err
+			}
+
+			log.Printf("Extracting previous backup %s\n", name)
+
+			err = f.extract(previous, stages)
+
+			if f.ChainStore != nil {
+				f.ChainStore.Close()
+			}
+
+			if err != nil {
+				return fmt.Errorf("cannot unpack previous backup %s: %v", name, err)
+			}
+		}
+	}
+
+	if err = f.extract(filepath, stages); err != nil {
 		return fmt.Errorf("cannot unpack backup: %v", err)
 	}
 
+	for name := range targets {
+		if _, err = os.Lstat(path.Join(stages[name], name)); err != nil {
+			return fmt.Errorf("backup has no %s", name)
+		}
+	}
+
+	if err = f.swap(targets, stages); err != nil {
+		return err
+	}
+
+	f.pruneRollbacks(targets)
+
 	return nil
 }
+
+// extract unpacks a tarball to the staging directories and removes the paths
+// deleted since its base backup
+func (f *TarballConfig) extract(filepath string, stages map[string]string) error {
+	reader, closer, err := openBackup(filepath)
+	if err != nil {
+		return err
+	}
+
+	defer closer()
+
+	tmp, err := ioutil.TempDir(f.SaveDir, ".tarball-restore-")
+	if err != nil {
+		return fmt.Errorf("cannot create temporary directory: %v", err)
+	}
+
+	defer os.RemoveAll(tmp)
+
+	deleted := path.Join(tmp, tarballDeleted)
+
+	err = extractTarEntries(reader, func(name string) (string, error) {
+		switch name {
+		case tarballManifest:
+			return "", nil
+		case tarballDeleted:
+			return deleted, nil
+		}
+
+		base := strings.SplitN(name, "/", 2)[0]
+
+		stage, ok := stages[base]
+		if !ok {
+			return "", fmt.Errorf("unexpected path %s", name)
+		}
+
+		return safeJoin(stage, name)
+	}, f.Credential)
+
+	if err != nil {
+		return err
+	}
+
+	return applyDeleted(deleted, stages)
+}
+
+// rollbackSuffix is followed by the time of the restore in rollback names
+const rollbackSuffix = ".rollback-"
+
+const rollbackTimeFormat = "20060102150405.000000000"
+
+// restoreArtifact reports if child of the path name is a staging or rollback
+// directory of a restore in place, they are not backed up nor swapped
+func restoreArtifact(name, child string) bool {
+	return strings.HasPrefix(child, "."+name+".restore-") || strings.HasPrefix(child, "."+name+rollbackSuffix)
+}
+
+// restoresInPlace reports if the contents of a directory are swapped instead
+// of the directory itself: a mount point can't be renamed, and renaming the
+// working directory would move it from under the process
+func restoresInPlace(target string) bool {
+	info, err := os.Lstat(target)
+	if err != nil || !info.IsDir() {
+		return false
+	}
+
+	if wd, err := os.Getwd(); err == nil && wd == target {
+		return true
+	}
+
+	if path.Dir(target) == target {
+		return true
+	}
+
+	parent, err := os.Lstat(path.Dir(target))
+	if err != nil {
+		return false
+	}
+
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	parentStat, parentOk := parent.Sys().(*syscall.Stat_t)
+
+	return ok && parentOk && stat.Dev != parentStat.Dev
+}
+
+// rollbackDir returns the directory of the staging and rollback directories
+// of a path
+func rollbackDir(target string) string {
+	if restoresInPlace(target) {
+		return target
+	}
+
+	return path.Dir(target)
+}
+
+// swap renames the restored paths into place, if one fails the paths
+// already swapped are rolled back
+func (f *TarballConfig) swap(targets, stages map[string]string) error {
+	suffix := rollbackSuffix + time.Now().UTC().Format(rollbackTimeFormat)
+
+	type swapped struct {
+		target, rollback string
+		inPlace          bool
+	}
+
+	var done []swapped
+
+	undo := func() {
+		for i := len(done) - 1; i >= 0; i-- {
+			if done[i].inPlace {
+				if err := unswapContents(done[i].target, done[i].rollback); err != nil {
+					log.Printf("Cannot roll back %s, previous contents are in %s: %v\n", done[i].target, done[i].rollback, err)
+				}
+
+				continue
+			}
+
+			os.RemoveAll(done[i].target)
+
+			if done[i].rollback != "" {
+				if err := os.Rename(done[i].rollback, done[i].target); err != nil {
+					log.Printf("Cannot roll back %s, previous contents are in %s: %v\n", done[i].target, done[i].rollback, err)
+				}
+			}
+		}
+	}
+
+	for name, target := range targets {
+		if restoresInPlace(target) {
+			rollback := path.Join(target, "."+name+suffix)
+
+			if err := swapContents(name, target, path.Join(stages[name], name), rollback); err != nil {
+				undo()
+				return fmt.Errorf("cannot move restored %s into place: %v", target, err)
+			}
+
+			done = append(done, swapped{target, rollback, true})
+			continue
+		}
+
+		rollback := path.Join(path.Dir(target), "."+name+suffix)
+
+		if _, err := os.Lstat(target); os.IsNotExist(err) {
+			rollback = ""
+		} else if err != nil {
+			undo()
+			return err
+		} else if err = os.Rename(target, rollback); err != nil {
+			undo()
+			return fmt.Errorf("cannot move %s aside: %v", target, err)
+		}
+
+		done = append(done, swapped{target, rollback, false})
+
+		if err := os.Rename(path.Join(stages[name], name), target); err != nil {
+			undo()
+			return fmt.Errorf("cannot move restored %s into place: %v", target, err)
+		}
+	}
+
+	return nil
+}
+
+// swapContents moves the entries of target to rollback and the ones of the
+// restored directory to target, whose mode and times are then restored. The
+// previous entries are moved back if it fails.
+func swapContents(name, target, restored, rollback string) error {
+	previous, err := os.Stat(target)
+	if err != nil {
+		return err
+	}
+
+	// moving the entries changes the times of the restored directory
+	info, err := os.Stat(restored)
+	if err != nil {
+		return err
+	}
+
+	if err = os.Mkdir(rollback, 0700); err != nil {
+		return err
+	}
+
+	if err = moveEntries(name, target, rollback); err != nil {
+		if rerr := moveEntries(name, rollback, target); rerr == nil {
+			os.Remove(rollback)
+		}
+
+		return err
+	}
+
+	// the rollback keeps the previous metadata of the directory
+	if err = copyDirMetadata(previous, rollback); err == nil {
+		err = moveEntries(name, restored, target)
+	}
+
+	if err == nil {
+		err = copyDirMetadata(info, target)
+	}
+
+	if err != nil {
+		if rerr := unswapContents(target, rollback); rerr != nil {
+			log.Printf("Cannot roll back %s, previous contents are in %s: %v\n", target, rollback, rerr)
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// unswapContents removes the restored entries of target and moves back the
+// ones of rollback
+func unswapContents(target, rollback string) error {
+	name := path.Base(target)
+
+	info, err := os.Stat(rollback)
+	if err != nil {
+		return err
+	}
+
+	entries, err := readDirNames(target)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if !restoreArtifact(name, entry) {
+			if err = os.RemoveAll(path.Join(target, entry)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err = moveEntries(name, rollback, target); err != nil {
+		return err
+	}
+
+	if err = copyDirMetadata(info, target); err != nil {
+		return err
+	}
+
+	return os.Remove(rollback)
+}
+
+// moveEntries renames the entries of src to dst, except the restore artifacts
+func moveEntries(name, src, dst string) error {
+	entries, err := readDirNames(src)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if restoreArtifact(name, entry) {
+			continue
+		}
+
+		if err = os.Rename(path.Join(src, entry), path.Join(dst, entry)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// copyDirMetadata gives a directory the mode, times and owner of info
+func copyDirMetadata(info os.FileInfo, dir string) error {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && os.Geteuid() == 0 {
+		if err := os.Lchown(dir, int(stat.Uid), int(stat.Gid)); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Chmod(dir, info.Mode()); err != nil {
+		return err
+	}
+
+	return os.Chtimes(dir, info.ModTime(), info.ModTime())
+}
+
+// pruneRollbacks removes the rollback directories older than the retention
+func (f *TarballConfig) pruneRollbacks(targets map[string]string) {
+	for name, target := range targets {
+		prefix := "." + name + rollbackSuffix
+
+		dir := rollbackDir(target)
+
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			log.Printf("Cannot list rollback directories of %s: %v\n", target, err)
+			continue
+		}
+
+		for _, file := range files {
+			if !strings.HasPrefix(file.Name(), prefix) {
+				continue
+			}
+
+			// the time is in UTC, as time.Parse assumes
+			created, err := time.Parse(rollbackTimeFormat, strings.TrimPrefix(file.Name(), prefix))
+			if err != nil || time.Since(created) < f.RollbackRetention {
+				continue
+			}
+
+			rollback := path.Join(dir, file.Name())
+			log.Printf("Removing rollback %s\n", rollback)
+
+			if err = os.RemoveAll(rollback); err != nil {
+				log.Printf("Cannot remove rollback %s: %v\n", rollback, err)
+			}
+		}
+	}
+}
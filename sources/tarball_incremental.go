@@ -0,0 +1,330 @@
+package sources
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sbusso/autobackup/stores"
+)
+
+const (
+	// TarballFull archives every file
+	TarballFull = "full"
+
+	// TarballIncremental archives the changes since the previous backup
+	TarballIncremental = "incremental"
+
+	// TarballDifferential archives the changes since the last full backup
+	TarballDifferential = "differential"
+)
+
+const (
+	// tarballManifest is the first entry of the tarballs taken in incremental
+	// or differential mode, it lists the backups to restore before them
+	tarballManifest = ".autobackup-manifest"
+
+	// tarballDeleted is the last entry of incremental and differential
+	// tarballs, it lists the paths removed since their base backup
+	tarballDeleted = ".autobackup-deleted"
+)
+
+// fileState is used to detect the files changed since a backup
+type fileState struct {
+	ModTime time.Time   `json:"mtime"`
+	Size    int64       `json:"size"`
+	Inode   uint64      `json:"inode"`
+	Mode    os.FileMode `json:"mode"`
+	Link    string      `json:"link,omitempty"`
+	Hash    string      `json:"hash,omitempty"`
+}
+
+func (s fileState) unchanged(prev fileState) bool {
+	return s.ModTime.Equal(prev.ModTime) && s.Size == prev.Size && s.Inode == prev.Inode &&
+		s.Mode == prev.Mode && s.Link == prev.Link
+}
+
+// tarballState records the files of the last backups of a job
+type tarballState struct {
+	// Chain lists the backups to restore in order, starting with the last full
+	Chain     []string             `json:"chain"`
+	FullFiles map[string]fileState `json:"full_files"`
+	Files     map[string]fileState `json:"files"`
+
+	// Backups counts the backups since the last full one included, the chain
+	// of a differential backup only has the full backup and the latest one
+	Backups int `json:"backups,omitempty"`
+}
+
+// backups returns the number of backups since the last full one included,
+// the states written before Backups was recorded only have the chain
+func (s *tarballState) backups() int {
+	if s.Backups == 0 {
+		return len(s.Chain)
+	}
+
+	return s.Backups
+}
+
+// tarballManifestData is stored in the tarballManifest entry
+type tarballManifestData struct {
+	Level string   `json:"level"`
+	Chain []string `json:"chain"`
+}
+
+// increment tracks the files of an incremental or differential backup
+type increment struct {
+	manifest tarballManifestData
+	base     map[string]fileState
+	files    map[string]fileState
+}
+
+// deleted returns the paths of the base backup that are gone
+func (inc *increment) deleted() []string {
+	var deleted []string
+
+	for name := range inc.base {
+		if _, ok := inc.files[name]; !ok {
+			deleted = append(deleted, name)
+		}
+	}
+
+	sort.Strings(deleted)
+
+	return deleted
+}
+
+// pendingSuffix is appended to the state path until the backup is stored
+const pendingSuffix = ".pending"
+
+func (f *TarballConfig) statePath(name string) string {
+	if f.StateFile != "" {
+		return f.StateFile
+	}
+
+	return path.Join(f.SaveDir, ".tarball-state-"+name)
+}
+
+func readTarballState(filename string) (*tarballState, error) {
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	state := &tarballState{}
+	if err = json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("invalid state %s: %v", filename, err)
+	}
+
+	return state, nil
+}
+
+func writeTarballState(filename string, state *tarballState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	tmp := filename + ".tmp"
+
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filename)
+}
+
+// newIncrement returns the increment to backup according to the mode and the
+// state of the job, nil for a full backup without tracking
+func (f *TarballConfig) newIncrement(state *tarballState) (*increment, error) {
+	switch f.Mode {
+	case "", TarballFull:
+		return nil, nil
+	case TarballIncremental, TarballDifferential:
+	default:
+		return nil, fmt.Errorf("unknown tarball mode %s", f.Mode)
+	}
+
+	inc := &increment{
+		manifest: tarballManifestData{Level: TarballFull},
+		files:    map[string]fileState{},
+	}
+
+	// start a new chain periodically so restores don't need too many backups
+	if state == nil || len(state.Chain) == 0 || (f.FullEvery > 0 && state.backups() >= f.FullEvery) {
+		return inc, nil
+	}
+
+	inc.manifest.Level = f.Mode
+
+	if f.Mode == TarballIncremental {
+		inc.manifest.Chain = state.Chain
+		inc.base = state.Files
+	} else {
+		inc.manifest.Chain = state.Chain[:1]
+		inc.base = state.FullFiles
+	}
+
+	return inc, nil
+}
+
+// update records a backup of the job on its state
+func (inc *increment) update(state *tarballState, name string) *tarballState {
+	if state == nil || inc.manifest.Level == TarballFull {
+		return &tarballState{Chain: []string{name}, FullFiles: inc.files, Files: inc.files, Backups: 1}
+	}
+
+	return &tarballState{
+		Chain:     append(append([]string{}, inc.manifest.Chain...), name),
+		FullFiles: state.FullFiles,
+		Files:     inc.files,
+		Backups:   state.backups() + 1,
+	}
+}
+
+func writeTarEntry(archive *tar.Writer, name string, data []byte) error {
+	header := &tar.Header{
+		Name:     name,
+		Typeflag: tar.TypeReg,
+		Mode:     0600,
+		Size:     int64(len(data)),
+		ModTime:  time.Now(),
+	}
+
+	if err := archive.WriteHeader(header); err != nil {
+		return err
+	}
+
+	_, err := archive.Write(data)
+
+	return err
+}
+
+// readTarballManifest returns the manifest of a tarball, nil if it was not
+// taken in incremental or differential mode
+func readTarballManifest(filepath string) (*tarballManifestData, error) {
+	reader, closer, err := openBackup(filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	defer closer()
+
+	archive := tar.NewReader(reader)
+
+	header, err := archive.Next()
+	if err == io.EOF {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if header.Name != tarballManifest {
+		return nil, nil
+	}
+
+	manifest := &tarballManifestData{}
+	if err = json.NewDecoder(archive).Decode(manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %v", err)
+	}
+
+	return manifest, nil
+}
+
+// retrieveChain returns the path of a previous backup of the chain, looked up
+// next to the restored tarball first and then on ChainStore
+func (f *TarballConfig) retrieveChain(dir, name string) (string, error) {
+	local := path.Join(dir, name)
+	if _, err := os.Stat(local); err == nil {
+		return local, nil
+	}
+
+	if f.ChainStore == nil {
+		return "", fmt.Errorf("previous backup %s not found", name)
+	}
+
+	key := name
+	if idx, ok := f.ChainStore.(stores.Indexer); ok {
+		key = idx.Key(name)
+	}
+
+	retrieved, err := f.ChainStore.Retrieve(key)
+	if err != nil {
+		return "", fmt.Errorf("cannot retrieve previous backup %s: %v", name, err)
+	}
+
+	return retrieved, nil
+}
+
+// applyDeleted removes the paths listed in a deleted entry from the stages
+func applyDeleted(filename string, stages map[string]string) error {
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	var deleted []string
+	if err = json.Unmarshal(data, &deleted); err != nil {
+		return fmt.Errorf("invalid list of deleted paths: %v", err)
+	}
+
+	for _, name := range deleted {
+		stage, ok := stages[strings.SplitN(name, "/", 2)[0]]
+		if !ok {
+			return fmt.Errorf("unexpected deleted path %s", name)
+		}
+
+		target, err := safeJoin(stage, name)
+		if err != nil {
+			return err
+		}
+
+		// a parent replaced by a symlink would be followed outside of the stage
+		if parentSymlink(stage, target) {
+			continue
+		}
+
+		// its parent may have been deleted or replaced by a file already
+		if _, err = os.Lstat(target); err != nil {
+			continue
+		}
+
+		if err = os.RemoveAll(target); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// parentSymlink reports if a parent directory of target below root is a
+// symlink
+func parentSymlink(root, target string) bool {
+	root = filepath.Clean(root)
+
+	for dir := filepath.Dir(target); dir != root && dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+		if info, err := os.Lstat(dir); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			return true
+		}
+	}
+
+	return false
+}
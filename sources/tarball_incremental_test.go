@@ -0,0 +1,256 @@
+package sources
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sbusso/autobackup/naming"
+	"github.com/stretchr/testify/require"
+)
+
+func tarballEntries(r *require.Assertions, filepath string) []string {
+	f, err := os.Open(filepath)
+	r.NoError(err)
+
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	r.NoError(err)
+
+	archive := tar.NewReader(gz)
+
+	var names []string
+
+	for {
+		header, err := archive.Next()
+		if err != nil {
+			break
+		}
+
+		names = append(names, header.Name)
+	}
+
+	return names
+}
+
+func TestTarballIncremental(t *testing.T) {
+	r := require.New(t)
+	tmp, err := ioutil.TempDir("", "tarball")
+	r.NoError(err, "failed to create temp directory")
+
+	defer os.RemoveAll(tmp)
+
+	// several backups are taken within the same second
+	defer naming.SetDefault(naming.Default())
+	naming.SetDefault(&naming.Template{Pattern: "{prefix}-{time}-{seq}{ext}"})
+
+	dir := path.Join(tmp, "data")
+	saveDir := path.Join(tmp, "backups")
+	r.NoError(os.MkdirAll(path.Join(dir, "sub"), 0755))
+	r.NoError(os.Mkdir(saveDir, 0755))
+
+	mtime := time.Now().Add(-time.Hour)
+
+	write := func(name, content string) {
+		file := path.Join(dir, name)
+		r.NoError(ioutil.WriteFile(file, []byte(content), 0644))
+		r.NoError(os.Chtimes(file, mtime, mtime))
+		mtime = mtime.Add(time.Second)
+	}
+
+	write("a.txt", "a1")
+	write("b.txt", "b1")
+	write("unchanged.txt", "same")
+	write("sub/c.txt", "c1")
+
+	tarball := TarballConfig{
+		Paths:     []string{dir},
+		Mode:      TarballIncremental,
+		FullEvery: 10,
+		Compress:  true,
+		SaveDir:   saveDir,
+		StateFile: path.Join(tmp, "state"),
+	}
+
+	full, err := tarball.Backup()
+	r.NoError(err, "failed to create full backup")
+	r.NoError(tarball.Commit(full), "failed to commit backup state")
+
+	write("a.txt", "a2")
+	r.NoError(os.Remove(path.Join(dir, "b.txt")))
+	write("d.txt", "d2")
+	r.NoError(os.RemoveAll(path.Join(dir, "sub")))
+	write("sub", "sub is a file")
+
+	first, err := tarball.Backup()
+	r.NoError(err, "failed to create incremental backup")
+	r.NoError(tarball.Commit(first), "failed to commit backup state")
+
+	entries := tarballEntries(r, first)
+	r.Equal(tarballManifest, entries[0])
+	r.Equal(tarballDeleted, entries[len(entries)-1])
+	r.Contains(entries, "data/a.txt")
+	r.Contains(entries, "data/d.txt")
+	r.NotContains(entries, "data/unchanged.txt", "unchanged files should not be archived")
+
+	write("a.txt", "a3")
+	write("e.txt", "e3")
+
+	// a backup that was not stored is left out of the chain
+	lost, err := tarball.Backup()
+	r.NoError(err, "failed to create incremental backup")
+	r.Error(tarball.Commit(full), "state committed for another backup")
+	r.NoError(os.Remove(lost))
+
+	second, err := tarball.Backup()
+	r.NoError(err, "failed to create incremental backup")
+	r.NoError(tarball.Commit(second), "failed to commit backup state")
+
+	manifest, err := readTarballManifest(second)
+	r.NoError(err)
+	r.Equal(TarballIncremental, manifest.Level)
+	r.Equal([]string{path.Base(full), path.Base(first)}, manifest.Chain)
+
+	tarball.Mode = TarballDifferential
+
+	differential, err := tarball.Backup()
+	r.NoError(err, "failed to create differential backup")
+	r.NoError(tarball.Commit(differential), "failed to commit backup state")
+
+	manifest, err = readTarballManifest(differential)
+	r.NoError(err)
+	r.Equal(TarballDifferential, manifest.Level)
+	r.Equal([]string{path.Base(full)}, manifest.Chain)
+
+	expected := map[string]map[string]string{
+		full:         {"a.txt": "a1", "b.txt": "b1", "unchanged.txt": "same", "sub/c.txt": "c1"},
+		first:        {"a.txt": "a2", "d.txt": "d2", "unchanged.txt": "same", "sub": "sub is a file"},
+		second:       {"a.txt": "a3", "d.txt": "d2", "e.txt": "e3", "unchanged.txt": "same", "sub": "sub is a file"},
+		differential: {"a.txt": "a3", "d.txt": "d2", "e.txt": "e3", "unchanged.txt": "same", "sub": "sub is a file"},
+	}
+
+	for _, backup := range []string{full, first, second, differential} {
+		r.NoError(tarball.Restore(backup), "failed to restore %s", backup)
+
+		files, err := readDirNames(dir)
+		r.NoError(err)
+
+		var restored []string
+		for _, name := range files {
+			if name == "sub" {
+				if info, err := os.Stat(path.Join(dir, name)); err == nil && info.IsDir() {
+					restored = append(restored, "sub/c.txt")
+					continue
+				}
+			}
+
+			restored = append(restored, name)
+		}
+
+		r.Len(restored, len(expected[backup]), "unexpected files restored from %s: %v", backup, restored)
+
+		for name, content := range expected[backup] {
+			actual, err := ioutil.ReadFile(path.Join(dir, name))
+			r.NoError(err, "missing %s restored from %s", name, backup)
+			r.Equal(content, string(actual))
+		}
+	}
+
+	r.NoError(os.Remove(full))
+	r.Error(tarball.Restore(second), "restore should fail without the full backup")
+}
+
+func TestTarballIncrementalSymlinkedDirectory(t *testing.T) {
+	r := require.New(t)
+	tmp, err := ioutil.TempDir("", "tarball")
+	r.NoError(err, "failed to create temp directory")
+
+	defer os.RemoveAll(tmp)
+
+	dir := path.Join(tmp, "data")
+	r.NoError(os.MkdirAll(path.Join(dir, "conf"), 0755))
+	r.NoError(ioutil.WriteFile(path.Join(dir, "conf", "x"), []byte("old"), 0644))
+
+	outside := path.Join(tmp, "outside")
+	r.NoError(os.Mkdir(outside, 0755))
+	r.NoError(ioutil.WriteFile(path.Join(outside, "x"), []byte("keep"), 0644))
+
+	tarball := TarballConfig{
+		Paths:     []string{dir},
+		Mode:      TarballIncremental,
+		FullEvery: 10,
+		SaveDir:   tmp,
+		StateFile: path.Join(tmp, "state"),
+	}
+
+	full, err := tarball.Backup()
+	r.NoError(err, "failed to create full backup")
+	r.NoError(tarball.Commit(full), "failed to commit backup state")
+
+	// the directory became a symlink, its old file is deleted
+	r.NoError(os.RemoveAll(path.Join(dir, "conf")))
+	r.NoError(os.Symlink(outside, path.Join(dir, "conf")))
+
+	incremental, err := tarball.Backup()
+	r.NoError(err, "failed to create incremental backup")
+
+	r.NoError(tarball.Restore(incremental), "failed to restore")
+
+	link, err := os.Readlink(path.Join(dir, "conf"))
+	r.NoError(err, "symlink not restored")
+	r.Equal(outside, link)
+
+	actual, err := ioutil.ReadFile(path.Join(outside, "x"))
+	r.NoError(err, "file removed through the symlink")
+	r.Equal("keep", string(actual))
+}
+
+func TestTarballFullEvery(t *testing.T) {
+	r := require.New(t)
+	tmp, err := ioutil.TempDir("", "tarball")
+	r.NoError(err, "failed to create temp directory")
+
+	defer os.RemoveAll(tmp)
+
+	defer naming.SetDefault(naming.Default())
+	naming.SetDefault(&naming.Template{Pattern: "{prefix}-{time}-{seq}{ext}"})
+
+	dir := path.Join(tmp, "data")
+	saveDir := path.Join(tmp, "backups")
+	r.NoError(os.Mkdir(dir, 0755))
+	r.NoError(os.Mkdir(saveDir, 0755))
+
+	for _, mode := range []string{TarballDifferential, TarballIncremental} {
+		tarball := TarballConfig{
+			Paths:     []string{dir},
+			Mode:      mode,
+			FullEvery: 3,
+			Compress:  true,
+			SaveDir:   saveDir,
+			StateFile: path.Join(tmp, "state-"+mode),
+		}
+
+		var levels []string
+
+		for i := 0; i < 7; i++ {
+			r.NoError(ioutil.WriteFile(path.Join(dir, "file.txt"), []byte(strings.Repeat("x", i)), 0644))
+
+			backup, err := tarball.Backup()
+			r.NoError(err, "failed to create backup")
+			r.NoError(tarball.Commit(backup), "failed to commit backup state")
+
+			manifest, err := readTarballManifest(backup)
+			r.NoError(err)
+			levels = append(levels, manifest.Level)
+		}
+
+		// the differential chains are always a full backup and the latest one
+		r.Equal([]string{TarballFull, mode, mode, TarballFull, mode, mode, TarballFull}, levels, "chains not rolled over in %s mode", mode)
+	}
+}
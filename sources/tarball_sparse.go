@@ -0,0 +1,228 @@
+package sources
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// sparseSegment is a region of data of a sparse file
+type sparseSegment struct {
+	Offset int64
+	Length int64
+}
+
+const tarBlockSize = 512
+
+// Largest values of the octal fields of the ustar headers, bigger values are
+// recorded in PAX records
+const (
+	maxTarID   = 07777777
+	maxTarSize = 077777777777
+)
+
+// writeSparseEntry writes a regular file as a GNU sparse 1.0 entry, only its
+// data segments are archived and the holes are restored by the readers.
+// archive/tar doesn't write the GNU.sparse records, so the headers are
+// encoded here and written to out, the writer of archive, once the previous
+// entry is flushed. hash gets the contents of the file, holes included.
+func writeSparseEntry(archive *tar.Writer, out io.Writer, header *tar.Header, in *os.File, segments []sparseSegment, hash io.Writer) error {
+	if err := archive.Flush(); err != nil {
+		return err
+	}
+
+	// the map ends with the file size, as an empty segment after a final hole,
+	// or the readers truncate the file
+	if n := len(segments); n == 0 || segments[n-1].Offset+segments[n-1].Length < header.Size {
+		segments = append(segments[:n:n], sparseSegment{Offset: header.Size})
+	}
+
+	// the data starts with the map of the segments
+	var sparseMap bytes.Buffer
+	fmt.Fprintf(&sparseMap, "%d\n", len(segments))
+
+	var dataSize int64
+	for _, s := range segments {
+		fmt.Fprintf(&sparseMap, "%d\n%d\n", s.Offset, s.Length)
+		dataSize += s.Length
+	}
+
+	sparseMap.Write(make([]byte, tarPadding(int64(sparseMap.Len()))))
+	size := int64(sparseMap.Len()) + dataSize
+
+	records := map[string]string{
+		"GNU.sparse.major":    "1",
+		"GNU.sparse.minor":    "0",
+		"GNU.sparse.name":     header.Name,
+		"GNU.sparse.realsize": strconv.FormatInt(header.Size, 10),
+		"mtime":               formatPAXTime(header.ModTime.Unix(), int64(header.ModTime.Nanosecond())),
+	}
+
+	for key, value := range header.PAXRecords {
+		records[key] = value
+	}
+
+	if header.Uname != "" {
+		records["uname"] = header.Uname
+	}
+
+	if header.Gname != "" {
+		records["gname"] = header.Gname
+	}
+
+	if header.Uid > maxTarID {
+		records["uid"] = strconv.Itoa(header.Uid)
+	}
+
+	if header.Gid > maxTarID {
+		records["gid"] = strconv.Itoa(header.Gid)
+	}
+
+	if size > maxTarSize {
+		records["size"] = strconv.FormatInt(size, 10)
+	}
+
+	keys := make([]string, 0, len(records))
+	for key := range records {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	var pax bytes.Buffer
+	for _, key := range keys {
+		pax.WriteString(paxRecord(key, records[key]))
+	}
+
+	dir, file := path.Split(strings.TrimSuffix(header.Name, "/"))
+
+	paxHeader := ustarHeader(path.Join(dir, "PaxHeaders.0", file), tar.TypeXHeader, 0644, int64(pax.Len()), header)
+	pax.Write(make([]byte, tarPadding(int64(pax.Len()))))
+	fileHeader := ustarHeader(path.Join(dir, "GNUSparseFile.0", file), tar.TypeReg, header.Mode, size, header)
+
+	for _, block := range [][]byte{paxHeader, pax.Bytes(), fileHeader, sparseMap.Bytes()} {
+		if _, err := out.Write(block); err != nil {
+			return err
+		}
+	}
+
+	writer := out
+	if hash != nil {
+		writer = io.MultiWriter(out, hash)
+	}
+
+	var offset int64
+
+	for _, s := range segments {
+		if hash != nil {
+			if _, err := io.CopyN(hash, zeroReader{}, s.Offset-offset); err != nil {
+				return err
+			}
+		}
+
+		// a file truncated during the backup fails like with io.CopyN
+		if _, err := io.CopyN(writer, io.NewSectionReader(in, s.Offset, s.Length), s.Length); err != nil {
+			return err
+		}
+
+		offset = s.Offset + s.Length
+	}
+
+	if hash != nil {
+		if _, err := io.CopyN(hash, zeroReader{}, header.Size-offset); err != nil {
+			return err
+		}
+	}
+
+	_, err := out.Write(make([]byte, tarPadding(dataSize)))
+
+	return err
+}
+
+func tarPadding(size int64) int64 {
+	return -size & (tarBlockSize - 1)
+}
+
+// paxRecord formats a record, prefixed by its length including the prefix
+func paxRecord(key, value string) string {
+	record := " " + key + "=" + value + "\n"
+
+	size := len(record)
+	for size < len(record)+len(strconv.Itoa(size)) {
+		size = len(record) + len(strconv.Itoa(size))
+	}
+
+	return strconv.Itoa(size) + record
+}
+
+// formatPAXTime formats a time in seconds with the nanoseconds, if any
+func formatPAXTime(sec, nsec int64) string {
+	if nsec == 0 {
+		return strconv.FormatInt(sec, 10)
+	}
+
+	return strings.TrimRight(fmt.Sprintf("%d.%09d", sec, nsec), "0")
+}
+
+// ustarHeader encodes a ustar header block, the values not fitting are
+// truncated and must be recorded in the PAX header
+func ustarHeader(name string, typeflag byte, mode, size int64, header *tar.Header) []byte {
+	block := make([]byte, tarBlockSize)
+
+	field := func(offset, length int, value string) {
+		if len(value) > length {
+			value = value[:length]
+		}
+
+		copy(block[offset:offset+length], value)
+	}
+
+	octal := func(offset, length int, value int64) {
+		if value < 0 || value > 1<<(3*uint(length-1))-1 {
+			value = 0
+		}
+
+		field(offset, length, fmt.Sprintf("%0*o", length-1, value))
+	}
+
+	field(0, 100, name)
+	octal(100, 8, mode&07777)
+	octal(108, 8, int64(header.Uid))
+	octal(116, 8, int64(header.Gid))
+	octal(124, 12, size)
+	octal(136, 12, header.ModTime.Unix())
+	block[156] = typeflag
+	field(257, 6, "ustar\x00")
+	field(263, 2, "00")
+	field(265, 32, header.Uname)
+	field(297, 32, header.Gname)
+
+	// the checksum is computed with its own field filled with spaces
+	copy(block[148:156], "        ")
+
+	var sum int64
+	for _, c := range block {
+		sum += int64(c)
+	}
+
+	field(148, 8, fmt.Sprintf("%06o\x00 ", sum))
+
+	return block
+}
+
+// zeroReader reads zeros, the contents of the holes
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+
+	return len(p), nil
+}
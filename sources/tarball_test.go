@@ -1,10 +1,20 @@
 package sources
 
 import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"os"
 	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -42,3 +52,431 @@ func TestBackupRestore(t *testing.T) {
 	r.NoError(err, "failed to read restored file")
 	r.Equal(expected, actual, "backup contents mismatch")
 }
+
+func TestTarballFilters(t *testing.T) {
+	r := require.New(t)
+	tmp, err := ioutil.TempDir("", "tarball")
+	r.NoError(err, "failed to create temp directory")
+
+	defer os.RemoveAll(tmp)
+
+	files := map[string]string{
+		"app/main.go":            "main",
+		"app/build.tmp":          "tmp",
+		"app/cache/data":         "cache",
+		"app/logs/app.log":       "log",
+		"app/logs/keep.log":      "keep",
+		"app/logs/big.log":       "0123456789012345678901234",
+		"app/logs/" + IgnoreFile: "*.log\n!keep.log\n",
+		"conf/app.conf":          "conf",
+	}
+
+	for name, content := range files {
+		file := path.Join(tmp, name)
+		r.NoError(os.MkdirAll(path.Dir(file), 0755))
+		r.NoError(ioutil.WriteFile(file, []byte(content), 0644))
+	}
+
+	listener, err := net.Listen("unix", path.Join(tmp, "app", "app.sock"))
+	r.NoError(err, "failed to create socket")
+
+	defer listener.Close()
+
+	tar := TarballConfig{
+		Paths:       []string{path.Join(tmp, "app"), path.Join(tmp, "conf")},
+		Exclude:     []string{"*.tmp", "cache/"},
+		MaxFileSize: 20,
+		SaveDir:     tmp,
+	}
+
+	tarball, err := tar.Backup()
+	r.NoError(err, "failed to create backup tarball")
+
+	r.NoError(os.RemoveAll(path.Join(tmp, "app")))
+	r.NoError(ioutil.WriteFile(path.Join(tmp, "conf", "new.conf"), nil, 0644))
+
+	err = tar.Restore(tarball)
+	r.NoError(err, "failed to restore backup")
+
+	for _, name := range []string{"app/main.go", "app/logs/keep.log", "app/logs/" + IgnoreFile, "conf/app.conf"} {
+		actual, err := ioutil.ReadFile(path.Join(tmp, name))
+		r.NoError(err, "missing %s", name)
+		r.Equal(files[name], string(actual))
+	}
+
+	for _, name := range []string{"app/build.tmp", "app/cache", "app/logs/app.log", "app/logs/big.log", "app/app.sock", "conf/new.conf"} {
+		_, err := os.Lstat(path.Join(tmp, name))
+		r.True(os.IsNotExist(err), "%s should not be restored", name)
+	}
+
+	tar.Include = []string{"*.conf"}
+
+	tarball, err = tar.Backup()
+	r.NoError(err, "failed to create backup tarball")
+
+	err = tar.Restore(tarball)
+	r.NoError(err, "failed to restore backup")
+
+	_, err = os.Stat(path.Join(tmp, "app", "main.go"))
+	r.True(os.IsNotExist(err), "only included files should be restored")
+
+	_, err = os.Stat(path.Join(tmp, "conf", "app.conf"))
+	r.NoError(err, "included file should be restored")
+
+	tar.Paths = []string{path.Join(tmp, "conf"), path.Join(tmp, "other", "conf")}
+
+	_, err = tar.Backup()
+	r.Error(err, "paths with the same name should fail")
+}
+
+func TestTarballMetadata(t *testing.T) {
+	r := require.New(t)
+	tmp, err := ioutil.TempDir("", "tarball")
+	r.NoError(err, "failed to create temp directory")
+
+	defer os.RemoveAll(tmp)
+
+	dir := path.Join(tmp, "data")
+	r.NoError(os.Mkdir(dir, 0750))
+
+	file := path.Join(dir, "file.txt")
+	r.NoError(ioutil.WriteFile(file, []byte("test"), 0640))
+	r.NoError(os.Link(file, path.Join(dir, "hardlink.txt")))
+	r.NoError(os.Symlink("file.txt", path.Join(dir, "symlink.txt")))
+
+	xattrs := writeXattr(file, "user.autobackup", "value") == nil
+
+	sparse, err := os.Create(path.Join(dir, "sparse"))
+	r.NoError(err)
+	_, err = sparse.WriteAt([]byte("end"), 8<<20)
+	r.NoError(err)
+	r.NoError(sparse.Close())
+
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	r.NoError(os.Chtimes(file, mtime, mtime))
+
+	tar := TarballConfig{
+		Paths:    []string{dir},
+		Compress: true,
+		SaveDir:  tmp,
+	}
+
+	if os.Geteuid() == 0 {
+		tar.Credential = &syscall.Credential{Uid: 1234, Gid: 1234}
+	}
+
+	tarball, err := tar.Backup()
+	r.NoError(err, "failed to create backup tarball")
+
+	r.NoError(os.RemoveAll(dir))
+
+	err = tar.Restore(tarball)
+	r.NoError(err, "failed to restore backup")
+
+	info, err := os.Stat(dir)
+	r.NoError(err)
+	r.Equal(os.FileMode(0750), info.Mode().Perm())
+
+	info, err = os.Stat(file)
+	r.NoError(err)
+	r.Equal(os.FileMode(0640), info.Mode().Perm())
+	r.True(mtime.Equal(info.ModTime()), "modification time mismatch")
+
+	if tar.Credential != nil {
+		stat := info.Sys().(*syscall.Stat_t)
+		r.Equal(uint32(1234), stat.Uid)
+		r.Equal(uint32(1234), stat.Gid)
+	}
+
+	link, err := os.Stat(path.Join(dir, "hardlink.txt"))
+	r.NoError(err)
+	r.True(os.SameFile(info, link), "hard link should be restored")
+
+	target, err := os.Readlink(path.Join(dir, "symlink.txt"))
+	r.NoError(err, "symlink should be restored")
+	r.Equal("file.txt", target)
+
+	info, err = os.Stat(path.Join(dir, "sparse"))
+	r.NoError(err)
+	r.Equal(int64(8<<20+3), info.Size())
+	r.True(info.Sys().(*syscall.Stat_t).Blocks*512 < info.Size(), "sparse file should have holes")
+
+	if xattrs {
+		restored, err := readXattrs(file)
+		r.NoError(err)
+		r.Equal("value", restored["user.autobackup"])
+	}
+}
+
+func writeTestTarball(r *require.Assertions, file string, headers ...*tar.Header) {
+	f, err := os.Create(file)
+	r.NoError(err)
+
+	defer f.Close()
+
+	w := tar.NewWriter(f)
+
+	for _, header := range headers {
+		r.NoError(w.WriteHeader(header))
+
+		if header.Size > 0 {
+			_, err = w.Write(make([]byte, header.Size))
+			r.NoError(err)
+		}
+	}
+
+	r.NoError(w.Close())
+}
+
+func TestTarballSafeRestore(t *testing.T) {
+	r := require.New(t)
+	tmp, err := ioutil.TempDir("", "tarball")
+	r.NoError(err, "failed to create temp directory")
+
+	defer os.RemoveAll(tmp)
+
+	dir := path.Join(tmp, "data")
+	r.NoError(os.Mkdir(dir, 0755))
+
+	file := path.Join(dir, "file.txt")
+	r.NoError(ioutil.WriteFile(file, []byte("backup"), 0644))
+
+	tarball := TarballConfig{
+		Paths:             []string{dir},
+		Compress:          true,
+		Compression:       "zstd",
+		SaveDir:           tmp,
+		RollbackRetention: time.Hour,
+	}
+
+	backup, err := tarball.Backup()
+	r.NoError(err, "failed to create backup tarball")
+	r.True(strings.HasSuffix(backup, ".tar.zst"), "codec extension missing")
+
+	r.NoError(ioutil.WriteFile(file, []byte("current"), 0644))
+
+	unsupported := path.Join(tmp, "backup.zip")
+	r.NoError(ioutil.WriteFile(unsupported, nil, 0644))
+
+	corrupt := path.Join(tmp, "corrupt.tar.zst")
+	data, err := ioutil.ReadFile(backup)
+	r.NoError(err)
+	r.NoError(ioutil.WriteFile(corrupt, data[:len(data)/2], 0644))
+
+	absolute := path.Join(tmp, "absolute.tar")
+	writeTestTarball(r, absolute,
+		&tar.Header{Name: "data/", Typeflag: tar.TypeDir, Mode: 0755},
+		&tar.Header{Name: "/tmp/evil", Typeflag: tar.TypeReg, Mode: 0644, Size: 1})
+
+	parent := path.Join(tmp, "parent.tar")
+	writeTestTarball(r, parent,
+		&tar.Header{Name: "data/", Typeflag: tar.TypeDir, Mode: 0755},
+		&tar.Header{Name: "data/../../evil", Typeflag: tar.TypeReg, Mode: 0644, Size: 1})
+
+	symlink := path.Join(tmp, "symlink.tar")
+	writeTestTarball(r, symlink,
+		&tar.Header{Name: "data/", Typeflag: tar.TypeDir, Mode: 0755},
+		&tar.Header{Name: "data/link", Typeflag: tar.TypeSymlink, Linkname: tmp},
+		&tar.Header{Name: "data/link/evil", Typeflag: tar.TypeReg, Mode: 0644, Size: 1})
+
+	missing := path.Join(tmp, "missing.tar")
+	writeTestTarball(r, missing, &tar.Header{Name: "other/", Typeflag: tar.TypeDir, Mode: 0755})
+
+	for _, invalid := range []string{unsupported, corrupt, absolute, parent, symlink, missing} {
+		r.Error(tarball.Restore(invalid), "restore of %s should fail", invalid)
+
+		actual, err := ioutil.ReadFile(file)
+		r.NoError(err, "data should be kept when restoring %s", invalid)
+		r.Equal("current", string(actual))
+	}
+
+	_, err = os.Stat(path.Join(tmp, "evil"))
+	r.True(os.IsNotExist(err), "entries must not escape the target")
+
+	r.NoError(tarball.Restore(backup), "failed to restore backup")
+
+	actual, err := ioutil.ReadFile(file)
+	r.NoError(err)
+	r.Equal("backup", string(actual))
+
+	rollbacks, err := filepath.Glob(path.Join(tmp, ".data.rollback-*"))
+	r.NoError(err)
+	r.Len(rollbacks, 1, "previous contents should be kept")
+
+	actual, err = ioutil.ReadFile(path.Join(rollbacks[0], "file.txt"))
+	r.NoError(err)
+	r.Equal("current", string(actual))
+
+	staging, err := filepath.Glob(path.Join(tmp, ".data.restore-*"))
+	r.NoError(err)
+	r.Empty(staging, "staging directories should be removed")
+
+	tarball.RollbackRetention = 0
+	r.NoError(tarball.Restore(backup), "failed to restore backup")
+
+	rollbacks, err = filepath.Glob(path.Join(tmp, ".data.rollback-*"))
+	r.NoError(err)
+	r.Empty(rollbacks, "expired rollbacks should be removed")
+}
+
+func TestTarballRestoreInPlace(t *testing.T) {
+	r := require.New(t)
+	tmp, err := ioutil.TempDir("", "tarball")
+	r.NoError(err, "failed to create temp directory")
+
+	defer os.RemoveAll(tmp)
+
+	dir := path.Join(tmp, "data")
+	r.NoError(os.Mkdir(dir, 0755))
+
+	file := path.Join(dir, "file.txt")
+	r.NoError(ioutil.WriteFile(file, []byte("backup"), 0644))
+
+	// the working directory is restored in place, like a mount point
+	wd, err := os.Getwd()
+	r.NoError(err)
+
+	defer os.Chdir(wd)
+	r.NoError(os.Chdir(dir))
+
+	tarball := TarballConfig{
+		Path:              "./",
+		SaveDir:           tmp,
+		RollbackRetention: time.Hour,
+	}
+
+	backup, err := tarball.Backup()
+	r.NoError(err, "failed to create backup tarball")
+
+	r.NoError(ioutil.WriteFile(file, []byte("current"), 0644))
+	r.NoError(ioutil.WriteFile(path.Join(dir, "new.txt"), nil, 0644))
+	r.NoError(os.Chmod(dir, 0700))
+
+	r.NoError(tarball.Restore(backup), "failed to restore backup")
+
+	current, err := os.Getwd()
+	r.NoError(err)
+	r.Equal(dir, current, "working directory should not move")
+
+	actual, err := ioutil.ReadFile("file.txt")
+	r.NoError(err, "restored file should be in the working directory")
+	r.Equal("backup", string(actual))
+
+	_, err = os.Stat(path.Join(dir, "new.txt"))
+	r.True(os.IsNotExist(err), "files created after the backup should be moved aside")
+
+	info, err := os.Stat(dir)
+	r.NoError(err)
+	r.Equal(os.FileMode(0755), info.Mode().Perm(), "directory mode should be restored")
+
+	rollbacks, err := filepath.Glob(path.Join(dir, ".data.rollback-*"))
+	r.NoError(err)
+	r.Len(rollbacks, 1, "previous contents should be kept in the directory")
+
+	actual, err = ioutil.ReadFile(path.Join(rollbacks[0], "file.txt"))
+	r.NoError(err)
+	r.Equal("current", string(actual))
+
+	staging, err := filepath.Glob(path.Join(dir, ".data.restore-*"))
+	r.NoError(err)
+	r.Empty(staging, "staging directories should be removed")
+
+	// the rollbacks are not backed up
+	backup, err = tarball.Backup()
+	r.NoError(err, "failed to create backup tarball")
+
+	reader, closer, err := openBackup(backup)
+	r.NoError(err)
+
+	defer closer()
+
+	archive := tar.NewReader(reader)
+
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+
+		r.NoError(err)
+		r.NotContains(header.Name, rollbackSuffix, "rollback backed up")
+	}
+
+	tarball.RollbackRetention = 0
+	r.NoError(tarball.Restore(backup), "failed to restore backup")
+
+	rollbacks, err = filepath.Glob(path.Join(dir, ".data.rollback-*"))
+	r.NoError(err)
+	r.Empty(rollbacks, "expired rollbacks should be removed")
+}
+
+func TestTarballSparse(t *testing.T) {
+	r := require.New(t)
+	tmp, err := ioutil.TempDir("", "tarball")
+	r.NoError(err, "failed to create temp directory")
+
+	defer os.RemoveAll(tmp)
+
+	dir := path.Join(tmp, "data")
+	r.NoError(os.Mkdir(dir, 0750))
+
+	// data at the start, in the middle and a hole at the end
+	file := path.Join(dir, "disk.img")
+	sparse, err := os.Create(file)
+	r.NoError(err)
+	_, err = sparse.WriteAt([]byte("start"), 0)
+	r.NoError(err)
+	_, err = sparse.WriteAt([]byte("middle"), 32<<20)
+	r.NoError(err)
+	r.NoError(sparse.Truncate(64 << 20))
+	r.NoError(sparse.Close())
+
+	// only a hole
+	r.NoError(ioutil.WriteFile(path.Join(dir, "hole.img"), nil, 0644))
+	r.NoError(os.Truncate(path.Join(dir, "hole.img"), 16<<20))
+
+	contents, err := ioutil.ReadFile(file)
+	r.NoError(err)
+
+	info, err := os.Stat(file)
+	r.NoError(err)
+
+	if info.Sys().(*syscall.Stat_t).Blocks*512 >= info.Size() {
+		t.Skip("filesystem without sparse files")
+	}
+
+	tarball := TarballConfig{
+		Paths:     []string{dir},
+		Mode:      TarballIncremental,
+		SaveDir:   tmp,
+		StateFile: path.Join(tmp, "state"),
+	}
+
+	filepath, err := tarball.Backup()
+	r.NoError(err, "failed to create backup tarball")
+	r.NoError(tarball.Commit(filepath))
+
+	// the holes are not archived
+	info, err = os.Stat(filepath)
+	r.NoError(err)
+	r.True(info.Size() < 1<<20, "holes archived, tarball size is %d", info.Size())
+
+	state, err := readTarballState(path.Join(tmp, "state"))
+	r.NoError(err)
+	r.Equal(fmt.Sprintf("%x", sha256.Sum256(contents)), state.Files["data/disk.img"].Hash)
+
+	r.NoError(os.RemoveAll(dir))
+	r.NoError(tarball.Restore(filepath), "failed to restore backup")
+
+	restored, err := ioutil.ReadFile(file)
+	r.NoError(err)
+	r.True(bytes.Equal(contents, restored), "sparse file contents mismatch")
+
+	info, err = os.Stat(file)
+	r.NoError(err)
+	r.True(info.Sys().(*syscall.Stat_t).Blocks*512 < info.Size(), "sparse file should have holes")
+
+	info, err = os.Stat(path.Join(dir, "hole.img"))
+	r.NoError(err)
+	r.Equal(int64(16<<20), info.Size())
+}
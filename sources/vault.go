@@ -0,0 +1,255 @@
+package sources
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/caarlos0/env"
+	"github.com/mitchellh/mapstructure"
+)
+
+// VaultConfig has the config options for the Vault service, it must use the
+// integrated storage. AuthMethod is one of token, approle or kubernetes.
+type VaultConfig struct {
+	Address    string        `env:"VAULT_ADDR" envDefault:"https://127.0.0.1:8200"`
+	Namespace  string        `env:"VAULT_NAMESPACE"`
+	CACert     string        `env:"VAULT_CACERT"`
+	Cert       string        `env:"VAULT_CLIENT_CERT"`
+	Key        string        `env:"VAULT_CLIENT_KEY"`
+	ServerName string        `env:"VAULT_TLS_SERVER_NAME"`
+	SkipVerify bool          `env:"VAULT_SKIP_VERIFY" envDefault:"false"`
+	AuthMethod string        `env:"VAULT_AUTH_METHOD" envDefault:"token"`
+	AuthMount  string        `env:"VAULT_AUTH_MOUNT"`
+	Token      string        `env:"VAULT_TOKEN"`
+	RoleID     string        `env:"VAULT_ROLE_ID"`
+	SecretID   string        `env:"VAULT_SECRET_ID"`
+	Role       string        `env:"VAULT_ROLE"`
+	JWTFile    string        `env:"VAULT_JWT_FILE" envDefault:"/var/run/secrets/kubernetes.io/serviceaccount/token"`
+	Timeout    time.Duration `env:"VAULT_TIMEOUT" envDefault:"1h"`
+	SaveDir    string        `env:"SAVEDIR" envDefault:"/tmp/"`
+}
+
+func NewVaultConfig(opts map[string]interface{}) *VaultConfig {
+	cfg := &VaultConfig{}
+	err := env.Parse(cfg)
+	mapstructure.Decode(opts, cfg)
+
+	if err != nil {
+		fmt.Printf("%+v\n", err)
+	}
+	return cfg
+}
+
+func (v *VaultConfig) client() (*http.Client, error) {
+	client := &http.Client{}
+
+	if strings.HasPrefix(v.Address, "https://") {
+		config, err := newTLSConfig(v.ServerName, v.CACert, v.Cert, v.Key, v.SkipVerify)
+		if err != nil {
+			return nil, err
+		}
+
+		client.Transport = &http.Transport{TLSClientConfig: config}
+	}
+
+	return client, nil
+}
+
+func (v *VaultConfig) context() (context.Context, context.CancelFunc) {
+	if v.Timeout > 0 {
+		return context.WithTimeout(context.Background(), v.Timeout)
+	}
+
+	return context.WithCancel(context.Background())
+}
+
+// request calls the Vault API, the response body must be closed and the
+// returned function called once done with it
+func (v *VaultConfig) request(client *http.Client, method, endpoint, token string, body io.Reader) (*http.Response, context.CancelFunc, error) {
+	ctx, cancel := v.context()
+
+	req, err := http.NewRequest(method, strings.TrimRight(v.Address, "/")+"/v1/"+endpoint, body)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+
+	req = req.WithContext(ctx)
+
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+
+	if v.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.Namespace)
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		res.Body.Close()
+		cancel()
+		return nil, nil, fmt.Errorf("%s returned %s: %s", endpoint, res.Status, strings.TrimSpace(string(msg)))
+	}
+
+	return res, cancel, nil
+}
+
+// login returns a token for the configured authentication method
+func (v *VaultConfig) login(client *http.Client) (string, error) {
+	var credentials map[string]string
+
+	mount := v.AuthMount
+
+	switch v.AuthMethod {
+	case "", "token":
+		if v.Token == "" {
+			return "", fmt.Errorf("vault token is not set")
+		}
+		return v.Token, nil
+	case "approle":
+		if mount == "" {
+			mount = "approle"
+		}
+
+		credentials = map[string]string{"role_id": v.RoleID, "secret_id": v.SecretID}
+	case "kubernetes":
+		if mount == "" {
+			mount = "kubernetes"
+		}
+
+		jwt, err := ioutil.ReadFile(v.JWTFile)
+		if err != nil {
+			return "", fmt.Errorf("cannot read service account token: %v", err)
+		}
+
+		credentials = map[string]string{"role": v.Role, "jwt": strings.TrimSpace(string(jwt))}
+	default:
+		return "", fmt.Errorf("unknown auth method %q", v.AuthMethod)
+	}
+
+	data, err := json.Marshal(credentials)
+	if err != nil {
+		return "", err
+	}
+
+	res, cancel, err := v.request(client, http.MethodPost, "auth/"+mount+"/login", "", bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("vault login failed: %v", err)
+	}
+
+	defer cancel()
+	defer res.Body.Close()
+
+	var secret struct {
+		Auth struct {
+			ClientToken string `json:"client_token"`
+		} `json:"auth"`
+	}
+
+	if err = json.NewDecoder(res.Body).Decode(&secret); err != nil {
+		return "", fmt.Errorf("invalid vault login response: %v", err)
+	}
+
+	if secret.Auth.ClientToken == "" {
+		return "", fmt.Errorf("vault login returned no token")
+	}
+
+	return secret.Auth.ClientToken, nil
+}
+
+// Backup saves a snapshot of the raft storage and returns the path where is stored
+func (v *VaultConfig) Backup() (string, error) {
+	client, err := v.client()
+	if err != nil {
+		return "", err
+	}
+
+	token, err := v.login(client)
+	if err != nil {
+		return "", err
+	}
+
+	res, cancel, err := v.request(client, http.MethodGet, "sys/storage/raft/snapshot", token, nil)
+	if err != nil {
+		return "", fmt.Errorf("cannot request vault snapshot: %v", err)
+	}
+
+	defer cancel()
+	defer res.Body.Close()
+
+	filepath := generateFilename(v.SaveDir, "vault-backup", ".snap")
+
+	f, err := os.Create(filepath)
+	if err != nil {
+		return "", fmt.Errorf("cannot create file: %v", err)
+	}
+
+	_, err = io.Copy(f, res.Body)
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err == nil {
+		err = verifyRaftSnapshot(filepath)
+	}
+
+	if err != nil {
+		os.Remove(filepath)
+		return "", fmt.Errorf("cannot save vault snapshot: %v", err)
+	}
+
+	return filepath, nil
+}
+
+// Restore verifies a snapshot and forces its restore, replacing the data of
+// the cluster even if it was taken from a different one
+func (v *VaultConfig) Restore(filepath string) error {
+	if err := verifyRaftSnapshot(filepath); err != nil {
+		return err
+	}
+
+	client, err := v.client()
+	if err != nil {
+		return err
+	}
+
+	token, err := v.login(client)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(filepath)
+	if err != nil {
+		return fmt.Errorf("cannot open file: %v", err)
+	}
+
+	defer f.Close()
+
+	res, cancel, err := v.request(client, http.MethodPost, "sys/storage/raft/snapshot-force", token, f)
+	if err != nil {
+		return fmt.Errorf("cannot restore vault snapshot: %v", err)
+	}
+
+	defer cancel()
+	res.Body.Close()
+
+	return nil
+}
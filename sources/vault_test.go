@@ -0,0 +1,82 @@
+package sources
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVaultSnapshot(t *testing.T) {
+	r := require.New(t)
+	tmp, err := ioutil.TempDir("", "vault")
+	r.NoError(err, "failed to create temp directory")
+
+	defer os.RemoveAll(tmp)
+
+	snapshot := raftSnapshot("vault raft state", false)
+	var restored []byte
+	var login map[string]string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/v1/auth/approle/login", "/v1/auth/k8s/login":
+			login = nil
+			json.NewDecoder(req.Body).Decode(&login)
+			w.Write([]byte(`{"auth":{"client_token":"s.session"}}`))
+			return
+		}
+
+		if req.Header.Get("X-Vault-Token") != "s.session" {
+			http.Error(w, `{"errors":["permission denied"]}`, http.StatusForbidden)
+			return
+		}
+
+		switch {
+		case req.Method == http.MethodGet && req.URL.Path == "/v1/sys/storage/raft/snapshot":
+			w.Write(snapshot)
+		case req.Method == http.MethodPost && req.URL.Path == "/v1/sys/storage/raft/snapshot-force":
+			restored, _ = ioutil.ReadAll(req.Body)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+
+	defer server.Close()
+
+	v := VaultConfig{
+		Address:    server.URL,
+		AuthMethod: "approle",
+		RoleID:     "role",
+		SecretID:   "secret",
+		SaveDir:    tmp,
+	}
+
+	filepath, err := v.Backup()
+	r.NoError(err, "failed to backup")
+	r.Equal(map[string]string{"role_id": "role", "secret_id": "secret"}, login)
+
+	jwt := path.Join(tmp, "jwt")
+	r.NoError(ioutil.WriteFile(jwt, []byte("service-account-token\n"), 0600))
+
+	v.AuthMethod = "kubernetes"
+	v.AuthMount = "k8s"
+	v.Role = "backup"
+	v.JWTFile = jwt
+
+	r.NoError(v.Restore(filepath), "failed to restore")
+	r.Equal(snapshot, restored)
+	r.Equal(map[string]string{"role": "backup", "jwt": "service-account-token"}, login)
+
+	v.AuthMethod = "token"
+	v.Token = "s.invalid"
+	_, err = v.Backup()
+	r.Error(err, "backup with an invalid token")
+	r.Contains(err.Error(), "permission denied")
+}
@@ -0,0 +1,72 @@
+package sources
+
+import (
+	"bytes"
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// readXattrs returns the extended attributes of a file without following
+// symlinks, POSIX ACLs are stored as system.posix_acl_* attributes
+func readXattrs(file string) (map[string]string, error) {
+	size, err := unix.Llistxattr(file, nil)
+	if err == unix.ENOTSUP || size == 0 {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, &os.PathError{Op: "listxattr", Path: file, Err: err}
+	}
+
+	buf := make([]byte, size)
+	if size, err = unix.Llistxattr(file, buf); err != nil {
+		return nil, &os.PathError{Op: "listxattr", Path: file, Err: err}
+	}
+
+	xattrs := map[string]string{}
+
+	for _, name := range bytes.Split(buf[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+
+		size, err := unix.Lgetxattr(file, string(name), nil)
+		if err == unix.ENODATA {
+			continue
+		}
+
+		if err != nil {
+			return nil, &os.PathError{Op: "getxattr", Path: file, Err: err}
+		}
+
+		value := make([]byte, size)
+		if size, err = unix.Lgetxattr(file, string(name), value); err != nil {
+			return nil, &os.PathError{Op: "getxattr", Path: file, Err: err}
+		}
+
+		xattrs[string(name)] = string(value[:size])
+	}
+
+	return xattrs, nil
+}
+
+func writeXattr(file, name, value string) error {
+	if err := unix.Lsetxattr(file, name, []byte(value), 0); err != nil {
+		return &os.PathError{Op: "setxattr", Path: file, Err: err}
+	}
+
+	return nil
+}
+
+// lchtimes changes the times of a symlink instead of its target
+func lchtimes(file string, atime, mtime time.Time) error {
+	ts := []unix.Timespec{unix.NsecToTimespec(atime.UnixNano()), unix.NsecToTimespec(mtime.UnixNano())}
+
+	if err := unix.UtimesNanoAt(unix.AT_FDCWD, file, ts, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return &os.PathError{Op: "utimes", Path: file, Err: err}
+	}
+
+	return nil
+}
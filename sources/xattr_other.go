@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package sources
+
+import "time"
+
+// extended attributes are only supported on Linux
+func readXattrs(file string) (map[string]string, error) {
+	return nil, nil
+}
+
+func writeXattr(file, name, value string) error {
+	return nil
+}
+
+func lchtimes(file string, atime, mtime time.Time) error {
+	return nil
+}
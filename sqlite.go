@@ -0,0 +1,45 @@
+package autobackup
+
+import (
+	"fmt"
+
+	"github.com/sbusso/autobackup/sources"
+	"github.com/sbusso/autobackup/stores"
+	"github.com/sbusso/autobackup/tasks"
+)
+
+// SQLite recipe to backup a SQLite database while it is in use
+func SQLite(dbPath string) (*tasks.Scheduler, error) {
+
+	var config = tasks.NewConfig()
+
+	var opts = map[string]interface{}{
+		"File": dbPath,
+	}
+
+	var source = sources.NewSQLiteConfig(opts)
+
+	s3, err := stores.NewS3Config()
+	if err != nil {
+		return nil, fmt.Errorf("an error occured getting config, backup will not be scheduled: %v\n", err)
+	}
+
+	repo, err := stores.WithRepository(s3)
+	if err != nil {
+		return nil, fmt.Errorf("an error occured opening repository, backup will not be scheduled: %v\n", err)
+	}
+
+	store, err := stores.WithCatalog(repo)
+	if err != nil {
+		return nil, fmt.Errorf("an error occured opening catalog, backup will not be scheduled: %v\n", err)
+	}
+
+	s, err := tasks.ScheduleBackup(config, source, store)
+	if err != nil {
+		return nil, fmt.Errorf("an error occured during scheduling backup, backup will not be scheduled: %v\n", err)
+	}
+
+	s.Start()
+
+	return s, nil
+}
@@ -0,0 +1,405 @@
+package stores
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	"log"
+
+	"github.com/caarlos0/env"
+	"github.com/sbusso/autobackup/naming"
+	bolt "go.etcd.io/bbolt"
+)
+
+var catalogBucket = []byte("backups")
+
+// CatalogConfig keeps a local index of the backups of a store, so the latest
+// backup and the ones to remove are found without listing the store. The
+// catalog is mirrored to the store to be able to recover it.
+type CatalogConfig struct {
+	File    string `env:"CATALOG_FILE"`
+	Object  string `env:"CATALOG_OBJECT" envDefault:"autobackup-catalog.db"`
+	Backend Store
+	db      *bolt.DB
+}
+
+// CatalogEntry describes a backup recorded in the catalog
+type CatalogEntry struct {
+	Name     string
+	Size     int64
+	Checksum string
+	Job      string
+	Time     time.Time
+}
+
+// NewCatalogConfig opens the catalog of a store, it is restored from the
+// store mirror or rebuilt from a store listing if the file doesn't exist
+func NewCatalogConfig(backend Store) (*CatalogConfig, error) {
+	cfg := &CatalogConfig{Backend: backend}
+	if err := env.Parse(cfg); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Open(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// WithCatalog wraps the store in a catalog when CATALOG_FILE is set
+func WithCatalog(backend Store) (Store, error) {
+	if os.Getenv("CATALOG_FILE") == "" {
+		return backend, nil
+	}
+
+	return NewCatalogConfig(backend)
+}
+
+func (c *CatalogConfig) indexer() (Indexer, error) {
+	idx, ok := c.Backend.(Indexer)
+	if !ok {
+		return nil, fmt.Errorf("store %T cannot be used with a catalog", c.Backend)
+	}
+
+	return idx, nil
+}
+
+// Open opens the catalog database
+func (c *CatalogConfig) Open() error {
+	if c.File == "" {
+		return fmt.Errorf("catalog file is not set")
+	}
+
+	idx, err := c.indexer()
+	if err != nil {
+		return err
+	}
+
+	_, err = os.Stat(c.File)
+	missing := os.IsNotExist(err)
+
+	if missing {
+		if err := c.fetchMirror(idx); err != nil {
+			log.Printf("Cannot restore catalog from the store, %v\n", err)
+		} else {
+			missing = false
+		}
+	}
+
+	c.db, err = bolt.Open(c.File, 0600, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return fmt.Errorf("cannot open catalog %s, %v", c.File, err)
+	}
+
+	err = c.db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(catalogBucket)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("cannot initialize catalog, %v", err)
+	}
+
+	if missing {
+		log.Println("Catalog not found, rebuilding it from the store")
+		return c.Rebuild()
+	}
+
+	return nil
+}
+
+// fetchMirror copies the catalog mirrored on the store to the local file
+func (c *CatalogConfig) fetchMirror(idx Indexer) error {
+	retrieved, err := c.Backend.Retrieve(idx.Key(c.Object))
+	if err != nil {
+		return err
+	}
+
+	defer c.Backend.Close()
+
+	return copyFile(retrieved, c.File)
+}
+
+// mirror uploads a copy of the catalog to the store
+func (c *CatalogConfig) mirror() {
+	tmp := path.Join(path.Dir(c.File), "."+path.Base(c.File)+".mirror")
+
+	err := c.db.View(func(tx *bolt.Tx) error {
+		return tx.CopyFile(tmp, 0600)
+	})
+
+	if err == nil {
+		err = c.Backend.Store(tmp, c.Object)
+	}
+
+	if err != nil {
+		log.Printf("Cannot mirror catalog to the store, %v\n", err)
+	}
+}
+
+// Store saves a file to the backend store and records it on the catalog
+func (c *CatalogConfig) Store(filepath string, filename string) error {
+	idx, err := c.indexer()
+	if err != nil {
+		return err
+	}
+
+	// the backend may remove the file once stored
+	size, checksum, err := fileChecksum(filepath)
+	if err != nil {
+		return fmt.Errorf("cannot compute checksum of %s, %v", filepath, err)
+	}
+
+	if err = c.Backend.Store(filepath, filename); err != nil {
+		return err
+	}
+
+	ts, ok := naming.Default().Time(filename)
+	if !ok {
+		ts = time.Now()
+	}
+
+	entry := CatalogEntry{
+		Name:     idx.Key(filename),
+		Size:     size,
+		Checksum: checksum,
+		Job:      naming.Default().Job,
+		Time:     ts,
+	}
+
+	if err = c.put(entry); err != nil {
+		return fmt.Errorf("cannot record backup on catalog, %v", err)
+	}
+
+	c.mirror()
+
+	return nil
+}
+
+func (c *CatalogConfig) put(entries ...CatalogEntry) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(catalogBucket)
+
+		for _, entry := range entries {
+			data, err := json.Marshal(entry)
+			if err != nil {
+				return err
+			}
+
+			if err = b.Put([]byte(entry.Name), data); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// Entries returns the backups recorded on the catalog, from the oldest to
+// the most recent
+func (c *CatalogConfig) Entries() ([]CatalogEntry, error) {
+	var entries []CatalogEntry
+
+	err := c.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(catalogBucket).ForEach(func(k, v []byte) error {
+			var entry CatalogEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return fmt.Errorf("invalid catalog entry %s, %v", k, err)
+			}
+
+			entries = append(entries, entry)
+			return nil
+		})
+	})
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].Time.Equal(entries[j].Time) {
+			return entries[i].Name < entries[j].Name
+		}
+		return entries[i].Time.Before(entries[j].Time)
+	})
+
+	return entries, err
+}
+
+// Retrieve downloads a backup from the backend store
+func (c *CatalogConfig) Retrieve(filename string) (string, error) {
+	return c.Backend.Retrieve(filename)
+}
+
+// RemoveOlderBackups keeps the most recent backups of the catalog and deletes
+// the old ones, the backend housekeeping runs as its own retention would
+func (c *CatalogConfig) RemoveOlderBackups(keep int) error {
+	idx, err := c.indexer()
+	if err != nil {
+		return err
+	}
+
+	if err = c.Housekeeping(); err != nil {
+		log.Printf("%v\n", err)
+	}
+
+	entries, err := c.Entries()
+	if err != nil {
+		return fmt.Errorf("cannot read catalog, %v", err)
+	}
+
+	count := len(entries) - keep
+	if count <= 0 {
+		return nil
+	}
+
+	names := make([]string, count)
+	for i, entry := range entries[:count] {
+		names[i] = entry.Name
+	}
+
+	if err = idx.Delete(names); err != nil {
+		return err
+	}
+
+	err = c.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(catalogBucket)
+		for _, name := range names {
+			if err := b.Delete([]byte(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		return fmt.Errorf("cannot remove backups from catalog, %v", err)
+	}
+
+	c.mirror()
+
+	return nil
+}
+
+// FindLatestBackup returns the most recent backup of the catalog
+func (c *CatalogConfig) FindLatestBackup() (string, error) {
+	entries, err := c.Entries()
+	if err != nil {
+		return "", fmt.Errorf("cannot read catalog, %v", err)
+	}
+
+	if len(entries) == 0 {
+		return "", fmt.Errorf("cannot find a recent backup on catalog %s", c.File)
+	}
+
+	return entries[len(entries)-1].Name, nil
+}
+
+// Rebuild replaces the contents of the catalog with a listing of the store,
+// checksums are unknown for the backups found this way
+func (c *CatalogConfig) Rebuild() error {
+	idx, err := c.indexer()
+	if err != nil {
+		return err
+	}
+
+	objects, err := idx.List()
+	if err != nil {
+		return fmt.Errorf("cannot list store, %v", err)
+	}
+
+	var entries []CatalogEntry
+
+	for _, obj := range objects {
+		if ts, ok := naming.Default().Time(obj.Name); ok {
+			entries = append(entries, CatalogEntry{Name: obj.Name, Size: obj.Size, Time: ts})
+		}
+	}
+
+	err = c.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(catalogBucket); err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+
+		_, err := tx.CreateBucket(catalogBucket)
+		return err
+	})
+
+	if err == nil {
+		err = c.put(entries...)
+	}
+
+	if err != nil {
+		return fmt.Errorf("cannot rebuild catalog, %v", err)
+	}
+
+	log.Printf("Catalog rebuilt with %d backups\n", len(entries))
+	c.mirror()
+
+	return nil
+}
+
+// Housekeeping runs the maintenance of the backend store, if it has any
+func (c *CatalogConfig) Housekeeping() error {
+	if hk, ok := c.Backend.(Housekeeper); ok {
+		return hk.Housekeeping()
+	}
+
+	return nil
+}
+
+// Close deinitializes the backend store, the catalog database stays open
+// until Shutdown
+func (c *CatalogConfig) Close() {
+	c.Backend.Close()
+}
+
+// Shutdown closes the catalog database
+func (c *CatalogConfig) Shutdown() error {
+	if c.db == nil {
+		return nil
+	}
+
+	return c.db.Close()
+}
+
+func fileChecksum(filepath string) (int64, string, error) {
+	f, err := os.Open(filepath)
+	if err != nil {
+		return 0, "", err
+	}
+
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return 0, "", err
+	}
+
+	return size, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func copyFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+
+	defer in.Close()
+
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
@@ -0,0 +1,80 @@
+package stores
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// housekeepingStore counts the housekeeping delegated to it
+type housekeepingStore struct {
+	*FilesystemConfig
+	runs int
+}
+
+func (h *housekeepingStore) Housekeeping() error {
+	h.runs++
+	return nil
+}
+
+func TestCatalog(t *testing.T) {
+	r := require.New(t)
+	tmp, err := ioutil.TempDir("", "catalog")
+	r.NoError(err, "failed to create temp directory")
+
+	defer os.RemoveAll(tmp)
+
+	storeDir := path.Join(tmp, "store")
+	err = os.Mkdir(storeDir, 0755)
+	r.NoError(err, "failed to create store directory")
+
+	fs := &housekeepingStore{FilesystemConfig: &FilesystemConfig{SaveDir: storeDir, Partition: true}}
+	catalog := &CatalogConfig{File: path.Join(tmp, "catalog.db"), Object: "catalog.db", Backend: fs}
+	r.NoError(catalog.Open(), "failed to open catalog")
+
+	names := []string{
+		"test-backup-20180901000000.tar.gz",
+		"test-backup-20180902000000.tar.gz",
+		"test-backup-20180903000000.tar.gz",
+	}
+
+	for _, name := range names {
+		filepath := path.Join(tmp, name)
+		err = ioutil.WriteFile(filepath, []byte(name), 0644)
+		r.NoError(err, "failed to create backup file")
+
+		err = catalog.Store(filepath, name)
+		r.NoError(err, "failed to store backup")
+	}
+
+	entries, err := catalog.Entries()
+	r.NoError(err, "failed to read catalog")
+	r.Len(entries, 3)
+	r.Equal(int64(len(names[0])), entries[0].Size)
+	r.NotEmpty(entries[0].Checksum)
+
+	latest, err := catalog.FindLatestBackup()
+	r.NoError(err, "failed to find latest backup")
+	r.Equal("2018/09/03/"+names[2], latest)
+
+	err = catalog.RemoveOlderBackups(2)
+	r.NoError(err, "failed to remove old backups")
+
+	_, err = os.Stat(path.Join(storeDir, "2018/09/01", names[0]))
+	r.True(os.IsNotExist(err), "old backup was not removed")
+	r.Equal(1, fs.runs, "backend housekeeping was not run")
+
+	// rebuilding from the store listing gives the same backups
+	err = catalog.Rebuild()
+	r.NoError(err, "failed to rebuild catalog")
+
+	entries, err = catalog.Entries()
+	r.NoError(err, "failed to read catalog")
+	r.Len(entries, 2)
+	r.Equal("2018/09/02/"+names[1], entries[0].Name)
+
+	r.NoError(catalog.Shutdown())
+}
@@ -0,0 +1,91 @@
+package stores
+
+import (
+	"io"
+)
+
+// gearTable holds the random values of the gear rolling hash, generated with
+// splitmix64 so chunk boundaries are stable across versions
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+
+	seed := uint64(0x6175746f6261636b)
+
+	for i := range table {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+
+	return table
+}()
+
+// chunker splits a stream in content defined chunks: a boundary is found
+// where the rolling hash of the last bytes matches a mask, so an insertion
+// only changes the chunks around it. Chunks are between avg/4 and avg*8
+// bytes, avg must be a power of two.
+type chunker struct {
+	r    io.Reader
+	buf  []byte
+	n    int
+	eof  bool
+	min  int
+	max  int
+	mask uint64
+}
+
+func newChunker(r io.Reader, avg int) *chunker {
+	return &chunker{
+		r:    r,
+		buf:  make([]byte, avg*8),
+		min:  avg / 4,
+		max:  avg * 8,
+		mask: uint64(avg - 1),
+	}
+}
+
+// Next returns the next chunk, io.EOF at the end of the stream
+func (c *chunker) Next() ([]byte, error) {
+	for !c.eof && c.n < c.max {
+		n, err := c.r.Read(c.buf[c.n:c.max])
+		c.n += n
+
+		if err == io.EOF {
+			c.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	if c.n == 0 {
+		return nil, io.EOF
+	}
+
+	size := c.boundary()
+	chunk := make([]byte, size)
+	copy(chunk, c.buf[:size])
+
+	c.n = copy(c.buf, c.buf[size:c.n])
+
+	return chunk, nil
+}
+
+func (c *chunker) boundary() int {
+	if c.n <= c.min {
+		return c.n
+	}
+
+	var hash uint64
+
+	for i := c.min; i < c.n; i++ {
+		hash = (hash << 1) + gearTable[c.buf[i]]
+
+		if hash&c.mask == 0 {
+			return i + 1
+		}
+	}
+
+	return c.n
+}
@@ -2,113 +2,332 @@ package stores
 
 import (
 	"fmt"
-	"io"
-	"io/ioutil"
 	"os"
+	"os/user"
 	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
 
 	"log"
+
+	"github.com/caarlos0/env"
+	"github.com/sbusso/autobackup/naming"
 )
 
 // FilesystemConfig has the config options for the FilesystemConfig service
 type FilesystemConfig struct {
-	SaveDir string
+	SaveDir   string `env:"FILESYSTEM_DIR"`
+	Job       string `env:"JOB_NAME"`
+	Partition bool   `env:"FILESYSTEM_PARTITION" envDefault:"false"`
+	FileMode  string `env:"FILESYSTEM_FILE_MODE" envDefault:"0640"`
+	Owner     string `env:"FILESYSTEM_OWNER"`
+}
+
+// NewFilesystemConfig loads the filesystem store configuration from the environment
+func NewFilesystemConfig() (*FilesystemConfig, error) {
+	cfg := &FilesystemConfig{}
+	err := env.Parse(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.SaveDir == "" {
+		return nil, fmt.Errorf("FILESYSTEM_DIR is required")
+	}
+
+	if _, err = cfg.fileMode(); err != nil {
+		return nil, err
+	}
+
+	if _, _, err = cfg.owner(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+func (f *FilesystemConfig) fileMode() (os.FileMode, error) {
+	if f.FileMode == "" {
+		return 0640, nil
+	}
+
+	mode, err := strconv.ParseUint(f.FileMode, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid file mode %q, %v", f.FileMode, err)
+	}
+
+	return os.FileMode(mode), nil
 }
 
-// Store moves/copies a file to another directory
+// owner resolves the "user:group" owner of the stored files, -1 leaves
+// the id unchanged
+func (f *FilesystemConfig) owner() (int, int, error) {
+	if f.Owner == "" {
+		return -1, -1, nil
+	}
+
+	parts := strings.SplitN(f.Owner, ":", 2)
+	uid, gid := -1, -1
+
+	if parts[0] != "" {
+		id, err := strconv.Atoi(parts[0])
+		if err != nil {
+			u, err := user.Lookup(parts[0])
+			if err != nil {
+				return 0, 0, fmt.Errorf("unknown user %s, %v", parts[0], err)
+			}
+
+			id, _ = strconv.Atoi(u.Uid)
+		}
+
+		uid = id
+	}
+
+	if len(parts) == 2 && parts[1] != "" {
+		id, err := strconv.Atoi(parts[1])
+		if err != nil {
+			g, err := user.LookupGroup(parts[1])
+			if err != nil {
+				return 0, 0, fmt.Errorf("unknown group %s, %v", parts[1], err)
+			}
+
+			id, _ = strconv.Atoi(g.Gid)
+		}
+
+		gid = id
+	}
+
+	return uid, gid, nil
+}
+
+// Store moves/copies a file to the store directory. The file is written to a
+// temporary name and renamed once complete, so an interrupted copy is never
+// taken for a backup.
 func (f *FilesystemConfig) Store(src string, filename string) error {
-	dest := path.Clean(path.Join(f.SaveDir, filename))
+	dest := path.Clean(path.Join(f.SaveDir, f.Key(filename)))
+	dir := path.Dir(dest)
 
 	if src == dest {
 		log.Println("Using the same path as source and destination, do nothing")
 		return nil
 	}
 
-	err := os.Rename(dest, src)
+	mode, err := f.fileMode()
 	if err != nil {
-		log.Printf("Cannot rename %s to %s, trying to copy instead\n", src, dest)
-	} else {
-		return nil
+		return err
 	}
 
-	var removeSourceFile = false
-
-	srcFile, err := os.Open(src)
+	uid, gid, err := f.owner()
 	if err != nil {
-		return fmt.Errorf("cannot open source file %s, %v", src, err)
+		return err
 	}
 
-	defer func() {
-		srcFile.Close()
+	if err = os.MkdirAll(dir, 0750); err != nil {
+		return fmt.Errorf("cannot create directory %s, %v", dir, err)
+	}
 
-		// if there aren't any errors on the file copy then delete the source file
-		if removeSourceFile {
-			if err = os.Remove(src); err != nil {
-				log.Printf("Cannot remove source file %s\n", src)
+	tmp := path.Join(dir, "."+path.Base(dest)+".tmp")
+	moved := true
+
+	if err = os.Rename(src, tmp); err != nil {
+		moved = false
+		log.Printf("Cannot rename %s to %s, trying to copy instead\n", src, dest)
+
+		if err = copyFile(src, tmp); err != nil {
+			os.Remove(tmp)
+			return fmt.Errorf("error while copying file, %v", err)
+		}
+
+		defer func() {
+			// the source is only removed once the copy is in place
+			if err == nil {
+				if rerr := os.Remove(src); rerr != nil {
+					log.Printf("Cannot remove source file %s\n", src)
+				}
 			}
+		}()
+	}
+
+	if err = f.commit(tmp, dest, mode, uid, gid); err != nil {
+		// a renamed source is the only copy of the backup, give it back
+		if !moved {
+			os.Remove(tmp)
+		} else if rerr := os.Rename(tmp, src); rerr != nil && !os.IsNotExist(rerr) {
+			log.Printf("Cannot move %s back to %s, %v\n", tmp, src, rerr)
 		}
-	}()
 
-	destFile, err := os.Create(dest)
-	if err != nil {
-		return fmt.Errorf("cannot create destination file %s, %v", dest, err)
+		return err
 	}
 
-	defer destFile.Close()
+	return nil
+}
 
-	_, err = io.Copy(destFile, srcFile) // check first var for number of bytes copied
+// commit flushes the temporary file, applies the permissions and renames it
+// to its final name
+func (f *FilesystemConfig) commit(tmp, dest string, mode os.FileMode, uid, gid int) error {
+	file, err := os.OpenFile(tmp, os.O_RDWR, 0)
 	if err != nil {
-		return fmt.Errorf("error while copying file, %v", err)
+		return fmt.Errorf("cannot open file %s, %v", tmp, err)
 	}
 
-	if err = destFile.Sync(); err != nil {
+	defer file.Close()
+
+	if err = file.Sync(); err != nil {
 		return fmt.Errorf("cannot flush file contents, %v", err)
 	}
 
-	removeSourceFile = true
+	if err = file.Chmod(mode); err != nil {
+		return fmt.Errorf("cannot change mode of %s, %v", tmp, err)
+	}
+
+	if uid != -1 || gid != -1 {
+		if err = file.Chown(uid, gid); err != nil {
+			return fmt.Errorf("cannot change owner of %s, %v", tmp, err)
+		}
+	}
+
+	if err = os.Rename(tmp, dest); err != nil {
+		return fmt.Errorf("cannot rename %s to %s, %v", tmp, dest, err)
+	}
+
+	return syncDir(path.Dir(dest))
+}
+
+// syncDir flushes a directory so a rename survives a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("cannot open directory %s, %v", dir, err)
+	}
+
+	defer d.Close()
+
+	if err = d.Sync(); err != nil {
+		return fmt.Errorf("cannot flush directory %s, %v", dir, err)
+	}
 
 	return nil
 }
 
+// Key returns the path of a stored file relative to the store directory
+func (f *FilesystemConfig) Key(filename string) string {
+	if f.Partition {
+		return path.Join(f.Job, partitionDir(filename), filename)
+	}
+
+	return path.Join(f.Job, filename)
+}
+
+// List returns the files of the job relative to the store directory,
+// including the ones in date partitions. Hidden files are skipped.
+func (f *FilesystemConfig) List() ([]Object, error) {
+	var objects []Object
+
+	root := path.Join(f.SaveDir, f.Job)
+	if _, err := os.Stat(root); os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if strings.HasPrefix(info.Name(), ".") && p != root {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if info.Mode().IsRegular() {
+			rel, err := filepath.Rel(f.SaveDir, p)
+			if err != nil {
+				return err
+			}
+
+			objects = append(objects, Object{Name: filepath.ToSlash(rel), Size: info.Size()})
+		}
+
+		return nil
+	})
+
+	return objects, err
+}
+
+func (f *FilesystemConfig) getFileListing() ([]string, error) {
+	objects, err := f.List()
+
+	files := make([]string, len(objects))
+	for i, obj := range objects {
+		files[i] = obj.Name
+	}
+
+	return files, err
+}
+
 // RemoveOlderBackups keeps the most recent backups of a directory and deletes the old ones
 func (f *FilesystemConfig) RemoveOlderBackups(keep int) error {
-	files, err := ioutil.ReadDir(f.SaveDir)
+	files, err := f.getFileListing()
 	if err != nil {
 		return fmt.Errorf("cannot list contents of directory %s, %v", f.SaveDir, err)
 	}
 
-	count := len(files) - keep
-	deleted := 0
+	backups := naming.Default().Sort(files)
+	count := len(backups) - keep
 
 	if count > 0 {
-		for _, file := range files[:count] {
-			fullpath := path.Clean(path.Join(f.SaveDir, file.Name()))
-			err = os.Remove(fullpath)
-			if err != nil {
-				log.Println(0, "Failed to remove file %s", fullpath)
-			} else {
-				deleted++
-			}
+		names := make([]string, count)
+		for i, backup := range backups[:count] {
+			names[i] = backup.Name
 		}
 
-		log.Printf("Deleted %d objects from %s\n", deleted, f.SaveDir)
+		return f.Delete(names)
 	}
 
 	return nil
 }
 
+// Delete removes the specified files from the store directory
+func (f *FilesystemConfig) Delete(names []string) error {
+	deleted := 0
+
+	for _, name := range names {
+		fullpath := path.Clean(path.Join(f.SaveDir, name))
+		if err := os.Remove(fullpath); err != nil {
+			log.Printf("Failed to remove file %s\n", fullpath)
+			continue
+		}
+
+		deleted++
+
+		// remove the partition directories left empty, this fails on non empty ones
+		for dir := path.Dir(name); dir != "." && dir != "/"; dir = path.Dir(dir) {
+			if os.Remove(path.Join(f.SaveDir, dir)) != nil {
+				break
+			}
+		}
+	}
+
+	log.Printf("Deleted %d objects from %s\n", deleted, f.SaveDir)
+
+	return nil
+}
+
 // FindLatestBackup returns the most recent backup of the specified directory
 func (f *FilesystemConfig) FindLatestBackup() (string, error) {
-	files, err := ioutil.ReadDir(f.SaveDir)
+	files, err := f.getFileListing()
 	if err != nil {
 		return "", fmt.Errorf("cannot list contents of directory %s, %v", f.SaveDir, err)
 	}
 
-	if len(files) == 0 {
+	backups := naming.Default().Sort(files)
+	if len(backups) == 0 {
 		return "", fmt.Errorf("cannot find a recent backup on %s", f.SaveDir)
 	}
 
-	return files[len(files)-1].Name(), nil
+	return backups[len(backups)-1].Name, nil
 }
 
 // Retrieve returns the path of the requested file
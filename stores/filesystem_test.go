@@ -32,3 +32,84 @@ func TestStoreRestore(t *testing.T) {
 	err = fs.Store(filepath, "test.txt")
 	r.NoError(err, "failed to store file")
 }
+
+func TestStoreJobMode(t *testing.T) {
+	r := require.New(t)
+	tmp, err := ioutil.TempDir("", "store")
+	r.NoError(err, "failed to create temp directory")
+
+	defer os.RemoveAll(tmp)
+
+	fs := FilesystemConfig{
+		SaveDir:  path.Join(tmp, "store"),
+		Job:      "products",
+		FileMode: "0600",
+	}
+
+	names := []string{"test-20180901000000.tar", "test-20180902000000.tar"}
+
+	for _, name := range names {
+		filepath := path.Join(tmp, name)
+		err = ioutil.WriteFile(filepath, []byte(name), 0644)
+		r.NoError(err, "failed to create backup file")
+
+		err = fs.Store(filepath, name)
+		r.NoError(err, "failed to store file")
+
+		_, err = os.Stat(filepath)
+		r.True(os.IsNotExist(err), "source file was not moved")
+	}
+
+	info, err := os.Stat(path.Join(tmp, "store", "products", names[0]))
+	r.NoError(err, "stored file not found in job directory")
+	r.Equal(os.FileMode(0600), info.Mode().Perm())
+
+	latest, err := fs.FindLatestBackup()
+	r.NoError(err, "failed to find latest backup")
+	r.Equal("products/"+names[1], latest)
+
+	// storing again the same name replaces the file
+	filepath := path.Join(tmp, names[1])
+	err = ioutil.WriteFile(filepath, []byte("updated"), 0644)
+	r.NoError(err, "failed to create backup file")
+
+	err = fs.Store(filepath, names[1])
+	r.NoError(err, "failed to store file")
+
+	retrieved, err := fs.Retrieve(latest)
+	r.NoError(err, "failed to retrieve file")
+
+	actual, err := ioutil.ReadFile(retrieved)
+	r.NoError(err, "failed to read stored file")
+	r.Equal([]byte("updated"), actual)
+
+	files, err := ioutil.ReadDir(path.Join(tmp, "store", "products"))
+	r.NoError(err, "failed to list job directory")
+	r.Len(files, 2, "temporary files left in job directory")
+}
+
+func TestStoreCommitFailure(t *testing.T) {
+	r := require.New(t)
+	tmp, err := ioutil.TempDir("", "store")
+	r.NoError(err, "failed to create temp directory")
+
+	defer os.RemoveAll(tmp)
+
+	fs := FilesystemConfig{SaveDir: path.Join(tmp, "store")}
+
+	// a directory in place of the backup makes the final rename fail
+	blocker := path.Join(fs.SaveDir, "test-20180901000000.tar")
+	r.NoError(os.MkdirAll(path.Join(blocker, "child"), 0755))
+
+	filepath := path.Join(tmp, "test-20180901000000.tar")
+	r.NoError(ioutil.WriteFile(filepath, []byte("backup"), 0644))
+
+	r.Error(fs.Store(filepath, "test-20180901000000.tar"), "commit did not fail")
+
+	contents, err := ioutil.ReadFile(filepath)
+	r.NoError(err, "source file was lost")
+	r.Equal("backup", string(contents))
+
+	_, err = os.Stat(path.Join(fs.SaveDir, ".test-20180901000000.tar.tmp"))
+	r.True(os.IsNotExist(err), "temporary file was left")
+}
@@ -0,0 +1,218 @@
+package stores
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// RateLimit describes a bandwidth limit in bytes per second, optionally
+// depending on the time of the day. A limit of 0 means unlimited.
+type RateLimit struct {
+	Default int64
+	Windows []RateWindow
+}
+
+// RateWindow applies a limit between two times of the day (local time).
+// A window where Start is after End wraps around midnight.
+type RateWindow struct {
+	Start time.Duration
+	End   time.Duration
+	Limit int64
+}
+
+// ParseRateLimit parses a comma separated list of limits, for example
+// "2M" or "08:00-18:00=512K,2M". Entries with a time window apply during
+// that window, the entry without window is used the rest of the day.
+func ParseRateLimit(value string) (*RateLimit, error) {
+	limit := &RateLimit{}
+
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) == 1 {
+			size, err := parseSize(parts[0])
+			if err != nil {
+				return nil, err
+			}
+
+			limit.Default = size
+			continue
+		}
+
+		times := strings.SplitN(parts[0], "-", 2)
+		if len(times) != 2 {
+			return nil, fmt.Errorf("invalid time window %q", parts[0])
+		}
+
+		start, err := parseTimeOfDay(times[0])
+		if err != nil {
+			return nil, err
+		}
+
+		end, err := parseTimeOfDay(times[1])
+		if err != nil {
+			return nil, err
+		}
+
+		size, err := parseSize(parts[1])
+		if err != nil {
+			return nil, err
+		}
+
+		limit.Windows = append(limit.Windows, RateWindow{Start: start, End: end, Limit: size})
+	}
+
+	return limit, nil
+}
+
+// At returns the limit in bytes per second that applies at the given time
+func (r *RateLimit) At(t time.Time) int64 {
+	if r == nil {
+		return 0
+	}
+
+	offset := time.Duration(t.Hour())*time.Hour +
+		time.Duration(t.Minute())*time.Minute +
+		time.Duration(t.Second())*time.Second
+
+	for _, w := range r.Windows {
+		if w.Start <= w.End {
+			if offset >= w.Start && offset < w.End {
+				return w.Limit
+			}
+		} else if offset >= w.Start || offset < w.End {
+			return w.Limit
+		}
+	}
+
+	return r.Default
+}
+
+func parseTimeOfDay(value string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(value))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, expected HH:MM", value)
+	}
+
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func parseSize(value string) (int64, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	multiplier := int64(1)
+
+	switch {
+	case strings.HasSuffix(value, "K"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(value, "M"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(value, "G"):
+		multiplier = 1 << 30
+	}
+
+	if multiplier > 1 {
+		value = value[:len(value)-1]
+	}
+
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+
+	return size * multiplier, nil
+}
+
+// throttle shares a bandwidth budget between concurrent transfers
+type throttle struct {
+	limit   *RateLimit
+	mu      sync.Mutex
+	current int64
+	limiter *rate.Limiter
+}
+
+func newThrottle(limit *RateLimit) *throttle {
+	return &throttle{limit: limit}
+}
+
+// wait blocks until n bytes can be transferred
+func (t *throttle) wait(n int) {
+	if t == nil || n <= 0 {
+		return
+	}
+
+	t.mu.Lock()
+	bps := t.limit.At(time.Now())
+	if bps != t.current {
+		t.current = bps
+		if bps > 0 {
+			t.limiter = rate.NewLimiter(rate.Limit(bps), int(bps))
+		} else {
+			t.limiter = nil
+		}
+	}
+	limiter := t.limiter
+	t.mu.Unlock()
+
+	if limiter == nil {
+		return
+	}
+
+	// WaitN cannot request more than the burst size at once
+	for n > 0 {
+		chunk := n
+		if chunk > limiter.Burst() {
+			chunk = limiter.Burst()
+		}
+
+		limiter.WaitN(context.Background(), chunk)
+		n -= chunk
+	}
+}
+
+// throttledFile limits the read speed of a file, it keeps the ReaderAt and
+// Seeker interfaces so the uploader can read parts concurrently
+type throttledFile struct {
+	f interface {
+		io.ReadSeeker
+		io.ReaderAt
+	}
+	t *throttle
+}
+
+func (r *throttledFile) Read(p []byte) (int, error) {
+	n, err := r.f.Read(p)
+	r.t.wait(n)
+	return n, err
+}
+
+func (r *throttledFile) ReadAt(p []byte, off int64) (int, error) {
+	n, err := r.f.ReadAt(p, off)
+	r.t.wait(n)
+	return n, err
+}
+
+func (r *throttledFile) Seek(offset int64, whence int) (int64, error) {
+	return r.f.Seek(offset, whence)
+}
+
+// throttledWriterAt limits the write speed of a download
+type throttledWriterAt struct {
+	w io.WriterAt
+	t *throttle
+}
+
+func (w *throttledWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	w.t.wait(len(p))
+	return w.w.WriteAt(p, off)
+}
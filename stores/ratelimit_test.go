@@ -0,0 +1,31 @@
+package stores
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	r := require.New(t)
+
+	limit, err := ParseRateLimit("2M")
+	r.NoError(err, "failed to parse plain limit")
+	r.Equal(int64(2<<20), limit.Default)
+
+	limit, err = ParseRateLimit("08:00-18:00=512K,22:00-06:00=0,1G")
+	r.NoError(err, "failed to parse windowed limit")
+
+	day := time.Date(2018, 1, 1, 0, 0, 0, 0, time.Local)
+	r.Equal(int64(512<<10), limit.At(day.Add(9*time.Hour)))
+	r.Equal(int64(1<<30), limit.At(day.Add(20*time.Hour)))
+	r.Equal(int64(0), limit.At(day.Add(23*time.Hour)))
+	r.Equal(int64(0), limit.At(day.Add(2*time.Hour)))
+
+	_, err = ParseRateLimit("8-18=1M")
+	r.Error(err)
+
+	_, err = ParseRateLimit("fast")
+	r.Error(err)
+}
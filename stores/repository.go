@@ -0,0 +1,839 @@
+package stores
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"log"
+
+	"github.com/caarlos0/env"
+	"github.com/sbusso/autobackup/naming"
+)
+
+const (
+	snapshotExt = ".snapshot"
+	packPrefix  = "pack-"
+	packExt     = ".pack"
+	indexFile   = "index.json"
+)
+
+// RepositoryConfig stores deduplicated backups on a backend store. Backups are
+// split in content defined chunks, the new chunks are compressed and uploaded
+// in pack files and a snapshot lists the chunks of each backup, so repeated
+// backups only upload the chunks that changed. The chunk index is cached in
+// CacheDir and rebuilt from the snapshots when missing.
+type RepositoryConfig struct {
+	CacheDir        string `env:"REPOSITORY_CACHE_DIR"`
+	ChunkSize       int    `env:"REPOSITORY_CHUNK_SIZE" envDefault:"1048576"`
+	PackSize        int64  `env:"REPOSITORY_PACK_SIZE" envDefault:"16777216"`
+	KeepAfterUpload bool   `env:"KEEP_AFTER_UPLOAD" envDefault:"false"`
+	SaveDir         string `env:"SAVEDIR" envDefault:"/tmp/"`
+	Backend         Store
+	index           map[string]chunkRef
+	retrievedFile   string
+}
+
+// chunkRef locates a compressed chunk in a pack file
+type chunkRef struct {
+	ID     string `json:"id"`
+	Pack   string `json:"pack,omitempty"`
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length"`
+	Size   int64  `json:"size"`
+}
+
+// repositorySnapshot lists the chunks of a backup in order
+type repositorySnapshot struct {
+	Name   string     `json:"name"`
+	Size   int64      `json:"size"`
+	Hash   string     `json:"hash"`
+	Time   time.Time  `json:"time"`
+	Chunks []chunkRef `json:"chunks"`
+}
+
+// NewRepositoryConfig opens the repository stored on a backend
+func NewRepositoryConfig(backend Store) (*RepositoryConfig, error) {
+	cfg := &RepositoryConfig{Backend: backend}
+	if err := env.Parse(cfg); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Open(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// WithRepository wraps the store in a repository when REPOSITORY_CACHE_DIR is set
+func WithRepository(backend Store) (Store, error) {
+	if os.Getenv("REPOSITORY_CACHE_DIR") == "" {
+		return backend, nil
+	}
+
+	return NewRepositoryConfig(backend)
+}
+
+func (r *RepositoryConfig) indexer() (Indexer, error) {
+	idx, ok := r.Backend.(Indexer)
+	if !ok {
+		return nil, fmt.Errorf("store %T cannot be used with a repository", r.Backend)
+	}
+
+	return idx, nil
+}
+
+// Open checks the configuration and loads the chunk index
+func (r *RepositoryConfig) Open() error {
+	if r.ChunkSize < 1024 || r.ChunkSize&(r.ChunkSize-1) != 0 {
+		return fmt.Errorf("chunk size %d must be a power of two of at least 1024", r.ChunkSize)
+	}
+
+	if _, err := r.indexer(); err != nil {
+		return err
+	}
+
+	if r.CacheDir != "" {
+		if err := os.MkdirAll(r.CacheDir, 0700); err != nil {
+			return fmt.Errorf("cannot create cache directory %s, %v", r.CacheDir, err)
+		}
+	}
+
+	return r.loadIndex()
+}
+
+func (r *RepositoryConfig) loadIndex() error {
+	if r.CacheDir != "" {
+		data, err := ioutil.ReadFile(path.Join(r.CacheDir, indexFile))
+
+		if err == nil {
+			r.index = map[string]chunkRef{}
+			if err = json.Unmarshal(data, &r.index); err == nil {
+				return nil
+			}
+
+			log.Printf("Invalid repository index, rebuilding it, %v\n", err)
+		} else if !os.IsNotExist(err) {
+			return fmt.Errorf("cannot read repository index, %v", err)
+		}
+	}
+
+	snapshots, err := r.readSnapshots()
+	if err != nil {
+		return fmt.Errorf("cannot rebuild repository index, %v", err)
+	}
+
+	r.rebuildIndex(snapshots)
+
+	return r.saveIndex()
+}
+
+func (r *RepositoryConfig) rebuildIndex(snapshots []*repositorySnapshot) {
+	r.index = map[string]chunkRef{}
+
+	for _, snap := range snapshots {
+		for _, ref := range snap.Chunks {
+			r.index[ref.ID] = ref
+		}
+	}
+}
+
+func (r *RepositoryConfig) saveIndex() error {
+	if r.CacheDir == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(r.index)
+	if err != nil {
+		return err
+	}
+
+	tmp := path.Join(r.CacheDir, "."+indexFile+".tmp")
+
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("cannot write repository index, %v", err)
+	}
+
+	return os.Rename(tmp, path.Join(r.CacheDir, indexFile))
+}
+
+// packWriter writes the compressed chunks of a pack to a temporary file, the
+// pack ends with a JSON header of its chunks and the header length
+type packWriter struct {
+	file   *os.File
+	name   string
+	chunks []chunkRef
+	offset int64
+}
+
+func (r *RepositoryConfig) newPack() (*packWriter, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	f, err := ioutil.TempFile(r.SaveDir, ".pack-")
+	if err != nil {
+		return nil, err
+	}
+
+	return &packWriter{file: f, name: packPrefix + hex.EncodeToString(id) + packExt}, nil
+}
+
+func (p *packWriter) add(id string, chunk []byte) (chunkRef, error) {
+	var buf bytes.Buffer
+
+	gz := gzip.NewWriter(&buf)
+	gz.Write(chunk)
+
+	if err := gz.Close(); err != nil {
+		return chunkRef{}, err
+	}
+
+	if _, err := p.file.Write(buf.Bytes()); err != nil {
+		return chunkRef{}, err
+	}
+
+	ref := chunkRef{ID: id, Pack: p.name, Offset: p.offset, Length: int64(buf.Len()), Size: int64(len(chunk))}
+
+	p.offset += ref.Length
+	p.chunks = append(p.chunks, ref)
+
+	return ref, nil
+}
+
+func (p *packWriter) finish() error {
+	header := make([]chunkRef, len(p.chunks))
+	for i, ref := range p.chunks {
+		ref.Pack = ""
+		header[i] = ref
+	}
+
+	data, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+
+	data = append(data, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(data[len(data)-4:], uint32(len(data)-4))
+
+	if _, err = p.file.Write(data); err != nil {
+		return err
+	}
+
+	if err = p.file.Sync(); err != nil {
+		return err
+	}
+
+	return p.file.Close()
+}
+
+// upload sends a pack to the backend, the temporary file is removed
+func (r *RepositoryConfig) upload(p *packWriter) error {
+	defer os.Remove(p.file.Name())
+
+	if err := p.finish(); err != nil {
+		return fmt.Errorf("cannot write pack %s, %v", p.name, err)
+	}
+
+	if err := r.Backend.Store(p.file.Name(), p.name); err != nil {
+		return fmt.Errorf("cannot store pack %s, %v", p.name, err)
+	}
+
+	return nil
+}
+
+// Store splits a file in chunks, uploads the new ones and a snapshot of the file
+func (r *RepositoryConfig) Store(filepath string, filename string) error {
+	if err := r.store(filepath, filename); err != nil {
+		// the chunks of the failed packs must not be referenced
+		if lerr := r.loadIndex(); lerr != nil {
+			log.Printf("Cannot reload repository index, %v\n", lerr)
+		}
+
+		return err
+	}
+
+	if !r.KeepAfterUpload {
+		if err := os.Remove(filepath); err != nil {
+			log.Printf("Cannot remove file %s, %v\n", filepath, err)
+		}
+	}
+
+	return nil
+}
+
+func (r *RepositoryConfig) store(filepath string, filename string) error {
+	f, err := os.Open(filepath)
+	if err != nil {
+		return fmt.Errorf("failed to open file %q, %v", filepath, err)
+	}
+
+	defer f.Close()
+
+	hash := sha256.New()
+	chunks := newChunker(io.TeeReader(f, hash), r.ChunkSize)
+
+	snap := repositorySnapshot{Name: filename, Time: time.Now()}
+
+	var pack *packWriter
+	var added, uploaded int64
+
+	for {
+		chunk, err := chunks.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return fmt.Errorf("cannot read %s, %v", filepath, err)
+		}
+
+		sum := sha256.Sum256(chunk)
+		id := hex.EncodeToString(sum[:])
+
+		snap.Size += int64(len(chunk))
+
+		if ref, ok := r.index[id]; ok {
+			snap.Chunks = append(snap.Chunks, ref)
+			continue
+		}
+
+		if pack == nil {
+			if pack, err = r.newPack(); err != nil {
+				return fmt.Errorf("cannot create pack, %v", err)
+			}
+		}
+
+		ref, err := pack.add(id, chunk)
+		if err != nil {
+			os.Remove(pack.file.Name())
+			return fmt.Errorf("cannot write pack %s, %v", pack.name, err)
+		}
+
+		r.index[id] = ref
+		snap.Chunks = append(snap.Chunks, ref)
+		added += ref.Size
+
+		if pack.offset >= r.PackSize {
+			uploaded += pack.offset
+
+			if err = r.upload(pack); err != nil {
+				return err
+			}
+
+			pack = nil
+		}
+	}
+
+	if pack != nil {
+		uploaded += pack.offset
+
+		if err = r.upload(pack); err != nil {
+			return err
+		}
+	}
+
+	snap.Hash = hex.EncodeToString(hash.Sum(nil))
+
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+
+	tmp := path.Join(r.SaveDir, "."+filename+snapshotExt)
+	defer os.Remove(tmp)
+
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("cannot write snapshot, %v", err)
+	}
+
+	if err = r.Backend.Store(tmp, filename+snapshotExt); err != nil {
+		return fmt.Errorf("cannot store snapshot, %v", err)
+	}
+
+	log.Printf("Stored %s in the repository, %d of %d bytes were new, %d bytes uploaded\n",
+		filename, added, snap.Size, uploaded)
+
+	return r.saveIndex()
+}
+
+func snapshotFilename(name string) string {
+	name = path.Base(name)
+	if !strings.HasSuffix(name, snapshotExt) {
+		name += snapshotExt
+	}
+
+	return name
+}
+
+// Key returns the name of the snapshot of a stored file
+func (r *RepositoryConfig) Key(filename string) string {
+	idx, err := r.indexer()
+	if err != nil {
+		return snapshotFilename(filename)
+	}
+
+	return idx.Key(snapshotFilename(filename))
+}
+
+// List returns the snapshots of the repository
+func (r *RepositoryConfig) List() ([]Object, error) {
+	idx, err := r.indexer()
+	if err != nil {
+		return nil, err
+	}
+
+	objects, err := idx.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshots []Object
+
+	for _, obj := range objects {
+		if strings.HasSuffix(obj.Name, snapshotExt) {
+			snapshots = append(snapshots, obj)
+		}
+	}
+
+	return snapshots, nil
+}
+
+func (r *RepositoryConfig) readSnapshot(key string) (*repositorySnapshot, error) {
+	retrieved, err := r.Backend.Retrieve(key)
+	if err != nil {
+		return nil, err
+	}
+
+	defer r.Backend.Close()
+
+	data, err := ioutil.ReadFile(retrieved)
+	if err != nil {
+		return nil, err
+	}
+
+	snap := &repositorySnapshot{}
+	if err = json.Unmarshal(data, snap); err != nil {
+		return nil, fmt.Errorf("invalid snapshot %s, %v", key, err)
+	}
+
+	return snap, nil
+}
+
+func (r *RepositoryConfig) readSnapshots() ([]*repositorySnapshot, error) {
+	objects, err := r.List()
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := make([]*repositorySnapshot, len(objects))
+
+	for i, obj := range objects {
+		if snapshots[i], err = r.readSnapshot(obj.Name); err != nil {
+			return nil, err
+		}
+	}
+
+	return snapshots, nil
+}
+
+// readChunk decompresses a chunk of a pack and checks its hash
+func readChunk(pack io.ReaderAt, ref chunkRef) ([]byte, error) {
+	gz, err := gzip.NewReader(io.NewSectionReader(pack, ref.Offset, ref.Length))
+	if err != nil {
+		return nil, fmt.Errorf("chunk %s is corrupted, %v", ref.ID, err)
+	}
+
+	chunk, err := ioutil.ReadAll(gz)
+	if err != nil {
+		return nil, fmt.Errorf("chunk %s is corrupted, %v", ref.ID, err)
+	}
+
+	sum := sha256.Sum256(chunk)
+	if hex.EncodeToString(sum[:]) != ref.ID || int64(len(chunk)) != ref.Size {
+		return nil, fmt.Errorf("chunk %s has an invalid hash", ref.ID)
+	}
+
+	return chunk, nil
+}
+
+// Retrieve rebuilds a stored file from its snapshot, the name of the file or
+// of its snapshot are accepted
+func (r *RepositoryConfig) Retrieve(filename string) (string, error) {
+	snap, err := r.readSnapshot(r.Key(filename))
+	if err != nil {
+		return "", fmt.Errorf("cannot read snapshot of %s, %v", filename, err)
+	}
+
+	filepath := path.Join(r.SaveDir, path.Base(snap.Name))
+
+	if err = r.restore(snap, filepath); err != nil {
+		os.Remove(filepath)
+		return "", fmt.Errorf("cannot rebuild %s, %v", snap.Name, err)
+	}
+
+	log.Printf("File rebuilt to %s\n", filepath)
+	r.retrievedFile = filepath
+
+	return filepath, nil
+}
+
+func (r *RepositoryConfig) restore(snap *repositorySnapshot, filepath string) error {
+	idx, err := r.indexer()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(filepath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	defer out.Close()
+
+	// each pack is retrieved once, its chunks are written at their offsets
+	offsets := map[string][]int{}
+	var packs []string
+	var position int64
+
+	positions := make([]int64, len(snap.Chunks))
+
+	for i, ref := range snap.Chunks {
+		if _, ok := offsets[ref.Pack]; !ok {
+			packs = append(packs, ref.Pack)
+		}
+
+		offsets[ref.Pack] = append(offsets[ref.Pack], i)
+		positions[i] = position
+		position += ref.Size
+	}
+
+	for _, name := range packs {
+		if err = r.restorePack(idx.Key(name), snap, offsets[name], positions, out); err != nil {
+			return err
+		}
+	}
+
+	if err = out.Sync(); err != nil {
+		return err
+	}
+
+	_, hash, err := fileChecksum(filepath)
+	if err != nil {
+		return err
+	}
+
+	if hash != snap.Hash {
+		return fmt.Errorf("checksum mismatch")
+	}
+
+	return nil
+}
+
+func (r *RepositoryConfig) restorePack(key string, snap *repositorySnapshot, chunks []int, positions []int64, out io.WriterAt) error {
+	retrieved, err := r.Backend.Retrieve(key)
+	if err != nil {
+		return fmt.Errorf("cannot retrieve pack %s, %v", key, err)
+	}
+
+	defer r.Backend.Close()
+
+	pack, err := os.Open(retrieved)
+	if err != nil {
+		return err
+	}
+
+	defer pack.Close()
+
+	for _, i := range chunks {
+		chunk, err := readChunk(pack, snap.Chunks[i])
+		if err != nil {
+			return fmt.Errorf("pack %s, %v", key, err)
+		}
+
+		if _, err = out.WriteAt(chunk, positions[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RemoveOlderBackups keeps the most recent snapshots and deletes the old ones
+// with the packs they were the last to reference
+func (r *RepositoryConfig) RemoveOlderBackups(keep int) error {
+	if err := r.Housekeeping(); err != nil {
+		log.Printf("%v\n", err)
+	}
+
+	objects, err := r.List()
+	if err != nil {
+		return fmt.Errorf("cannot list snapshots, %v", err)
+	}
+
+	names := make([]string, len(objects))
+	for i, obj := range objects {
+		names[i] = obj.Name
+	}
+
+	backups := naming.Default().Sort(names)
+	count := len(backups) - keep
+
+	if count <= 0 {
+		return nil
+	}
+
+	names = make([]string, count)
+	for i, backup := range backups[:count] {
+		names[i] = backup.Name
+	}
+
+	return r.Delete(names)
+}
+
+// Housekeeping runs the maintenance of the backend store, if it has any
+func (r *RepositoryConfig) Housekeeping() error {
+	if hk, ok := r.Backend.(Housekeeper); ok {
+		return hk.Housekeeping()
+	}
+
+	return nil
+}
+
+// Delete removes snapshots and collects the packs no longer referenced
+func (r *RepositoryConfig) Delete(names []string) error {
+	idx, err := r.indexer()
+	if err != nil {
+		return err
+	}
+
+	if err = idx.Delete(names); err != nil {
+		return err
+	}
+
+	return r.CollectGarbage()
+}
+
+// CollectGarbage deletes the packs that no snapshot references, like the ones
+// left by interrupted backups
+func (r *RepositoryConfig) CollectGarbage() error {
+	idx, err := r.indexer()
+	if err != nil {
+		return err
+	}
+
+	objects, err := idx.List()
+	if err != nil {
+		return fmt.Errorf("cannot list repository, %v", err)
+	}
+
+	snapshots, err := r.readSnapshots()
+	if err != nil {
+		return fmt.Errorf("cannot read snapshots, %v", err)
+	}
+
+	used := map[string]bool{}
+	for _, snap := range snapshots {
+		for _, ref := range snap.Chunks {
+			used[ref.Pack] = true
+		}
+	}
+
+	var unused []string
+
+	for _, obj := range objects {
+		name := path.Base(obj.Name)
+
+		if strings.HasPrefix(name, packPrefix) && strings.HasSuffix(name, packExt) && !used[name] {
+			unused = append(unused, obj.Name)
+		}
+	}
+
+	if len(unused) > 0 {
+		log.Printf("Removing %d unused packs from the repository\n", len(unused))
+
+		if err = idx.Delete(unused); err != nil {
+			return err
+		}
+	}
+
+	r.rebuildIndex(snapshots)
+
+	return r.saveIndex()
+}
+
+// FindLatestBackup returns the most recent snapshot of the repository
+func (r *RepositoryConfig) FindLatestBackup() (string, error) {
+	objects, err := r.List()
+	if err != nil {
+		return "", fmt.Errorf("cannot list snapshots, %v", err)
+	}
+
+	names := make([]string, len(objects))
+	for i, obj := range objects {
+		names[i] = obj.Name
+	}
+
+	backups := naming.Default().Sort(names)
+	if len(backups) == 0 {
+		return "", fmt.Errorf("cannot find a recent backup on the repository")
+	}
+
+	return backups[len(backups)-1].Name, nil
+}
+
+// readPackHeader returns the chunks listed at the end of a pack
+func readPackHeader(pack *os.File) ([]chunkRef, error) {
+	info, err := pack.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	var size [4]byte
+
+	if info.Size() < 4 {
+		return nil, fmt.Errorf("pack is truncated")
+	}
+
+	if _, err = pack.ReadAt(size[:], info.Size()-4); err != nil {
+		return nil, err
+	}
+
+	length := int64(binary.LittleEndian.Uint32(size[:]))
+	if length > info.Size()-4 {
+		return nil, fmt.Errorf("pack header is truncated")
+	}
+
+	data := make([]byte, length)
+	if _, err = pack.ReadAt(data, info.Size()-4-length); err != nil {
+		return nil, err
+	}
+
+	var header []chunkRef
+	if err = json.Unmarshal(data, &header); err != nil {
+		return nil, fmt.Errorf("invalid pack header, %v", err)
+	}
+
+	return header, nil
+}
+
+// Check verifies that the chunks of every pack match their hash and that the
+// snapshots only reference existing chunks
+func (r *RepositoryConfig) Check() error {
+	idx, err := r.indexer()
+	if err != nil {
+		return err
+	}
+
+	objects, err := idx.List()
+	if err != nil {
+		return fmt.Errorf("cannot list repository, %v", err)
+	}
+
+	var problems []string
+
+	// offsets of the valid chunks of each pack
+	chunks := map[string]map[int64]chunkRef{}
+
+	for _, obj := range objects {
+		name := path.Base(obj.Name)
+		if !strings.HasPrefix(name, packPrefix) || !strings.HasSuffix(name, packExt) {
+			continue
+		}
+
+		valid, err := r.checkPack(obj.Name)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("pack %s: %v", obj.Name, err))
+		}
+
+		chunks[name] = valid
+	}
+
+	snapshots, err := r.readSnapshots()
+	if err != nil {
+		return fmt.Errorf("cannot read snapshots, %v", err)
+	}
+
+	for _, snap := range snapshots {
+		for _, ref := range snap.Chunks {
+			valid, ok := chunks[ref.Pack][ref.Offset]
+
+			if !ok || valid.ID != ref.ID || valid.Length != ref.Length {
+				problems = append(problems, fmt.Sprintf("snapshot %s: chunk %s in pack %s is missing or corrupted", snap.Name, ref.ID, ref.Pack))
+				break
+			}
+		}
+	}
+
+	for _, problem := range problems {
+		log.Println(problem)
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("repository check found %d errors", len(problems))
+	}
+
+	log.Printf("Checked %d snapshots and %d packs\n", len(snapshots), len(chunks))
+
+	return nil
+}
+
+// checkPack returns the chunks of a pack that match their hash
+func (r *RepositoryConfig) checkPack(key string) (map[int64]chunkRef, error) {
+	retrieved, err := r.Backend.Retrieve(key)
+	if err != nil {
+		return nil, err
+	}
+
+	defer r.Backend.Close()
+
+	pack, err := os.Open(retrieved)
+	if err != nil {
+		return nil, err
+	}
+
+	defer pack.Close()
+
+	header, err := readPackHeader(pack)
+	if err != nil {
+		return nil, err
+	}
+
+	valid := map[int64]chunkRef{}
+	var invalid error
+
+	for _, ref := range header {
+		if _, err = readChunk(pack, ref); err != nil {
+			invalid = err
+			continue
+		}
+
+		valid[ref.Offset] = ref
+	}
+
+	return valid, invalid
+}
+
+// Close removes the rebuilt file
+func (r *RepositoryConfig) Close() {
+	if r.retrievedFile != "" {
+		if err := os.Remove(r.retrievedFile); err != nil {
+			log.Printf("Cannot remove file %s\n", r.retrievedFile)
+		}
+
+		r.retrievedFile = ""
+	}
+}
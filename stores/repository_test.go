@@ -0,0 +1,120 @@
+package stores
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRepository(t *testing.T) {
+	r := require.New(t)
+	tmp, err := ioutil.TempDir("", "repository")
+	r.NoError(err, "failed to create temp directory")
+
+	defer os.RemoveAll(tmp)
+
+	storeDir := path.Join(tmp, "store")
+	r.NoError(os.Mkdir(storeDir, 0755))
+
+	repo := &RepositoryConfig{
+		CacheDir:  path.Join(tmp, "cache"),
+		ChunkSize: 4096,
+		PackSize:  64 * 1024,
+		SaveDir:   tmp,
+		Backend:   &housekeepingStore{FilesystemConfig: &FilesystemConfig{SaveDir: storeDir}},
+	}
+	r.NoError(repo.Open(), "failed to open repository")
+
+	first := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(first)
+
+	// a few bytes inserted in the middle only change the chunks around them
+	second := append(append(append([]byte{}, first[:500000]...), []byte("changed")...), first[500000:]...)
+
+	names := []string{"test-backup-20180901000000.bin", "test-backup-20180902000000.bin"}
+
+	for i, data := range [][]byte{first, second} {
+		file := path.Join(tmp, names[i])
+		r.NoError(ioutil.WriteFile(file, data, 0644))
+		r.NoError(repo.Store(file, names[i]), "failed to store backup")
+
+		_, err = os.Stat(file)
+		r.True(os.IsNotExist(err), "source file should be removed")
+	}
+
+	objects, err := repo.List()
+	r.NoError(err)
+	r.Len(objects, 2)
+
+	var unique int64
+	for _, ref := range repo.index {
+		unique += ref.Size
+	}
+	r.True(unique < int64(len(first))+int64(len(first))/10, "only the changed chunks should be added, got %d bytes", unique)
+
+	for i, data := range [][]byte{first, second} {
+		retrieved, err := repo.Retrieve(names[i])
+		r.NoError(err, "failed to retrieve backup")
+
+		actual, err := ioutil.ReadFile(retrieved)
+		r.NoError(err)
+		r.True(bytes.Equal(data, actual), "retrieved backup mismatch")
+
+		repo.Close()
+	}
+
+	r.NoError(repo.Check(), "repository should be valid")
+
+	// the index is rebuilt from the snapshots
+	rebuilt := &RepositoryConfig{ChunkSize: 4096, SaveDir: tmp, Backend: repo.Backend}
+	r.NoError(rebuilt.Open())
+	r.Equal(len(repo.index), len(rebuilt.index))
+
+	packs, err := filepath.Glob(path.Join(storeDir, packPrefix+"*"))
+	r.NoError(err)
+
+	third := make([]byte, 100000)
+	rand.New(rand.NewSource(2)).Read(third)
+
+	file := path.Join(tmp, "test-backup-20180903000000.bin")
+	r.NoError(ioutil.WriteFile(file, third, 0644))
+	r.NoError(repo.Store(file, path.Base(file)), "failed to store backup")
+
+	latest, err := repo.FindLatestBackup()
+	r.NoError(err)
+	r.Equal(path.Base(file)+snapshotExt, latest)
+
+	r.NoError(repo.RemoveOlderBackups(1), "failed to remove old backups")
+	r.Equal(1, repo.Backend.(*housekeepingStore).runs, "backend housekeeping was not run")
+
+	objects, err = repo.List()
+	r.NoError(err)
+	r.Len(objects, 1)
+
+	remaining, err := filepath.Glob(path.Join(storeDir, packPrefix+"*"))
+	r.NoError(err)
+	r.True(len(remaining) < len(packs), "packs only used by removed backups should be deleted")
+
+	retrieved, err := repo.Retrieve(latest)
+	r.NoError(err, "failed to retrieve backup after garbage collection")
+
+	actual, err := ioutil.ReadFile(retrieved)
+	r.NoError(err)
+	r.True(bytes.Equal(third, actual), "retrieved backup mismatch")
+	repo.Close()
+
+	// corrupt a chunk of a pack
+	pack, err := os.OpenFile(remaining[0], os.O_RDWR, 0)
+	r.NoError(err)
+	_, err = pack.WriteAt([]byte("corrupted"), 100)
+	r.NoError(err)
+	r.NoError(pack.Close())
+
+	r.Error(repo.Check(), "corrupted pack should be detected")
+}
@@ -6,6 +6,7 @@ import (
 	"path"
 	"sort"
 	"strings"
+	"time"
 
 	"log"
 
@@ -15,18 +16,24 @@ import (
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 
 	"github.com/caarlos0/env"
+	"github.com/sbusso/autobackup/naming"
 )
 
 // S3Config has the config options for the S3 service
 type S3Config struct {
-	Endpoint        string `env:"S3_ENDPOINT"`
-	Region          string `env:"S3_REGION"`
-	Bucket          string `env:"S3_BUCKET"`
-	Prefix          string `env:"S3_PREFIX"`
-	ForcePathStyle  bool   `env:"S3_FORCE_PATH_STYLE" envDefault:"false"`
-	KeepAfterUpload bool   `env:"KEEP_AFTER_UPLOAD" envDefault:"false"`
-	SaveDir         string `env:"SAVEDIR" envDefault:"/tmp/"`
-	retrievedFile   string `env:"RETRIEVED_FILE"`
+	Endpoint        string        `env:"S3_ENDPOINT"`
+	Region          string        `env:"S3_REGION"`
+	Bucket          string        `env:"S3_BUCKET"`
+	Prefix          string        `env:"S3_PREFIX"`
+	ForcePathStyle  bool          `env:"S3_FORCE_PATH_STYLE" envDefault:"false"`
+	KeepAfterUpload bool          `env:"KEEP_AFTER_UPLOAD" envDefault:"false"`
+	SaveDir         string        `env:"SAVEDIR" envDefault:"/tmp/"`
+	PartSize        int64         `env:"S3_PART_SIZE" envDefault:"5242880"`
+	Concurrency     int           `env:"S3_CONCURRENCY" envDefault:"5"`
+	RateLimit       string        `env:"S3_RATE_LIMIT"`
+	StaleUploadAge  time.Duration `env:"S3_STALE_UPLOAD_AGE" envDefault:"24h"`
+	Partition       bool          `env:"S3_PARTITION" envDefault:"false"`
+	retrievedFile   string        `env:"RETRIEVED_FILE"`
 }
 
 func NewS3Config() (*S3Config, error) {
@@ -35,6 +42,11 @@ func NewS3Config() (*S3Config, error) {
 	if err != nil {
 		return nil, err
 	}
+
+	if _, err = ParseRateLimit(cfg.RateLimit); err != nil {
+		return nil, fmt.Errorf("invalid S3_RATE_LIMIT: %v", err)
+	}
+
 	return cfg, nil
 }
 
@@ -48,33 +60,88 @@ func (s *S3Config) newSession() *session.Session {
 	return session.Must(session.NewSession(config))
 }
 
-// Store saves a file to a remote S3 service
+func (s *S3Config) newThrottle() (*throttle, error) {
+	if s.RateLimit == "" {
+		return nil, nil
+	}
+
+	limit, err := ParseRateLimit(s.RateLimit)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rate limit %q, %v", s.RateLimit, err)
+	}
+
+	return newThrottle(limit), nil
+}
+
+// uploaderOptions applies the part size and concurrency to the uploader
+func (s *S3Config) uploaderOptions(u *s3manager.Uploader) {
+	if s.PartSize > 0 {
+		u.PartSize = s.PartSize
+	}
+
+	if s.Concurrency > 0 {
+		u.Concurrency = s.Concurrency
+	}
+}
+
+// Store saves a file to a remote S3 service, files bigger than the part size
+// are sent with a multipart upload that can be resumed if interrupted
 func (s *S3Config) Store(filepath string, filename string) error {
-	uploader := s3manager.NewUploader(s.newSession())
+	svc := s3.New(s.newSession())
 
-	f, err := os.Open(filepath)
+	t, err := s.newThrottle()
+	if err != nil {
+		return err
+	}
+
+	s.resumePendingUploads(svc, t, filepath)
+
+	info, err := os.Stat(filepath)
 	if err != nil {
 		return fmt.Errorf("failed to open file %q, %v", filepath, err)
 	}
 
-	defer f.Close()
+	key := s.Key(filename)
 
-	if !s.KeepAfterUpload {
-		defer func() {
-			log.Printf("Removing source file %s\n", filepath)
-			if err = os.Remove(filepath); err != nil {
-				log.Printf("Cannot remove file %s, %v\n", filepath, err)
-			}
-		}()
+	if info.Size() > s.partSize() {
+		err = s.multipartUpload(svc, t, filepath, key)
+	} else {
+		err = s.upload(t, filepath, key)
+	}
+
+	if err != nil {
+		return err
 	}
 
-	key := path.Clean(path.Join(s.Prefix, filename))
+	s.removeSource(filepath)
+
+	return nil
+}
+
+// Key returns the object key of a stored file
+func (s *S3Config) Key(filename string) string {
+	if s.Partition {
+		return path.Clean(path.Join(s.Prefix, partitionDir(filename), filename))
+	}
+
+	return path.Clean(path.Join(s.Prefix, filename))
+}
+
+func (s *S3Config) upload(t *throttle, filepath string, key string) error {
+	uploader := s3manager.NewUploader(s.newSession(), s.uploaderOptions)
+
+	f, err := os.Open(filepath)
+	if err != nil {
+		return fmt.Errorf("failed to open file %q, %v", filepath, err)
+	}
+
+	defer f.Close()
 
 	// Upload the file to S3.
 	res, err := uploader.Upload(&s3manager.UploadInput{
 		Bucket: aws.String(s.Bucket),
 		Key:    aws.String(key),
-		Body:   f,
+		Body:   &throttledFile{f: f, t: t},
 	})
 	if err != nil {
 		return fmt.Errorf("failed to upload file, %v", err)
@@ -85,45 +152,155 @@ func (s *S3Config) Store(filepath string, filename string) error {
 	return nil
 }
 
-func (s *S3Config) getFileListing(svc *s3.S3) ([]string, error) {
-	var files []string
+// removeSource deletes the local file after a successful upload
+func (s *S3Config) removeSource(filepath string) {
+	if s.KeepAfterUpload {
+		return
+	}
+
+	log.Printf("Removing source file %s\n", filepath)
+	if err := os.Remove(filepath); err != nil {
+		log.Printf("Cannot remove file %s, %v\n", filepath, err)
+	}
+}
+
+// listPrefix returns the prefix used to list the objects, it always ends with "/"
+func (s *S3Config) listPrefix() string {
+	return path.Clean(s.Prefix) + "/"
+}
+
+func (s *S3Config) getFileListing(svc *s3.S3, prefix string) ([]string, error) {
+	objects, err := s.getObjectListing(svc, prefix)
+
+	files := make([]string, len(objects))
+	for i, obj := range objects {
+		files[i] = obj.Name
+	}
+
+	return files, err
+}
+
+func (s *S3Config) getObjectListing(svc *s3.S3, prefix string) ([]Object, error) {
+	var objects []Object
 
 	err := svc.ListObjectsPages(&s3.ListObjectsInput{
 		Bucket: aws.String(s.Bucket),
-		// make sure that the prefix ends with "/"
-		Prefix: aws.String(path.Clean(s.Prefix) + "/"),
+		Prefix: aws.String(prefix),
 	}, func(p *s3.ListObjectsOutput, last bool) (shouldContinue bool) {
 
 		for _, obj := range p.Contents {
 			if !strings.HasSuffix(*obj.Key, "/") {
-				files = append(files, aws.StringValue(obj.Key))
+				objects = append(objects, Object{
+					Name: aws.StringValue(obj.Key),
+					Size: aws.Int64Value(obj.Size),
+				})
 			}
 		}
 		return true
 	})
 
-	return files, err
+	return objects, err
+}
+
+// List returns all the objects under the prefix
+func (s *S3Config) List() ([]Object, error) {
+	return s.getObjectListing(s3.New(s.newSession()), s.listPrefix())
+}
+
+// getLatestPartition descends the YYYY/MM/DD partitions choosing the most
+// recent one at each level, so only the last day needs to be listed
+func (s *S3Config) getLatestPartition(svc *s3.S3) (string, error) {
+	prefix := s.listPrefix()
+
+	for level := 0; level < 3; level++ {
+		var dirs []string
+
+		err := svc.ListObjectsPages(&s3.ListObjectsInput{
+			Bucket:    aws.String(s.Bucket),
+			Prefix:    aws.String(prefix),
+			Delimiter: aws.String("/"),
+		}, func(p *s3.ListObjectsOutput, last bool) bool {
+			for _, dir := range p.CommonPrefixes {
+				dirs = append(dirs, aws.StringValue(dir.Prefix))
+			}
+			return true
+		})
+
+		if err != nil {
+			return "", err
+		}
+
+		if len(dirs) == 0 {
+			return "", nil
+		}
+
+		// zero padded numbers sort lexically
+		sort.Strings(dirs)
+		prefix = dirs[len(dirs)-1]
+	}
+
+	return prefix, nil
 }
 
-// RemoveOlderBackups keeps the most recent backups of the S3 service and deletes the old ones
+// Housekeeping aborts the stale multipart uploads left by interrupted backups
+func (s *S3Config) Housekeeping() error {
+	if err := s.abortStaleUploads(s3.New(s.newSession())); err != nil {
+		return fmt.Errorf("cannot abort stale multipart uploads, %v", err)
+	}
+
+	return nil
+}
+
+// RemoveOlderBackups keeps the most recent backups of the S3 service and deletes the old ones,
+// it also aborts the stale multipart uploads left by interrupted backups
 func (s *S3Config) RemoveOlderBackups(keep int) error {
+	if err := s.Housekeeping(); err != nil {
+		log.Printf("%v\n", err)
+	}
+
 	svc := s3.New(s.newSession())
 
-	files, err := s.getFileListing(svc)
+	files, err := s.getFileListing(svc, s.listPrefix())
 	if err != nil {
 		return fmt.Errorf("couldn't list S3 objects, %v", err)
 	}
 
-	sort.Strings(files)
-	count := len(files) - keep
+	backups := naming.Default().Sort(files)
+	count := len(backups) - keep
 
 	if count > 0 {
+		names := make([]string, count)
+		for i, backup := range backups[:count] {
+			names[i] = backup.Name
+		}
+
+		return s.deleteObjects(svc, names)
+	}
+
+	return nil
+}
+
+// Delete removes the specified objects from the bucket
+func (s *S3Config) Delete(names []string) error {
+	return s.deleteObjects(s3.New(s.newSession()), names)
+}
+
+func (s *S3Config) deleteObjects(svc *s3.S3, names []string) error {
+	deleted := 0
+
+	// DeleteObjects accepts up to 1000 keys per request
+	for start := 0; start < len(names); start += 1000 {
+		end := start + 1000
+		if end > len(names) {
+			end = len(names)
+		}
+
 		var items s3.Delete
-		var objs = make([]*s3.ObjectIdentifier, count)
+		var objs []*s3.ObjectIdentifier
 
-		for i, file := range files[:count] {
-			objs[i] = &s3.ObjectIdentifier{Key: aws.String(file)}
-			log.Printf("Marked to delete: s3://%s/%s\n", s.Bucket, file)
+		for _, name := range names[start:end] {
+			objs = append(objs, &s3.ObjectIdentifier{Key: aws.String(name)})
+			log.Printf("Marked to delete: s3://%s/%s\n", s.Bucket, name)
 		}
 
 		items.SetObjects(objs)
@@ -136,51 +313,57 @@ func (s *S3Config) RemoveOlderBackups(keep int) error {
 			return fmt.Errorf("couldn't delete the S3 objects, %v", err)
 		}
 
-		log.Printf("Deleted %d objects from S3\n", len(out.Deleted))
+		deleted += len(out.Deleted)
 	}
 
+	log.Printf("Deleted %d objects from S3\n", deleted)
+
 	return nil
 }
 
 // FindLatestBackup returns the most recent backup of the S3 store
 func (s *S3Config) FindLatestBackup() (string, error) {
 	svc := s3.New(s.newSession())
+	prefix := s.listPrefix()
+
+	if s.Partition {
+		latest, err := s.getLatestPartition(svc)
+		if err != nil {
+			return "", fmt.Errorf("couldn't list S3 partitions, %v", err)
+		}
 
-	files, err := s.getFileListing(svc)
+		if latest != "" {
+			prefix = latest
+		}
+	}
+
+	files, err := s.getFileListing(svc, prefix)
 	if err != nil {
 		return "", fmt.Errorf("couldn't list S3 objects, %v", err)
 	}
 
-	if len(files) == 0 {
+	backups := naming.Default().Sort(files)
+	if len(backups) == 0 {
 		return "", fmt.Errorf("cannot find a recent backup on s3://%s/%s",
 			s.Bucket, s.Prefix)
 	}
 
-	sort.Sort(sort.Reverse(sort.StringSlice(files)))
-
-	return files[0], nil
+	return backups[len(backups)-1].Name, nil
 }
 
-// Retrieve downloads a S3 object to the local filesystem
+// Retrieve downloads a S3 object to the local filesystem, resuming a
+// previous partial download of the same object
 func (s *S3Config) Retrieve(s3path string) (string, error) {
-	// Create an uploader with the session and default options
-	downloader := s3manager.NewDownloader(s.newSession())
+	svc := s3.New(s.newSession())
 
-	filepath := path.Join(s.SaveDir, path.Base(s3path))
-	f, err := os.Create(filepath)
+	t, err := s.newThrottle()
 	if err != nil {
-		return "", fmt.Errorf("failed to open file: %v", err)
+		return "", err
 	}
 
-	defer f.Close()
-
-	// download the file from S3.
-	_, err = downloader.Download(f, &s3.GetObjectInput{
-		Bucket: aws.String(s.Bucket),
-		Key:    aws.String(s3path),
-	})
+	filepath := path.Join(s.SaveDir, path.Base(s3path))
 
-	if err != nil {
+	if err = s.resumableDownload(svc, t, s3path, filepath); err != nil {
 		return "", fmt.Errorf("failed to download S3 object, %v", err)
 	}
 
@@ -0,0 +1,519 @@
+package stores
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"log"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	uploadStateExt   = ".s3upload"
+	downloadPartExt  = ".part"
+	downloadStateExt = ".part.json"
+)
+
+// uploadState is persisted while a multipart upload is in progress so it can
+// be resumed after a restart
+type uploadState struct {
+	Source   string
+	Bucket   string
+	Key      string
+	UploadID string
+	Size     int64
+	ModTime  time.Time
+	PartSize int64
+	Parts    map[int64]string
+}
+
+// downloadState is persisted while a download is in progress, Completed is
+// the number of contiguous bytes already written to the partial file
+type downloadState struct {
+	Bucket    string
+	Key       string
+	ETag      string
+	Size      int64
+	Completed int64
+}
+
+func readState(filename string, v interface{}) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+func writeState(filename string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	tmp := filename + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filename)
+}
+
+func (s *S3Config) partSize() int64 {
+	if s.PartSize > 0 {
+		return s.PartSize
+	}
+
+	return 5 * 1024 * 1024
+}
+
+func (s *S3Config) concurrency() int {
+	if s.Concurrency > 0 {
+		return s.Concurrency
+	}
+
+	return 1
+}
+
+func (s *S3Config) uploadStatePath(filepath string) string {
+	return path.Join(s.SaveDir, path.Base(filepath)+uploadStateExt)
+}
+
+// pendingUploads returns the persisted state of the interrupted uploads
+func (s *S3Config) pendingUploads() []*uploadState {
+	matches, err := filepath.Glob(path.Join(s.SaveDir, "*"+uploadStateExt))
+	if err != nil {
+		return nil
+	}
+
+	var states []*uploadState
+
+	for _, match := range matches {
+		state := &uploadState{}
+		if err := readState(match, state); err != nil {
+			log.Printf("Ignoring unreadable upload state %s, %v\n", match, err)
+			continue
+		}
+
+		states = append(states, state)
+	}
+
+	return states
+}
+
+// resumePendingUploads finishes the uploads interrupted by a previous run,
+// skipping the file about to be uploaded
+func (s *S3Config) resumePendingUploads(svc *s3.S3, t *throttle, current string) {
+	for _, state := range s.pendingUploads() {
+		if state.Source == current || state.Bucket != s.Bucket {
+			continue
+		}
+
+		if _, err := os.Stat(state.Source); err != nil {
+			log.Printf("Source file %s of interrupted upload is gone, discarding state\n", state.Source)
+			os.Remove(s.uploadStatePath(state.Source))
+			continue
+		}
+
+		log.Printf("Resuming interrupted upload of %s\n", state.Source)
+
+		if err := s.multipartUpload(svc, t, state.Source, state.Key); err != nil {
+			log.Printf("Cannot resume upload of %s, %v\n", state.Source, err)
+			continue
+		}
+
+		s.removeSource(state.Source)
+	}
+}
+
+// loadUploadState returns the saved state of an upload if it still matches
+// the source file and the upload exists on the server
+func (s *S3Config) loadUploadState(svc *s3.S3, filepath, key string, info os.FileInfo) *uploadState {
+	state := &uploadState{}
+	if err := readState(s.uploadStatePath(filepath), state); err != nil {
+		return nil
+	}
+
+	if state.Bucket != s.Bucket || state.Key != key || state.Size != info.Size() ||
+		!state.ModTime.Equal(info.ModTime()) || state.PartSize != s.partSize() {
+		log.Printf("Upload state of %s is outdated, starting over\n", filepath)
+		s.abortUpload(svc, state.Key, state.UploadID)
+		return nil
+	}
+
+	// trust the server about the parts that were completed
+	parts := make(map[int64]string)
+	err := svc.ListPartsPages(&s3.ListPartsInput{
+		Bucket:   aws.String(s.Bucket),
+		Key:      aws.String(key),
+		UploadId: aws.String(state.UploadID),
+	}, func(p *s3.ListPartsOutput, last bool) bool {
+		for _, part := range p.Parts {
+			parts[aws.Int64Value(part.PartNumber)] = aws.StringValue(part.ETag)
+		}
+		return true
+	})
+
+	if err != nil {
+		log.Printf("Cannot resume upload %s, %v\n", state.UploadID, err)
+		return nil
+	}
+
+	state.Parts = parts
+	log.Printf("Resuming upload of %s, %d parts already uploaded\n", filepath, len(parts))
+
+	return state
+}
+
+// multipartUpload uploads a file in parts, saving the progress after each
+// part so an interrupted upload can continue where it stopped
+func (s *S3Config) multipartUpload(svc *s3.S3, t *throttle, filepath, key string) error {
+	f, err := os.Open(filepath)
+	if err != nil {
+		return fmt.Errorf("failed to open file %q, %v", filepath, err)
+	}
+
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("cannot stat file %q, %v", filepath, err)
+	}
+
+	statePath := s.uploadStatePath(filepath)
+	state := s.loadUploadState(svc, filepath, key, info)
+
+	if state == nil {
+		out, err := svc.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+			Bucket: aws.String(s.Bucket),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			return fmt.Errorf("cannot create multipart upload, %v", err)
+		}
+
+		state = &uploadState{
+			Source:   filepath,
+			Bucket:   s.Bucket,
+			Key:      key,
+			UploadID: aws.StringValue(out.UploadId),
+			Size:     info.Size(),
+			ModTime:  info.ModTime(),
+			PartSize: s.partSize(),
+			Parts:    make(map[int64]string),
+		}
+	}
+
+	if err = writeState(statePath, state); err != nil {
+		return fmt.Errorf("cannot save upload state, %v", err)
+	}
+
+	count := (state.Size + state.PartSize - 1) / state.PartSize
+	pending := make(chan int64, count)
+
+	for n := int64(1); n <= count; n++ {
+		if _, ok := state.Parts[n]; !ok {
+			pending <- n
+		}
+	}
+
+	close(pending)
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var uploadErr error
+
+	for i := 0; i < s.concurrency(); i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for n := range pending {
+				offset := (n - 1) * state.PartSize
+				size := state.PartSize
+				if offset+size > state.Size {
+					size = state.Size - offset
+				}
+
+				out, err := svc.UploadPart(&s3.UploadPartInput{
+					Bucket:     aws.String(s.Bucket),
+					Key:        aws.String(key),
+					UploadId:   aws.String(state.UploadID),
+					PartNumber: aws.Int64(n),
+					Body:       &throttledFile{f: io.NewSectionReader(f, offset, size), t: t},
+				})
+
+				mu.Lock()
+				if err != nil {
+					if uploadErr == nil {
+						uploadErr = fmt.Errorf("failed to upload part %d, %v", n, err)
+					}
+				} else {
+					state.Parts[n] = aws.StringValue(out.ETag)
+					if err = writeState(statePath, state); err != nil {
+						log.Printf("Cannot save upload state, %v\n", err)
+					}
+				}
+				failed := uploadErr != nil
+				mu.Unlock()
+
+				if failed {
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if uploadErr != nil {
+		return uploadErr
+	}
+
+	completed := make([]*s3.CompletedPart, 0, len(state.Parts))
+	for n, etag := range state.Parts {
+		completed = append(completed, &s3.CompletedPart{PartNumber: aws.Int64(n), ETag: aws.String(etag)})
+	}
+
+	sort.Slice(completed, func(i, j int) bool {
+		return aws.Int64Value(completed[i].PartNumber) < aws.Int64Value(completed[j].PartNumber)
+	})
+
+	_, err = svc.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.Bucket),
+		Key:             aws.String(key),
+		UploadId:        aws.String(state.UploadID),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: completed},
+	})
+	if err != nil {
+		return fmt.Errorf("cannot complete multipart upload, %v", err)
+	}
+
+	if err = os.Remove(statePath); err != nil {
+		log.Printf("Cannot remove upload state %s, %v\n", statePath, err)
+	}
+
+	log.Printf("File uploaded to s3://%s/%s\n", s.Bucket, key)
+
+	return nil
+}
+
+func (s *S3Config) abortUpload(svc *s3.S3, key, uploadID string) {
+	_, err := svc.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(s.Bucket),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadID),
+	})
+
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != s3.ErrCodeNoSuchUpload {
+			log.Printf("Cannot abort multipart upload %s, %v\n", uploadID, err)
+		}
+	}
+}
+
+// abortStaleUploads aborts the multipart uploads older than StaleUploadAge
+// that cannot be resumed from this host
+func (s *S3Config) abortStaleUploads(svc *s3.S3) error {
+	active := make(map[string]bool)
+	for _, state := range s.pendingUploads() {
+		active[state.UploadID] = true
+	}
+
+	var stale []*s3.MultipartUpload
+
+	err := svc.ListMultipartUploadsPages(&s3.ListMultipartUploadsInput{
+		Bucket: aws.String(s.Bucket),
+		Prefix: aws.String(path.Clean(s.Prefix) + "/"),
+	}, func(p *s3.ListMultipartUploadsOutput, last bool) bool {
+		for _, upload := range p.Uploads {
+			if active[aws.StringValue(upload.UploadId)] {
+				continue
+			}
+
+			if time.Since(aws.TimeValue(upload.Initiated)) > s.StaleUploadAge {
+				stale = append(stale, upload)
+			}
+		}
+		return true
+	})
+
+	if err != nil {
+		return fmt.Errorf("couldn't list multipart uploads, %v", err)
+	}
+
+	for _, upload := range stale {
+		log.Printf("Aborting stale multipart upload of s3://%s/%s\n", s.Bucket, aws.StringValue(upload.Key))
+		s.abortUpload(svc, aws.StringValue(upload.Key), aws.StringValue(upload.UploadId))
+	}
+
+	return nil
+}
+
+// offsetWriter writes sequentially from an offset of a WriterAt
+type offsetWriter struct {
+	w      io.WriterAt
+	offset int64
+}
+
+func (o *offsetWriter) Write(p []byte) (int, error) {
+	n, err := o.w.WriteAt(p, o.offset)
+	o.offset += int64(n)
+	return n, err
+}
+
+// resumableDownload downloads an object using ranged requests into a partial
+// file, saving the progress so an interrupted download can continue
+func (s *S3Config) resumableDownload(svc *s3.S3, t *throttle, key, filepath string) error {
+	head, err := svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("cannot get S3 object info, %v", err)
+	}
+
+	partial := filepath + downloadPartExt
+	statePath := filepath + downloadStateExt
+
+	state := &downloadState{}
+	err = readState(statePath, state)
+
+	if err == nil && state.Bucket == s.Bucket && state.Key == key &&
+		state.ETag == aws.StringValue(head.ETag) && state.Size == aws.Int64Value(head.ContentLength) {
+		log.Printf("Resuming download of %s from byte %d\n", key, state.Completed)
+	} else {
+		state = &downloadState{
+			Bucket: s.Bucket,
+			Key:    key,
+			ETag:   aws.StringValue(head.ETag),
+			Size:   aws.Int64Value(head.ContentLength),
+		}
+	}
+
+	f, err := os.OpenFile(partial, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %v", err)
+	}
+
+	defer f.Close()
+
+	if info, err := f.Stat(); err != nil || info.Size() < state.Completed {
+		log.Printf("Partial file %s is missing data, starting over\n", partial)
+		state.Completed = 0
+	}
+
+	if err = writeState(statePath, state); err != nil {
+		return fmt.Errorf("cannot save download state, %v", err)
+	}
+
+	type chunk struct {
+		start, end int64
+	}
+
+	pending := make(chan chunk, s.concurrency())
+	partSize := s.partSize()
+
+	go func() {
+		for start := state.Completed; start < state.Size; start += partSize {
+			end := start + partSize - 1
+			if end >= state.Size {
+				end = state.Size - 1
+			}
+
+			pending <- chunk{start, end}
+		}
+
+		close(pending)
+	}()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var downloadErr error
+	done := make(map[int64]int64)
+
+	for i := 0; i < s.concurrency(); i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for c := range pending {
+				mu.Lock()
+				failed := downloadErr != nil
+				mu.Unlock()
+
+				if failed {
+					continue
+				}
+
+				out, err := svc.GetObject(&s3.GetObjectInput{
+					Bucket:  aws.String(s.Bucket),
+					Key:     aws.String(key),
+					Range:   aws.String(fmt.Sprintf("bytes=%d-%d", c.start, c.end)),
+					IfMatch: aws.String(state.ETag),
+				})
+
+				if err == nil {
+					w := &offsetWriter{w: &throttledWriterAt{w: f, t: t}, offset: c.start}
+					_, err = io.Copy(w, out.Body)
+					out.Body.Close()
+				}
+
+				mu.Lock()
+				if err != nil {
+					if downloadErr == nil {
+						downloadErr = fmt.Errorf("failed to download range %d-%d, %v", c.start, c.end, err)
+					}
+				} else {
+					// only the contiguous part of the file can be resumed
+					done[c.start] = c.end + 1
+					for next, ok := done[state.Completed]; ok; next, ok = done[state.Completed] {
+						delete(done, state.Completed)
+						state.Completed = next
+					}
+
+					if err = writeState(statePath, state); err != nil {
+						log.Printf("Cannot save download state, %v\n", err)
+					}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if downloadErr != nil {
+		return downloadErr
+	}
+
+	if err = f.Truncate(state.Size); err != nil {
+		return fmt.Errorf("cannot truncate downloaded file, %v", err)
+	}
+
+	if err = f.Close(); err != nil {
+		return fmt.Errorf("cannot close downloaded file, %v", err)
+	}
+
+	if err = os.Rename(partial, filepath); err != nil {
+		return fmt.Errorf("cannot rename downloaded file, %v", err)
+	}
+
+	os.Remove(statePath)
+
+	return nil
+}
@@ -0,0 +1,259 @@
+package stores
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newFakeS3 starts a S3 server answering with handler and returns a store
+// using it with parts of 30 bytes, call the returned function to stop it
+func newFakeS3(tmp string, handler http.HandlerFunc) (*S3Config, func()) {
+	server := httptest.NewServer(handler)
+
+	os.Setenv("AWS_ACCESS_KEY_ID", "test")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+
+	s := &S3Config{
+		Endpoint:       server.URL,
+		Region:         "us-east-1",
+		Bucket:         "backups",
+		ForcePathStyle: true,
+		SaveDir:        tmp,
+		PartSize:       30,
+		Concurrency:    2,
+	}
+
+	return s, func() {
+		server.Close()
+		os.Unsetenv("AWS_ACCESS_KEY_ID")
+		os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+	}
+}
+
+// hasParam tells if the subresource name is in the query, like "?uploads"
+func hasParam(query url.Values, name string) bool {
+	_, ok := query[name]
+	return ok
+}
+
+func TestResumeDownload(t *testing.T) {
+	r := require.New(t)
+	tmp, err := ioutil.TempDir("", "s3")
+	r.NoError(err, "failed to create temp directory")
+
+	defer os.RemoveAll(tmp)
+
+	content := []byte(strings.Repeat("0123456789", 10))
+	var mu sync.Mutex
+	var ranges []string
+
+	s, stop := newFakeS3(tmp, func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("ETag", `"abc"`)
+
+		if req.Method == http.MethodHead {
+			w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+			return
+		}
+
+		var start, end int
+		fmt.Sscanf(req.Header.Get("Range"), "bytes=%d-%d", &start, &end)
+
+		mu.Lock()
+		ranges = append(ranges, req.Header.Get("Range"))
+		mu.Unlock()
+
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(content)))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(content[start : end+1])
+	})
+
+	defer stop()
+
+	// simulate a download interrupted after 40 bytes
+	filepath := path.Join(tmp, "test.tar.gz")
+	err = ioutil.WriteFile(filepath+downloadPartExt, content[:40], 0600)
+	r.NoError(err, "failed to create partial file")
+
+	err = writeState(filepath+downloadStateExt, &downloadState{
+		Bucket:    "backups",
+		Key:       "test.tar.gz",
+		ETag:      `"abc"`,
+		Size:      int64(len(content)),
+		Completed: 40,
+	})
+	r.NoError(err, "failed to create download state")
+
+	downloaded, err := s.Retrieve("test.tar.gz")
+	r.NoError(err, "failed to retrieve file")
+	r.Equal(filepath, downloaded)
+
+	actual, err := ioutil.ReadFile(downloaded)
+	r.NoError(err, "failed to read downloaded file")
+	r.Equal(content, actual, "downloaded contents mismatch")
+
+	r.ElementsMatch([]string{"bytes=40-69", "bytes=70-99"}, ranges)
+
+	_, err = os.Stat(filepath + downloadStateExt)
+	r.True(os.IsNotExist(err), "download state was not removed")
+}
+
+func TestResumeUpload(t *testing.T) {
+	r := require.New(t)
+	tmp, err := ioutil.TempDir("", "s3")
+	r.NoError(err, "failed to create temp directory")
+
+	defer os.RemoveAll(tmp)
+
+	content := []byte(strings.Repeat("0123456789", 10))
+	var mu sync.Mutex
+	var uploaded []string
+	var completed struct {
+		Parts []int64 `xml:"Part>PartNumber"`
+	}
+
+	s, stop := newFakeS3(tmp, func(w http.ResponseWriter, req *http.Request) {
+		query := req.URL.Query()
+
+		switch {
+		case query.Get("uploadId") != "upload-1":
+			w.WriteHeader(http.StatusNotFound)
+		case req.Method == http.MethodGet:
+			// the server completed part 3 after the state was last saved
+			fmt.Fprint(w, `<ListPartsResult><IsTruncated>false</IsTruncated>`+
+				`<Part><PartNumber>1</PartNumber><ETag>"part-1"</ETag></Part>`+
+				`<Part><PartNumber>3</PartNumber><ETag>"part-3"</ETag></Part>`+
+				`</ListPartsResult>`)
+		case req.Method == http.MethodPut:
+			body, _ := ioutil.ReadAll(req.Body)
+
+			mu.Lock()
+			uploaded = append(uploaded, query.Get("partNumber")+":"+string(body))
+			mu.Unlock()
+
+			w.Header().Set("ETag", `"part-`+query.Get("partNumber")+`"`)
+		case req.Method == http.MethodPost:
+			xml.NewDecoder(req.Body).Decode(&completed)
+			fmt.Fprint(w, `<CompleteMultipartUploadResult></CompleteMultipartUploadResult>`)
+		default:
+			w.WriteHeader(http.StatusNotImplemented)
+		}
+	})
+
+	defer stop()
+
+	filename := "test-backup-20180901000000.tar.gz"
+	filepath := path.Join(tmp, filename)
+	r.NoError(ioutil.WriteFile(filepath, content, 0600), "failed to create backup")
+
+	info, err := os.Stat(filepath)
+	r.NoError(err)
+
+	// simulate an upload interrupted after the first part
+	err = writeState(s.uploadStatePath(filepath), &uploadState{
+		Source:   filepath,
+		Bucket:   "backups",
+		Key:      filename,
+		UploadID: "upload-1",
+		Size:     info.Size(),
+		ModTime:  info.ModTime(),
+		PartSize: 30,
+		Parts:    map[int64]string{1: `"part-1"`},
+	})
+	r.NoError(err, "failed to create upload state")
+
+	r.NoError(s.Store(filepath, filename), "failed to store file")
+
+	r.ElementsMatch([]string{"2:" + string(content[30:60]), "4:" + string(content[90:])}, uploaded)
+	r.Equal([]int64{1, 2, 3, 4}, completed.Parts)
+
+	_, err = os.Stat(s.uploadStatePath(filepath))
+	r.True(os.IsNotExist(err), "upload state was not removed")
+
+	_, err = os.Stat(filepath)
+	r.True(os.IsNotExist(err), "source file was not removed")
+}
+
+func TestRemoveOlderBackupsAbortsStaleUploads(t *testing.T) {
+	r := require.New(t)
+	tmp, err := ioutil.TempDir("", "s3")
+	r.NoError(err, "failed to create temp directory")
+
+	defer os.RemoveAll(tmp)
+
+	old := time.Now().Add(-48 * time.Hour).UTC().Format(time.RFC3339)
+	recent := time.Now().UTC().Format(time.RFC3339)
+
+	var mu sync.Mutex
+	var aborted []string
+	var uploadsPrefix string
+	var deleted struct {
+		Keys []string `xml:"Object>Key"`
+	}
+
+	s, stop := newFakeS3(tmp, func(w http.ResponseWriter, req *http.Request) {
+		query := req.URL.Query()
+
+		switch {
+		case req.Method == http.MethodGet && hasParam(query, "uploads"):
+			mu.Lock()
+			uploadsPrefix = query.Get("prefix")
+			mu.Unlock()
+
+			fmt.Fprint(w, `<ListMultipartUploadsResult><IsTruncated>false</IsTruncated>`+
+				`<Upload><Key>db/stale.tar.gz</Key><UploadId>stale</UploadId><Initiated>`+old+`</Initiated></Upload>`+
+				`<Upload><Key>db/resumable.tar.gz</Key><UploadId>resumable</UploadId><Initiated>`+old+`</Initiated></Upload>`+
+				`<Upload><Key>db/running.tar.gz</Key><UploadId>running</UploadId><Initiated>`+recent+`</Initiated></Upload>`+
+				`</ListMultipartUploadsResult>`)
+		case req.Method == http.MethodDelete:
+			mu.Lock()
+			aborted = append(aborted, query.Get("uploadId"))
+			mu.Unlock()
+
+			w.WriteHeader(http.StatusNoContent)
+		case req.Method == http.MethodGet:
+			fmt.Fprint(w, `<ListBucketResult><IsTruncated>false</IsTruncated>`+
+				`<Contents><Key>db/test-backup-20180901000000.tar.gz</Key><Size>1</Size></Contents>`+
+				`<Contents><Key>db/test-backup-20180902000000.tar.gz</Key><Size>1</Size></Contents>`+
+				`<Contents><Key>db/test-backup-20180903000000.tar.gz</Key><Size>1</Size></Contents>`+
+				`</ListBucketResult>`)
+		case req.Method == http.MethodPost && hasParam(query, "delete"):
+			xml.NewDecoder(req.Body).Decode(&deleted)
+			fmt.Fprint(w, `<DeleteResult></DeleteResult>`)
+		default:
+			w.WriteHeader(http.StatusNotImplemented)
+		}
+	})
+
+	defer stop()
+
+	s.Prefix = "db"
+	s.StaleUploadAge = 24 * time.Hour
+
+	// the upload interrupted on this host can still be resumed
+	source := path.Join(tmp, "resumable.tar.gz")
+	err = writeState(s.uploadStatePath(source), &uploadState{
+		Source:   source,
+		Bucket:   "backups",
+		Key:      "db/resumable.tar.gz",
+		UploadID: "resumable",
+	})
+	r.NoError(err, "failed to create upload state")
+
+	r.NoError(s.RemoveOlderBackups(2), "failed to remove older backups")
+
+	r.Equal("db/", uploadsPrefix)
+	r.Equal([]string{"stale"}, aborted)
+	r.Equal([]string{"db/test-backup-20180901000000.tar.gz"}, deleted.Keys)
+}
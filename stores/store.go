@@ -1,5 +1,9 @@
 package stores
 
+import (
+	"github.com/sbusso/autobackup/naming"
+)
+
 // Storer represents the methods to store/retrieve a backup from another location
 type Store interface {
 	Store(filepath string, filename string) error
@@ -8,3 +12,34 @@ type Store interface {
 	FindLatestBackup() (string, error)
 	Close()
 }
+
+// Housekeeper is implemented by the stores that have maintenance to run along
+// with the retention, so the stores wrapping them can delegate it
+type Housekeeper interface {
+	Housekeeping() error
+}
+
+// Object describes a file saved on a store
+type Object struct {
+	Name string
+	Size int64
+}
+
+// Indexer is implemented by the stores that can be used with a catalog
+type Indexer interface {
+	// Key returns the name of a stored file as returned by List
+	Key(filename string) string
+	List() ([]Object, error)
+	Delete(names []string) error
+}
+
+// partitionDir returns the YYYY/MM/DD directory where a backup is stored,
+// based on the time in its name. Files without time are kept at the root.
+func partitionDir(filename string) string {
+	t, ok := naming.Default().Time(filename)
+	if !ok {
+		return ""
+	}
+
+	return naming.PartitionDir(t)
+}
@@ -0,0 +1,238 @@
+package tasks
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/sbusso/autobackup/sources"
+)
+
+// Stages a hook runs at
+const (
+	PreBackup   = "pre-backup"
+	PostBackup  = "post-backup"
+	PreRestore  = "pre-restore"
+	PostRestore = "post-restore"
+)
+
+// Failure policies of the hooks
+const (
+	// HookAbort fails the task, a failed pre hook prevents the backup or
+	// restore. A failed post backup hook doesn't prevent the upload and the
+	// retention, the task fails once they are done.
+	HookAbort = "abort"
+
+	// HookWarn logs the failure and carries on
+	HookWarn = "warn"
+)
+
+// HookShell points to the shell running the hook commands
+var HookShell = "/bin/sh"
+
+// Hook runs Command with HookShell or Func at a stage of a backup or restore,
+// e.g. to flush caches or pause writes before the backup. Commands get the
+// stage in AUTOBACKUP_HOOK and the error of the backup or restore, if any,
+// in AUTOBACKUP_ERROR; Func gets the error as taskErr and must return once
+// ctx is done.
+type Hook struct {
+	Stage   string
+	Name    string
+	Command string
+	Func    func(ctx context.Context, taskErr error) error
+
+	// Timeout defaults to the HookTimeout of the config
+	Timeout time.Duration
+
+	// OnFailure is HookAbort or HookWarn, the HookFailure of the config by default
+	OnFailure string
+}
+
+var registeredHooks []Hook
+
+// RegisterHook adds a hook to the configs created afterwards by NewConfig, so
+// it also applies to the recipes
+func RegisterHook(hook Hook) {
+	registeredHooks = append(registeredHooks, hook)
+}
+
+func (h Hook) String() string {
+	if h.Name != "" {
+		return h.Name
+	}
+
+	if h.Command != "" {
+		return h.Command
+	}
+
+	return "callback"
+}
+
+// checkHooks rejects unknown failure policies before anything runs, an empty
+// policy aborts
+func (c *Config) checkHooks() error {
+	policies := []string{c.HookFailure}
+	for _, hook := range c.Hooks {
+		policies = append(policies, hook.OnFailure)
+	}
+
+	for _, policy := range policies {
+		if policy != "" && policy != HookAbort && policy != HookWarn {
+			return fmt.Errorf("unknown hook failure policy %q, expected %q or %q", policy, HookAbort, HookWarn)
+		}
+	}
+
+	return nil
+}
+
+// hooks returns the hooks of a stage, the command set in the environment first
+func (c *Config) hooks(stage string) []Hook {
+	commands := map[string]string{
+		PreBackup:   c.PreBackupHook,
+		PostBackup:  c.PostBackupHook,
+		PreRestore:  c.PreRestoreHook,
+		PostRestore: c.PostRestoreHook,
+	}
+
+	var hooks []Hook
+
+	if command := commands[stage]; command != "" {
+		hooks = append(hooks, Hook{Stage: stage, Command: command})
+	}
+
+	for _, hook := range c.Hooks {
+		if hook.Stage == stage {
+			hooks = append(hooks, hook)
+		}
+	}
+
+	return hooks
+}
+
+// withHooks runs fn between the pre and post hooks. The post hooks always run,
+// even when a pre hook aborted or fn failed or panicked, so the applications
+// are resumed. Their failure is returned apart in hookErr, so the task can
+// carry on before reporting it.
+func (c *Config) withHooks(pre, post string, fn func() error) (err, hookErr error) {
+	defer func() {
+		taskErr := err
+
+		p := recover()
+		if p != nil {
+			taskErr = fmt.Errorf("panic: %v", p)
+		}
+
+		hookErr = c.runHooks(post, taskErr)
+
+		if p != nil {
+			panic(p)
+		}
+	}()
+
+	if err = c.runHooks(pre, nil); err != nil {
+		return err, nil
+	}
+
+	return fn(), nil
+}
+
+// hookFailure returns the error of the task, or the failure of its post hooks
+// when it succeeded
+func hookFailure(err, hookErr error) error {
+	if hookErr == nil {
+		return err
+	}
+
+	if err == nil {
+		return hookErr
+	}
+
+	log.Printf("Also failed: %v\n", hookErr)
+
+	return err
+}
+
+// runHooks runs the hooks of a stage in order. Pre hooks stop at the first
+// aborting failure, every post hook runs and the first aborting failure is
+// returned.
+func (c *Config) runHooks(stage string, taskErr error) error {
+	var first error
+
+	for _, hook := range c.hooks(stage) {
+		log.Printf("Running %s hook %s\n", stage, hook)
+
+		err := hook.run(c, taskErr)
+		if err == nil {
+			continue
+		}
+
+		err = fmt.Errorf("%s hook %s failed: %v", stage, hook, err)
+
+		policy := hook.OnFailure
+		if policy == "" {
+			policy = c.HookFailure
+		}
+
+		if policy == HookWarn {
+			log.Printf("Ignored failure: %v\n", err)
+			continue
+		}
+
+		if stage == PreBackup || stage == PreRestore {
+			return err
+		}
+
+		if first == nil {
+			first = err
+		}
+	}
+
+	return first
+}
+
+func (h Hook) run(c *Config, taskErr error) error {
+	timeout := h.Timeout
+	if timeout == 0 {
+		timeout = c.HookTimeout
+	}
+
+	if h.Func == nil {
+		var message string
+		if taskErr != nil {
+			message = taskErr.Error()
+		}
+
+		app := sources.CmdConfig{
+			Env:     append(os.Environ(), "AUTOBACKUP_HOOK="+h.Stage, "AUTOBACKUP_ERROR="+message),
+			Timeout: timeout,
+		}
+
+		return app.CmdRun(HookShell, "-c", h.Command)
+	}
+
+	var ctx context.Context
+	var cancel context.CancelFunc
+
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+
+	defer cancel()
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- h.Func(ctx, taskErr)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("timed out after %v", timeout)
+	}
+}
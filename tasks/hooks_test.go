@@ -0,0 +1,267 @@
+package tasks
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// recorder collects the steps of the tasks, the Func hooks run in their own
+// goroutine
+type recorder struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (rec *recorder) add(event string) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	rec.events = append(rec.events, event)
+}
+
+func (rec *recorder) list() []string {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	return rec.events
+}
+
+type stubSource struct {
+	events *recorder
+	err    error
+	panic  bool
+}
+
+func (s *stubSource) Backup() (string, error) {
+	s.events.add("backup")
+	if s.panic {
+		panic("backup crashed")
+	}
+
+	if s.err != nil {
+		return "", s.err
+	}
+
+	return "/tmp/stub-backup.bin", nil
+}
+
+func (s *stubSource) Restore(path string) error {
+	s.events.add("restore")
+	return s.err
+}
+
+type stubStore struct {
+	events *recorder
+}
+
+func (s *stubStore) Store(filepath string, filename string) error {
+	s.events.add("store")
+	return nil
+}
+
+func (s *stubStore) Retrieve(s3path string) (string, error) {
+	return "/tmp/" + s3path, nil
+}
+
+func (s *stubStore) RemoveOlderBackups(keep int) error {
+	s.events.add("retention")
+	return nil
+}
+
+func (s *stubStore) FindLatestBackup() (string, error) {
+	return "stub-backup.bin", nil
+}
+
+func (s *stubStore) Close() {}
+
+// hookSpec describes a Func hook failing with err, or blocking until its
+// context is done
+type hookSpec struct {
+	stage     string
+	err       error
+	onFailure string
+	block     bool
+}
+
+func TestBackupHooks(t *testing.T) {
+	failed := errors.New("hook failed")
+
+	tests := []struct {
+		name      string
+		failure   string
+		hooks     []hookSpec
+		backupErr error
+		wantErr   string
+		events    []string
+	}{
+		{
+			name:   "success",
+			hooks:  []hookSpec{{stage: PreBackup}, {stage: PostBackup}},
+			events: []string{PreBackup, "backup", PostBackup, "store", "retention"},
+		},
+		{
+			name:    "pre hook aborts",
+			hooks:   []hookSpec{{stage: PreBackup, err: failed}, {stage: PostBackup}},
+			wantErr: "pre-backup hook pre-backup failed: hook failed",
+			events:  []string{PreBackup, PostBackup + " after error"},
+		},
+		{
+			name:    "pre hook warns",
+			failure: HookWarn,
+			hooks:   []hookSpec{{stage: PreBackup, err: failed}, {stage: PostBackup}},
+			events:  []string{PreBackup, "backup", PostBackup, "store", "retention"},
+		},
+		{
+			name:      "backup fails",
+			hooks:     []hookSpec{{stage: PreBackup}, {stage: PostBackup}},
+			backupErr: errors.New("disk full"),
+			wantErr:   "source backup failed: disk full",
+			events:    []string{PreBackup, "backup", PostBackup + " after error"},
+		},
+		{
+			name:    "post hook aborts after the upload",
+			hooks:   []hookSpec{{stage: PostBackup, err: failed}, {stage: PostBackup}},
+			wantErr: "post-backup hook post-backup failed: hook failed",
+			events:  []string{"backup", PostBackup, PostBackup, "store", "retention"},
+		},
+		{
+			name:    "post hook warns",
+			failure: HookWarn,
+			hooks:   []hookSpec{{stage: PostBackup, err: failed}},
+			events:  []string{"backup", PostBackup, "store", "retention"},
+		},
+		{
+			name:    "hook warns over the abort policy",
+			failure: HookAbort,
+			hooks:   []hookSpec{{stage: PreBackup, err: failed, onFailure: HookWarn}},
+			events:  []string{PreBackup, "backup", "store", "retention"},
+		},
+		{
+			name:    "hook aborts over the warn policy",
+			failure: HookWarn,
+			hooks:   []hookSpec{{stage: PreBackup, err: failed, onFailure: HookAbort}, {stage: PostBackup}},
+			wantErr: "pre-backup hook pre-backup failed: hook failed",
+			events:  []string{PreBackup, PostBackup + " after error"},
+		},
+		{
+			name:    "hook times out",
+			hooks:   []hookSpec{{stage: PreBackup, block: true}, {stage: PostBackup}},
+			wantErr: "pre-backup hook pre-backup failed: timed out after 50ms",
+			events:  []string{PreBackup, PostBackup + " after error"},
+		},
+		{
+			name:    "unknown failure policy",
+			failure: "ignore",
+			hooks:   []hookSpec{{stage: PreBackup}, {stage: PostBackup}},
+			wantErr: `unknown hook failure policy "ignore"`,
+		},
+		{
+			name:    "unknown hook failure policy",
+			hooks:   []hookSpec{{stage: PreBackup, onFailure: "skip"}},
+			wantErr: `unknown hook failure policy "skip"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := require.New(t)
+
+			events := &recorder{}
+			c := &Config{
+				MaxBackups:  7,
+				HookTimeout: 50 * time.Millisecond,
+				HookFailure: tt.failure,
+			}
+
+			for _, spec := range tt.hooks {
+				spec := spec
+				c.Hooks = append(c.Hooks, Hook{
+					Stage:     spec.stage,
+					Name:      spec.stage,
+					OnFailure: spec.onFailure,
+					Func: func(ctx context.Context, taskErr error) error {
+						event := spec.stage
+						if taskErr != nil {
+							event += " after error"
+						}
+						events.add(event)
+
+						if spec.block {
+							<-ctx.Done()
+						}
+
+						return spec.err
+					},
+				})
+			}
+
+			err := BackupTask(c, &stubSource{events: events, err: tt.backupErr}, &stubStore{events: events})
+			if tt.wantErr == "" {
+				r.NoError(err)
+			} else {
+				r.Error(err)
+				r.Contains(err.Error(), tt.wantErr)
+			}
+
+			r.Equal(tt.events, events.list())
+		})
+	}
+}
+
+func TestRestoreHooks(t *testing.T) {
+	r := require.New(t)
+
+	events := &recorder{}
+	c := &Config{HookFailure: HookAbort}
+
+	for _, stage := range []string{PreRestore, PostRestore} {
+		stage := stage
+		c.Hooks = append(c.Hooks, Hook{
+			Stage: stage,
+			Func: func(ctx context.Context, taskErr error) error {
+				events.add(stage)
+				if stage == PreRestore {
+					return errors.New("hook failed")
+				}
+
+				return nil
+			},
+		})
+	}
+
+	// a failed pre hook prevents the restore, the post hooks still run
+	err := RestoreTask(c, &stubSource{events: events}, &stubStore{events: events})
+	r.Error(err)
+	r.Equal([]string{PreRestore, PostRestore}, events.list())
+}
+
+func TestBackupHooksPanic(t *testing.T) {
+	r := require.New(t)
+
+	events := &recorder{}
+	c := &Config{HookFailure: HookAbort}
+
+	var taskErr error
+
+	c.Hooks = append(c.Hooks, Hook{
+		Stage: PostBackup,
+		Func: func(ctx context.Context, err error) error {
+			events.add(PostBackup)
+			taskErr = err
+			return nil
+		},
+	})
+
+	// the application is resumed when the backup panics
+	r.Panics(func() {
+		BackupTask(c, &stubSource{events: events, panic: true}, &stubStore{events: events})
+	})
+
+	r.Equal([]string{"backup", PostBackup}, events.list())
+	r.EqualError(taskErr, "panic: backup crashed")
+}
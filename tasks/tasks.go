@@ -3,7 +3,9 @@ package tasks
 import (
 	"fmt"
 	"log"
+	"os"
 	"path"
+	"time"
 
 	"github.com/caarlos0/env"
 	"github.com/joho/godotenv"
@@ -18,34 +20,59 @@ type Config struct {
 	// shellComplete bool
 	// flagSet       *flag.FlagSet
 	// setFlags      map[string]bool
-	Schedule    string `env:"SCHEDULE" envDefault:"@daily"`
-	MaxBackups  int    `env:"MAX_BACKUPS" envDefault:"7"`
-	RestoreFile string `env:"RESTORE_FILE"`
-	RandomDelay int    `env:"RANDOM_DELAY" envDefault:"1"`
+	Schedule        string        `env:"SCHEDULE" envDefault:"@daily"`
+	MaxBackups      int           `env:"MAX_BACKUPS" envDefault:"7"`
+	RestoreFile     string        `env:"RESTORE_FILE"`
+	RandomDelay     int           `env:"RANDOM_DELAY" envDefault:"1"`
+	PreBackupHook   string        `env:"PRE_BACKUP_HOOK"`
+	PostBackupHook  string        `env:"POST_BACKUP_HOOK"`
+	PreRestoreHook  string        `env:"PRE_RESTORE_HOOK"`
+	PostRestoreHook string        `env:"POST_RESTORE_HOOK"`
+	HookTimeout     time.Duration `env:"HOOK_TIMEOUT" envDefault:"5m"`
+	HookFailure     string        `env:"HOOK_FAILURE" envDefault:"abort"`
+	Hooks           []Hook
 }
 
 func NewConfig() *Config {
+	// the settings may all come from the environment
+	if err := godotenv.Load(); err != nil && !os.IsNotExist(err) {
+		log.Printf("Error loading .env file: %v\n", err)
+	}
+
 	cfg := &Config{}
 	err := env.Parse(cfg)
 	if err != nil {
 		fmt.Printf("%+v\n", err)
 	}
+
+	cfg.Hooks = append(cfg.Hooks, registeredHooks...)
+
 	return cfg
 }
 
 type task func(c *Config) error
 
-func init() {
-	err := godotenv.Load()
-	if err != nil {
-		log.Fatal("Error loading .env file")
+func BackupTask(c *Config, source sources.Source, store stores.Store) (err error) {
+	var filepath string
+
+	if err = c.checkHooks(); err != nil {
+		return err
 	}
-}
 
-func BackupTask(c *Config, source sources.Source, store stores.Store) error {
-	filepath, err := source.Backup()
+	err, hookErr := c.withHooks(PreBackup, PostBackup, func() (err error) {
+		if filepath, err = source.Backup(); err != nil {
+			return fmt.Errorf("source backup failed: %v", err)
+		}
+
+		return nil
+	})
+
+	// a failure of the post hooks is only reported once the backup is stored
+	// and the retention done
+	defer func() { err = hookFailure(err, hookErr) }()
+
 	if err != nil {
-		return fmt.Errorf("source backup failed: %v", err)
+		return err
 	}
 
 	log.Printf("Backup saved to %s\n", filepath)
@@ -56,6 +83,13 @@ func BackupTask(c *Config, source sources.Source, store stores.Store) error {
 		return fmt.Errorf("couldn't upload file to store: %v", err)
 	}
 
+	// the next backups may be based on this one now it is stored
+	if committer, ok := source.(sources.Committer); ok {
+		if err = committer.Commit(filepath); err != nil {
+			return fmt.Errorf("couldn't commit backup state: %v", err)
+		}
+	}
+
 	err = store.RemoveOlderBackups(c.MaxBackups)
 	if err != nil {
 		return fmt.Errorf("couldn't remove old backups from store: %v", err)
@@ -68,6 +102,10 @@ func RestoreTask(c *Config, source sources.Source, store stores.Store) error {
 	var err error
 	var filename string
 
+	if err = c.checkHooks(); err != nil {
+		return err
+	}
+
 	if key := c.RestoreFile; key != "" {
 		// restore directly from this file
 		filename = key
@@ -86,9 +124,11 @@ func RestoreTask(c *Config, source sources.Source, store stores.Store) error {
 
 	defer store.Close()
 
-	if err = source.Restore(filepath); err != nil {
-		return fmt.Errorf("source restore failed: %v", err)
-	}
+	return hookFailure(c.withHooks(PreRestore, PostRestore, func() error {
+		if err := source.Restore(filepath); err != nil {
+			return fmt.Errorf("source restore failed: %v", err)
+		}
 
-	return nil
+		return nil
+	}))
 }
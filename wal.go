@@ -0,0 +1,55 @@
+package autobackup
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/sbusso/autobackup/sources"
+	"github.com/sbusso/autobackup/stores"
+)
+
+// siblingPrefix returns the prefix next to the backups one where name is
+// stored, outside of it so the listings of the backups never include it
+func siblingPrefix(prefix, name string) string {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return name
+	}
+
+	return prefix + "-" + name
+}
+
+func newWALArchive() (*sources.WALArchive, error) {
+	s3, err := stores.NewS3Config()
+	if err != nil {
+		return nil, fmt.Errorf("an error occured getting config: %v", err)
+	}
+
+	// segments are kept apart from the backups, retention doesn't apply to them
+	s3.Prefix = siblingPrefix(s3.Prefix, "wal")
+	s3.Partition = false
+
+	return sources.NewWALArchive(s3, map[string]interface{}{"SaveDir": s3.SaveDir}), nil
+}
+
+// ArchiveWAL ships a WAL segment to S3, to be called from the postgres
+// archive_command with %p and %f
+func ArchiveWAL(walPath, walName string) error {
+	archive, err := newWALArchive()
+	if err != nil {
+		return err
+	}
+
+	return archive.Push(walPath, walName)
+}
+
+// FetchWAL retrieves a WAL segment from S3, to be called from the postgres
+// restore_command with %f and %p
+func FetchWAL(walName, dest string) error {
+	archive, err := newWALArchive()
+	if err != nil {
+		return err
+	}
+
+	return archive.Fetch(walName, dest)
+}